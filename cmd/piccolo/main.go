@@ -10,8 +10,27 @@ import (
 	"github.com/james-hester/piccolo/internal"
 )
 
+// defines collects -D options.
+type defines map[string]int
+
+func (d defines) String() string {
+	return fmt.Sprint(map[string]int(d))
+}
+
+func (d defines) Set(s string) error {
+	name, val, err := internal.ParseDefine(s)
+	if err != nil {
+		return err
+	}
+	d[name] = val
+	return nil
+}
+
 func main() {
+	consts := defines{}
+	flag.Var(consts, "D", "Set a constant, overriding its declaration: -D name=value (repeatable)")
 	asm := flag.Bool("S", false, "Print assembly output")
+	sym := flag.Bool("sym", false, "Write a .sym file listing the address of every symbol")
 	flag.Parse()
 
 	if flag.NArg() < 1 {
@@ -33,13 +52,16 @@ func main() {
 		os.Exit(1)
 	}
 
-	prog, err := internal.Parse(tokens)
+	prog, err := internal.ParseWithDefines(tokens, consts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Parsing error: %v\n", err)
 		os.Exit(1)
 	}
 
-	ops, syms, err := internal.Compile(prog)
+	ops, syms, warnings, err := internal.CompileWithWarnings(prog)
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, w.Error())
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Compilation error: %v\n", err)
 		os.Exit(1)
@@ -58,7 +80,8 @@ func main() {
 		os.Exit(1)
 	}
 
-	outputFile := strings.TrimSuffix(inputFile, filepath.Ext(inputFile)) + ".hex"
+	base := strings.TrimSuffix(inputFile, filepath.Ext(inputFile))
+	outputFile := base + ".hex"
 	f, err := os.Create(outputFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
@@ -71,5 +94,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *sym {
+		symFile := base + ".sym"
+		sf, err := os.Create(symFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating symbol file: %v\n", err)
+			os.Exit(1)
+		}
+		defer sf.Close()
+		if err := internal.WriteSymbols(sf, ops, syms); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing symbol file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	fmt.Printf("Successfully compiled %s to %s\n", inputFile, outputFile)
 }
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Variables live in general purpose RAM: 0x20-0x6F of each bank, plus
+// the 16 bytes of common RAM at 0x70-0x7F that every bank shares.
+// Pinned variables and overlays are placed first. Everything else then
+// takes the first free space of its kind, in name order, without
+// straddling banks. Variables with initial values go before the rest so
+// that the startup code can copy them in long runs.
+
+const lastGPRBank = 30 // bank 31 holds only SFRs
+
+// ram tracks which bytes of general purpose RAM are taken, and by what.
+type ram struct {
+	owner map[int]string
+}
+
+func newRAM() *ram {
+	return &ram{owner: map[int]string{}}
+}
+
+// isGPR reports whether addr is general purpose RAM. Common RAM is only
+// accepted at its bank 0 addresses.
+func isGPR(addr int) bool {
+	if addr >= 0x70 && addr <= 0x7F {
+		return true
+	}
+	bank, offset := addr>>7, addr&0x7F
+	return addr >= 0 && bank <= lastGPRBank && offset >= 0x20 && offset <= 0x6F
+}
+
+// pin claims size bytes at addr for name, which was declared at rng.
+func (r *ram) pin(addr, size int, name string, rng Range) DiagnosticList {
+	for a := addr; a < addr+size; a++ {
+		if !isGPR(a) {
+			return DiagnosticList{{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("%s at $%X: $%X is not general purpose RAM, which is $20-$6F of each bank and $70-$7F", name, addr, a),
+				Range:   rng,
+			}}
+		}
+		if other, ok := r.owner[a]; ok {
+			return DiagnosticList{{
+				Code:    ErrType,
+				Message: fmt.Sprintf("%s at $%X overlaps %s", name, addr, other),
+				Range:   rng,
+			}}
+		}
+	}
+	for a := addr; a < addr+size; a++ {
+		r.owner[a] = name
+	}
+	return nil
+}
+
+// alloc claims the first free run of size bytes in common RAM, or else
+// in the banks.
+func (r *ram) alloc(common bool, size int, name string) (int, bool) {
+	var regions [][2]int
+	if common {
+		regions = [][2]int{{0x70, 0x7F}}
+	} else {
+		for bank := 0; bank <= lastGPRBank; bank++ {
+			regions = append(regions, [2]int{bank<<7 | 0x20, bank<<7 | 0x6F})
+		}
+	}
+	for _, region := range regions {
+	next:
+		for addr := region[0]; addr+size-1 <= region[1]; addr++ {
+			for a := addr; a < addr+size; a++ {
+				if _, ok := r.owner[a]; ok {
+					continue next
+				}
+			}
+			for a := addr; a < addr+size; a++ {
+				r.owner[a] = name
+			}
+			return addr, true
+		}
+	}
+	return 0, false
+}
+
+func outOfRAM(common bool, what string, rng Range) Diagnostic {
+	kind := "banked"
+	if common {
+		kind = "common"
+	}
+	return Diagnostic{
+		Code:    ErrUnknown,
+		Message: fmt.Sprintf("out of %s RAM for %s", kind, what),
+		Range:   rng,
+	}
+}
+
+// allocate assigns an address to every variable in prog and returns the
+// RAM left over.
+func allocate(prog Program) (*ram, DiagnosticList) {
+	r := newRAM()
+	var diagnostics DiagnosticList
+
+	inOverlay := map[string]bool{}
+	for _, o := range prog.Overlays {
+		for _, member := range o.Members {
+			for _, name := range member {
+				inOverlay[name] = true
+			}
+		}
+	}
+	var names []string
+	for name := range prog.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		v := prog.Variables[name]
+		if !v.Pinned || inOverlay[name] {
+			continue
+		}
+		diagnostics = append(diagnostics, r.pin(v.Address, v.Size(), name, v.Range)...)
+		v.Banked = v.Address < 0x70 || v.Address > 0x7F
+		prog.Variables[name] = v
+	}
+
+	for _, pinned := range []bool{true, false} {
+		for _, o := range prog.Overlays {
+			if o.Pinned != pinned {
+				continue
+			}
+			var all []string
+			size := 0
+			for _, member := range o.Members {
+				n := 0
+				for _, name := range member {
+					n += prog.Variables[name].Size()
+				}
+				size = max(size, n)
+				all = append(all, member...)
+			}
+			what := "the overlay of " + strings.Join(all, ", ")
+			if size == 0 {
+				continue
+			}
+
+			base := o.Address
+			if pinned {
+				if d := r.pin(base, size, what, o.Range); d != nil {
+					diagnostics = append(diagnostics, d...)
+					continue
+				}
+			} else {
+				var ok bool
+				if base, ok = r.alloc(!o.Banked, size, what); !ok {
+					diagnostics = append(diagnostics, outOfRAM(!o.Banked, what, o.Range))
+					continue
+				}
+			}
+			for _, member := range o.Members {
+				addr := base
+				for _, name := range member {
+					v := prog.Variables[name]
+					v.Address = addr
+					addr += v.Size()
+					prog.Variables[name] = v
+				}
+			}
+		}
+	}
+
+	for _, init := range []bool{true, false} {
+		for _, name := range names {
+			v := prog.Variables[name]
+			if v.Pinned || inOverlay[name] || (v.Init != nil) != init {
+				continue
+			}
+			addr, ok := r.alloc(!v.Banked, v.Size(), name)
+			if !ok {
+				diagnostics = append(diagnostics, outOfRAM(!v.Banked, name, v.Range))
+				continue
+			}
+			v.Address = addr
+			prog.Variables[name] = v
+		}
+	}
+	return r, diagnostics
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParsePlacement(t *testing.T) {
+	input := `
+section data
+banked:
+  boot i8 at $25
+  wide i16 at $A0
+  overlay at $40 begin
+    begin count i8 sum i16 end
+    scratch i8
+  end
+`
+	toks, err := Lex(input)
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	prog, err := Parse(toks)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if v := prog.Variables["boot"]; !v.Pinned || v.Address != 0x25 || v.Type != "i8" {
+		t.Errorf("boot: expected i8 pinned at $25, got %+v", v)
+	}
+	if v := prog.Variables["wide"]; !v.Pinned || v.Address != 0xA0 || v.Type != "i16" {
+		t.Errorf("wide: expected i16 pinned at $A0, got %+v", v)
+	}
+	if len(prog.Overlays) != 1 {
+		t.Fatalf("expected 1 overlay, got %d", len(prog.Overlays))
+	}
+	o := prog.Overlays[0]
+	if !o.Pinned || o.Address != 0x40 || !o.Banked {
+		t.Errorf("expected a banked overlay pinned at $40, got %+v", o)
+	}
+	want := [][]string{{"count", "sum"}, {"scratch"}}
+	if !slices.EqualFunc(o.Members, want, slices.Equal) {
+		t.Errorf("expected members %v, got %v", want, o.Members)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	input := `
+section data
+common:
+  a i8
+  b i8 at $71
+  c i16
+  overlay begin
+    begin rx i8 rxsum i16 end
+    tx i8
+  end
+banked:
+  d i8
+  e i8 at $20
+  f i16
+  overlay at $30 begin
+    begin p i8 q i8 end
+    r i16
+    s i8
+  end
+  g i8 at $6F
+  h i16
+`
+	_, syms, err := compileBody(input)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	want := map[string]int{
+		"b":     0x71, // pinned
+		"e":     0x20,
+		"g":     0x6F,
+		"p":     0x30, // pinned overlay
+		"q":     0x31,
+		"r":     0x30,
+		"s":     0x30,
+		"rx":    0x72, // overlays before other variables
+		"rxsum": 0x73,
+		"tx":    0x72,
+		"a":     0x70,
+		"c":     0x75,
+		"d":     0x21,
+		"f":     0x22,
+		"h":     0x24,
+	}
+	for name, addr := range want {
+		if got, _ := syms.GetAddress(name); got != addr {
+			t.Errorf("%s: expected $%X, got $%X", name, addr, got)
+		}
+	}
+}
+
+func TestAllocateBanks(t *testing.T) {
+	// 0x20-0x6F is 80 bytes, so the 41st i16 doesn't fit in bank 0 and
+	// goes to bank 1 rather than straddling into common RAM.
+	var sb strings.Builder
+	sb.WriteString("section data\nbanked:\n")
+	for i := range 41 {
+		sb.WriteString("  v" + string(rune('a'+i/26)) + string(rune('a'+i%26)) + " i16\n")
+	}
+	sb.WriteString("  x i8\n")
+	_, syms, err := compileBody(sb.String())
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	if got, _ := syms.GetAddress("vbo"); got != 0xA0 {
+		t.Errorf("expected the 41st i16 at $A0, got $%X", got)
+	}
+	if got, _ := syms.GetAddress("x"); got != 0xA2 {
+		t.Errorf("expected x at $A2, got $%X", got)
+	}
+}
+
+func TestAllocateErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		msg  string
+	}{
+		{"banked:\n  a i8 at $25\n  b i8 at $25", "b at $25 overlaps a"},
+		{"banked:\n  a i16 at $25\n  b i8 at $26", "b at $26 overlaps a"},
+		{"banked:\n  a i8 at $0C", "a at $C: $C is not general purpose RAM"},
+		{"banked:\n  a i8 at $F0", "a at $F0: $F0 is not general purpose RAM"},
+		{"banked:\n  a i8 at $FA0", "is not general purpose RAM"},
+		{"banked:\n  a i16 at $EF", "a at $EF: $F0 is not general purpose RAM"},
+		{"banked:\n  a i8 at $40\n  overlay at $3F begin x i16 y i8 end", "the overlay of x, y at $3F overlaps a"},
+		{"banked:\n  overlay begin x i8 at $30 end", "x is in an overlay, so place the overlay instead"},
+		{"common:\n  big i16 at $7F", "$80 is not general purpose RAM"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody("section data\n" + tt.data + "\n")
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.data, tt.msg, err)
+		}
+	}
+}
+
+func TestAllocateOutOfCommonRAM(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("section data\ncommon:\n")
+	for i := range 17 {
+		sb.WriteString("  v" + string(rune('a'+i)) + " i8\n")
+	}
+	if _, _, err := compileBody(sb.String()); err == nil || !strings.Contains(err.Error(), "out of common RAM for vq") {
+		t.Errorf("expected out of common RAM for vq, got %v", err)
+	}
+}
@@ -19,6 +19,19 @@ type Fixup struct {
 	Index int    // Index in Words
 	Label string // Label to resolve
 	Mask  uint16 // Mask to apply (usually 0x7FF for GOTO/CALL)
+	Shift int    // Bits to shift the address right by before masking
+}
+
+// scratchSymbols returns a copy of syms to encode a program with when
+// only its size or layout is wanted, so the labels it defines stay out
+// of syms.
+func scratchSymbols(syms SymbolTable) SymbolTable {
+	scratch := NewSymbolTable()
+	for _, name := range syms.Names() {
+		addr, _ := syms.GetAddress(name)
+		scratch.SetAddress(name, addr)
+	}
+	return scratch
 }
 
 // NewAssemblerContext creates a new context.
@@ -40,12 +53,9 @@ func (ctx *AssemblerContext) Emit(word uint16) {
 
 // EnsureBank emits a MOVLB instruction if the address is in a different bank.
 func (ctx *AssemblerContext) EnsureBank(addr int) {
-	// Common RAM (0x70-0x7F) is accessible from any bank on many PICs.
-	// We assume standard banking for PIC16F1xxx.
-	// Bank size is 128 bytes (0x80).
-
-	// If addr is common (0x70-0x7F), we don't need to switch.
-	if addr >= 0x70 && addr <= 0x7F {
+	// Common RAM (0x70-0x7F) and the core registers can be reached from
+	// any bank. Bank size is 128 bytes (0x80).
+	if unbanked(addr) {
 		return
 	}
 
@@ -68,15 +78,24 @@ func (ctx *AssemblerContext) AddFixup(label string, mask uint16) {
 	})
 }
 
+// AddShiftedFixup records a fixup for part of a label's address, such
+// as its high byte.
+func (ctx *AssemblerContext) AddShiftedFixup(label string, shift int, mask uint16) {
+	ctx.Fixups = append(ctx.Fixups, Fixup{
+		Index: len(ctx.Words),
+		Label: label,
+		Mask:  mask,
+		Shift: shift,
+	})
+}
+
 // Assemble converts a list of PicOp into machine code using the context.
 func Assemble(ops []PicOp, syms SymbolTable) ([]uint16, map[int]uint16, error) {
 	ctx := NewAssemblerContext(syms)
 
 	// Pass 1: Emit code and collect fixups
-	for _, op := range ops {
-		if err := op.Encode(ctx); err != nil {
-			return nil, nil, err
-		}
+	if _, err := ctx.encode(ops); err != nil {
+		return nil, nil, err
 	}
 
 	// Pass 2: Apply fixups
@@ -87,12 +106,43 @@ func Assemble(ops []PicOp, syms SymbolTable) ([]uint16, map[int]uint16, error) {
 		}
 		// Apply fixup
 		// We assume the word at Index has 0s where the address goes
-		ctx.Words[fixup.Index] |= (uint16(addr) & fixup.Mask)
+		ctx.Words[fixup.Index] |= (uint16(addr>>fixup.Shift) & fixup.Mask)
 	}
 
 	return ctx.Words, ctx.Config, nil
 }
 
+// encode emits ops, returning the number of words each one took. The
+// bank selected before each op is the one bankStates finds, and a skip
+// must be followed by a single word, not a MOVLB and the instruction it
+// selects the bank for.
+func (ctx *AssemblerContext) encode(ops []PicOp) ([]int, error) {
+	banks := bankStates(ops, func(f string) (int, bool) {
+		addr, err := resolveAddr(ctx, f)
+		return addr, err == nil
+	})
+	words := make([]int, len(ops))
+	skip := -1
+	for i, op := range ops {
+		start := len(ctx.Words)
+		ctx.CurrentBank = banks[i]
+		if err := op.Encode(ctx); err != nil {
+			return nil, err
+		}
+		words[i] = len(ctx.Words) - start
+		if words[i] > 0 {
+			if skip >= 0 && words[i] > 1 {
+				return nil, fmt.Errorf("the skip at 0x%X would only skip the bank switch before %s", skip, op.Assembly())
+			}
+			skip = -1
+			if isSkip(op) {
+				skip = len(ctx.Words) - 1
+			}
+		}
+	}
+	return words, nil
+}
+
 // WriteHex writes the machine code in Intel HEX format.
 func WriteHex(w io.Writer, words []uint16, config map[int]uint16) error {
 	// Intel HEX format
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// Asserts are checked once the program is parsed and fosc is known, so
+// they can check constants worked out from units, such as a timer
+// reload. Budgets are checked where the figure they limit is known: the
+// stack with the call graph, and the size of the program once it is
+// encoded.
+
+// checkAsserts reports the asserts that don't hold.
+func (c *asmGen) checkAsserts() DiagnosticList {
+	var diagnostics DiagnosticList
+	for _, a := range c.prog.Asserts {
+		holds, ok, err := c.truth(a.Cond)
+		switch {
+		case err != nil:
+			diagnostics = append(diagnostics, asDiagnostic(err, a.Range))
+		case !ok:
+			diagnostics = append(diagnostics, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("assert needs a constant condition, got %v", a.Cond),
+				Range:   a.Cond.Position(),
+			})
+		case !holds:
+			diagnostics = append(diagnostics, Diagnostic{
+				Code:    ErrType,
+				Message: "assertion failed: " + a.Message,
+				Range:   a.Range,
+			})
+		}
+	}
+	return diagnostics
+}
+
+// truth evaluates e as a constant condition. ok is false if e is not
+// constant. A comparison of a quantity with a plain number compares the
+// number with the quantity's value in cycles, as adding them would.
+func (c *asmGen) truth(e Expr) (bool, bool, error) {
+	switch e := e.(type) {
+	case UnaryExpr:
+		if e.Op == NOT {
+			holds, ok, err := c.truth(e.Expr)
+			return !holds, ok, err
+		}
+	case BinaryExpr:
+		switch e.Op {
+		case AND, OR:
+			a, ok, err := c.truth(e.Lhs)
+			if err != nil || !ok {
+				return false, false, err
+			}
+			b, ok, err := c.truth(e.Rhs)
+			if err != nil || !ok {
+				return false, false, err
+			}
+			if e.Op == AND {
+				return a && b, true, nil
+			}
+			return a || b, true, nil
+		case EQEQ, NEQ, LT, GT, LE, GE:
+			a, ok, err := c.quantity(e.Lhs)
+			if err != nil || !ok {
+				return false, false, err
+			}
+			b, ok, err := c.quantity(e.Rhs)
+			if err != nil || !ok {
+				return false, false, err
+			}
+			switch {
+			case a.Unit == b.Unit:
+			case a.Unit == NoUnit:
+				b.Value, err = c.unitValue(b, e.Rhs)
+			case b.Unit == NoUnit:
+				a.Value, err = c.unitValue(a, e.Lhs)
+			default:
+				err = Diagnostic{
+					Code:    ErrType,
+					Message: fmt.Sprintf("mismatched units: %v compares a %s with a %s", e, a.Unit, b.Unit),
+					Range:   e.Range,
+				}
+			}
+			if err != nil {
+				return false, false, err
+			}
+			return compareOp(e.Op, a.Value, b.Value), true, nil
+		}
+	}
+	val, ok, err := c.unitConst(e)
+	return val != 0, ok, err
+}
+
+// checkBudgets reports a program larger than its words budget. It
+// encodes ops to count them, so the compiler temporaries in syms must
+// already have addresses.
+func (c *asmGen) checkBudgets(ops []PicOp, syms SymbolTable) DiagnosticList {
+	b, ok := c.prog.Budgets[budgetWords]
+	if !ok {
+		return nil
+	}
+	ctx := NewAssemblerContext(scratchSymbols(syms))
+	if _, err := ctx.encode(ops); err != nil {
+		// Assembling the program will report it.
+		return nil
+	}
+	if len(ctx.Words) <= b.Limit {
+		return nil
+	}
+	return DiagnosticList{{
+		Code:    ErrType,
+		Message: fmt.Sprintf("program is %d words, over its budget of %d", len(ctx.Words), b.Limit),
+		Range:   b.Range,
+	}}
+}
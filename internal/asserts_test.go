@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+const assertsHeader = `
+section constants
+tick: 1ms
+baud: 9600baud
+mode: 2
+section configuration
+fosc: 32MHz
+section data
+common:
+  x i8
+section program
+fn main() begin
+  x = 1
+end
+`
+
+func TestLexComparisons(t *testing.T) {
+	toks, err := Lex("< <= > >= << >>")
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	for i, want := range []TTy{LT, LE, GT, GE, SHL, SHR} {
+		if toks[i].ty != want {
+			t.Errorf("token %d: expected %v, got %v", i, want, toks[i].ty)
+		}
+	}
+}
+
+func TestAsserts(t *testing.T) {
+	tests := []struct {
+		assert string
+		holds  bool
+	}{
+		{"mode == 2", true},
+		{"mode < 2", false},
+		{"mode >= 2 and not (mode > 2)", true},
+		{"tick / 250us <= 4", true},
+		{"tick < 500us or mode != 2", false},
+		{"256 - 25us > 0", true}, // 25us is 200 cycles
+		{"25us < 200", false},
+		{"38400baud <= 206", false},
+		{"mode", true},
+		{"mode - 2", false},
+	}
+	for _, tt := range tests {
+		for _, section := range []string{"constants", "configuration", "data", "program"} {
+			input := assertsHeader + "section " + section + "\nassert " + tt.assert + ", \"out of range\"\n"
+			_, _, err := compileBody(input)
+			switch {
+			case tt.holds && err != nil:
+				t.Errorf("%s in %s: expected to hold, got %v", tt.assert, section, err)
+			case !tt.holds && (err == nil || !strings.Contains(err.Error(), "assertion failed: out of range")):
+				t.Errorf("%s in %s: expected to fail, got %v", tt.assert, section, err)
+			}
+		}
+	}
+
+	// Only the asserts of a true when count.
+	input := assertsHeader + "section constants\nwhen mode > 5 begin\n  assert mode == 0, \"never\"\nend\n"
+	if _, _, err := compileBody(input); err != nil {
+		t.Errorf("expected the assert in a false when to be dropped, got %v", err)
+	}
+}
+
+func TestAssertErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		msg   string
+	}{
+		{"section constants\nassert x == 1, \"x\"\n", "assert needs a constant condition, got x EQEQ 1"},
+		{"section constants\nassert tick < 1MHz, \"x\"\n", "mismatched units: tick LT 1MHz compares a time with a frequency"},
+		{"section constants\nassert mode == 2\n", "expected , and a message after assert condition"},
+		{"section constants\nassert mode == 2, mode\n", "expected a message string after assert condition"},
+		{"section configuration\nbudget time: 5\n", "unknown budget time; expected words or stack"},
+		{"section configuration\nbudget words: 1ms\n", "budget words needs a plain number, got 1ms"},
+		{"section configuration\nbudget stack: 4\nbudget stack: 5\n", "budget stack is already declared"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody(assertsHeader + tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.msg, err)
+		}
+	}
+}
+
+func TestBudgets(t *testing.T) {
+	const calls = `
+section data
+common:
+  x i8
+section program
+fn main() begin
+  a()
+end
+fn a() begin
+  b()
+end
+fn b() begin
+  x = 1
+end
+`
+	_, _, err := compileBody("section configuration\nbudget stack: 2\n" + calls)
+	if err != nil {
+		t.Errorf("expected calls two deep to fit a budget of 2, got %v", err)
+	}
+	_, _, err = compileBody("section configuration\nbudget stack: 1\n" + calls)
+	if err == nil || !strings.Contains(err.Error(), "calls nest 2 deep, but the stack budget is 1: at $0 -> main -> a -> b") {
+		t.Errorf("expected the stack budget to be exceeded, got %v", err)
+	}
+
+	for _, tt := range []struct {
+		limit string
+		msg   string
+	}{
+		{"1000", ""},
+		{"5", "2:1: program is"},
+	} {
+		_, _, err := compileBody("section configuration\nbudget words: " + tt.limit + "\n" + calls)
+		switch {
+		case tt.msg == "" && err != nil:
+			t.Errorf("budget %s: expected the program to fit, got %v", tt.limit, err)
+		case tt.msg != "" && (err == nil || !strings.Contains(err.Error(), tt.msg) || !strings.Contains(err.Error(), "over its budget of 5")):
+			t.Errorf("budget %s: expected error containing %q, got %v", tt.limit, tt.msg, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// An atomic block runs with interrupts disabled. It saves GIE in a bit
+// of a compiler temporary, clears it, and restores it at the end and
+// before every return inside the block. Each block has its own bit so
+// that a block in a called function can't overwrite its caller's.
+// Blocks nested in another are compiled as plain blocks, since GIE is
+// already clear. The temporaries live in common RAM and INTCON is a
+// core register, so none of the skips here can be thrown off by a
+// bank switch inserted between the skip and its target.
+
+// gieSave is the bit holding the GIE of the code around an atomic block.
+type gieSave struct {
+	f string
+	b int
+}
+
+func (c *asmGen) compileAtomic(s AtomicStmt) ([]PicOp, error) {
+	body := BlockStmt{Body: s.Body, Range: s.Range}
+	if c.gie != nil {
+		return c.compileStmt(body)
+	}
+
+	save := &gieSave{f: c.temp(fmt.Sprintf("gie%d", c.atomics/8)), b: c.atomics % 8}
+	c.atomics++
+	intcon := hexAddr(regINTCON)
+	ops := []PicOp{
+		Bcf{F: save.f, B: save.b},
+		Btfsc{F: intcon, B: intconGIE},
+		Bsf{F: save.f, B: save.b},
+		Bcf{F: intcon, B: intconGIE},
+	}
+
+	c.gie = save
+	defer func() { c.gie = nil }()
+	compiled, err := c.compileStmt(body)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, compiled...)
+	return append(ops, c.restoreGIE()...), nil
+}
+
+// restoreGIE returns code restoring the GIE saved by the enclosing
+// atomic block, if there is one.
+func (c *asmGen) restoreGIE() []PicOp {
+	if c.gie == nil {
+		return nil
+	}
+	return []PicOp{
+		Btfsc{F: c.gie.f, B: c.gie.b},
+		Bsf{F: hexAddr(regINTCON), B: intconGIE},
+	}
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+const atomicData = "section data\ncommon:\n  x i8\n  done i8\nsection program\n"
+
+func TestCompileAtomic(t *testing.T) {
+	ops, _, err := compileBody(atomicData + `
+fn main() begin
+  atomic begin
+    x = 1
+    return
+  end
+end
+fn other() begin
+  atomic begin
+    atomic begin
+      x = 2
+    end
+  end
+end
+`)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	expected := []string{
+		"main:",
+		"BCF _gie0,0",
+		"BTFSC 0xB,7",
+		"BSF _gie0,0",
+		"BCF 0xB,7",
+		"MOVLW 1",
+		"MOVWF 0x71",
+		"BTFSC _gie0,0",
+		"BSF 0xB,7",
+		"RETURN",
+		"BTFSC _gie0,0",
+		"BSF 0xB,7",
+		"other:",
+		"BCF _gie0,1",
+		"BTFSC 0xB,7",
+		"BSF _gie0,1",
+		"BCF 0xB,7",
+		"MOVLW 2",
+		"MOVWF 0x71",
+		"BTFSC _gie0,1",
+		"BSF 0xB,7",
+	}
+	var got []string
+	for _, op := range ops {
+		got = append(got, op.Assembly())
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// TestAtomicExits runs every way out of an atomic block, with
+// interrupts enabled and disabled beforehand, and checks that GIE is
+// cleared inside and back as it was afterwards.
+func TestAtomicExits(t *testing.T) {
+	ops, _, err := compileBody(atomicData + `
+fn main() begin
+  atomic begin
+    x = 1
+    if done == 1 then return
+    case done of
+      2: return
+      3: begin x = 3 return end
+    end
+    x = 2
+  end
+  done = 0
+  return
+end
+`)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	tests := []struct {
+		done int
+		x    int
+	}{{0, 2}, {1, 1}, {2, 1}, {3, 3}}
+	for _, tt := range tests {
+		for _, gie := range []int{0, 0x80} {
+			m := newCPU(t, ops, map[string]int{"0xB": gie | 0x10, "0x70": tt.done})
+			m.run(0)
+			if got := m.regs["0xB"]; got != gie|0x10 {
+				t.Errorf("done = %d, INTCON = 0x%02X: INTCON is 0x%02X afterwards", tt.done, gie|0x10, got)
+			}
+			if m.regs["0x71"] != tt.x {
+				t.Errorf("done = %d: expected x = %d, got %d", tt.done, tt.x, m.regs["0x71"])
+			}
+		}
+	}
+}
+
+func TestAtomicClearsGIE(t *testing.T) {
+	ops, _, err := compileBody(atomicData + "fn main() begin\n  atomic begin\n    x = 1\n  end\nend\n")
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	for i, op := range ops {
+		if mov, ok := op.(Movwf); ok && mov.F == "0x71" {
+			m := newCPU(t, ops[:i], map[string]int{"0xB": 0x80})
+			m.run(0)
+			if m.regs["0xB"]&0x80 != 0 {
+				t.Errorf("GIE is still set in the body")
+			}
+			return
+		}
+	}
+	t.Fatal("body not found")
+}
+
+func TestAtomicErrors(t *testing.T) {
+	toks, err := Lex("section program\nfn main() begin\n  atomic x = 1\nend\n")
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	if _, err := Parse(toks); err == nil || !strings.Contains(err.Error(), "expected begin after atomic") {
+		t.Errorf("expected an error about the missing begin, got %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package internal
+
+import "slices"
+
+// The bank selected at each instruction is worked out by following the
+// program's control flow: falling through, branches, skips, the GOTO
+// tables after a BRW, and calls, after which the bank is the one the
+// callee returns with. A bank is known at an instruction if every way of
+// reaching it selects that bank, and the assembler only adds a MOVLB
+// where the bank is unknown or different. BSR is cleared by a reset. It
+// is unknown after any other ORG, as its padding may hold the interrupt
+// vector, and at labels whose address is taken, such as function tables.
+
+const (
+	bankUnknown   = -1 // reached with different or unknown banks
+	bankUnreached = -2 // not reached, or not yet
+)
+
+// joinBank returns the bank known after coming from a or from b.
+func joinBank(a, b int) int {
+	switch {
+	case a == bankUnreached || a == b:
+		return b
+	case b == bankUnreached:
+		return a
+	}
+	return bankUnknown
+}
+
+// bankAfter returns the bank selected after op runs in bank. resolve
+// returns the address of a register operand.
+func bankAfter(op PicOp, bank int, resolve func(string) (int, bool)) int {
+	f, ok := fileOperand(op)
+	if !ok {
+		return bank
+	}
+	addr, ok := resolve(f)
+	switch {
+	case !ok:
+		// A name only the assembler can resolve.
+		return bankUnknown
+	case addr&0x7F == regBSR:
+		// Whatever is written to BSR isn't followed.
+		return bankUnknown
+	case unbanked(addr):
+		return bank
+	}
+	return (addr >> 7) & 0x1F
+}
+
+// bankStates returns the bank selected on reaching each of ops, or
+// bankUnknown if it isn't known.
+func bankStates(ops []PicOp, resolve func(string) (int, bool)) []int {
+	labels := map[string]int{}
+	for i, op := range ops {
+		if l, ok := op.(LabelOp); ok {
+			labels[l.Name] = i
+		}
+	}
+
+	in := make([]int, len(ops))
+	for i := range in {
+		in[i] = bankUnreached
+	}
+	enter := func(i, bank int) bool {
+		if i >= len(ops) {
+			return false
+		}
+		b := joinBank(in[i], bank)
+		if b == in[i] {
+			return false
+		}
+		in[i] = b
+		return true
+	}
+	if len(ops) == 0 {
+		return in
+	}
+	// Configuration words may come before the reset vector, so it is
+	// looked for rather than taken to be the first op.
+	reset := slices.IndexFunc(ops, func(op PicOp) bool {
+		org, ok := op.(OrgOp)
+		return ok && org.Address == 0
+	})
+	if reset >= 0 {
+		in[reset] = 0
+	} else {
+		in[0] = bankUnknown
+	}
+	taken := func(label string) {
+		if i, ok := labels[label]; ok {
+			enter(i, bankUnknown)
+		}
+	}
+	for i, op := range ops {
+		switch op := op.(type) {
+		case OrgOp:
+			if i != reset {
+				enter(i, bankUnknown)
+			}
+		case AddlwLow:
+			taken(op.Label)
+		case MovlwLow:
+			taken(op.Label)
+		case MovlwHigh:
+			taken(op.Label)
+		}
+	}
+
+	// next returns the ops control goes to from ops[i], a call going on
+	// to the op after it.
+	next := func(i int) []int {
+		switch op := ops[i].(type) {
+		case Goto:
+			if j, ok := labels[op.Label]; ok {
+				return []int{j}
+			}
+			return nil
+		case Return, Retlw, Retfie:
+			return nil
+		case Brw:
+			var js []int
+			for j := i + 1; j < len(ops); j++ {
+				if _, ok := ops[j].(Goto); !ok {
+					break
+				}
+				js = append(js, j)
+			}
+			return js
+		}
+		js := []int{i + 1}
+		if isSkip(ops[i]) {
+			j := i + 1
+			for j < len(ops) && codeWords(ops[j:j+1]) == 0 {
+				j++
+			}
+			js = append(js, j+1)
+		}
+		return js
+	}
+
+	// The returns a call to each label can reach without making another
+	// call, which together give the bank it returns with.
+	returns := map[string][]int{}
+	for _, op := range ops {
+		call, ok := op.(CallOp)
+		if !ok {
+			continue
+		}
+		if _, ok := returns[call.Label]; ok {
+			continue
+		}
+		var rets []int
+		if start, ok := labels[call.Label]; ok {
+			seen := map[int]bool{start: true}
+			for work := []int{start}; len(work) > 0; {
+				i := work[len(work)-1]
+				work = work[:len(work)-1]
+				switch ops[i].(type) {
+				case Return, Retlw:
+					rets = append(rets, i)
+				}
+				for _, j := range next(i) {
+					if j < len(ops) && !seen[j] {
+						seen[j] = true
+						work = append(work, j)
+					}
+				}
+			}
+		}
+		returns[call.Label] = rets
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i, op := range ops {
+			bank := in[i]
+			if bank == bankUnreached {
+				continue
+			}
+			var out int
+			switch op := op.(type) {
+			case CallOp:
+				if start, ok := labels[op.Label]; ok {
+					changed = enter(start, bank) || changed
+				}
+				out = bankUnreached
+				for _, r := range returns[op.Label] {
+					out = joinBank(out, in[r])
+				}
+			case Callw:
+				out = bankUnknown
+			default:
+				out = bankAfter(op, bank, resolve)
+			}
+			for _, j := range next(i) {
+				changed = enter(j, out) || changed
+			}
+		}
+	}
+
+	for i, bank := range in {
+		if bank == bankUnreached {
+			in[i] = bankUnknown
+		}
+	}
+	return in
+}
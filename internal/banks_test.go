@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// movlbs returns the banks the MOVLBs in words select, in order.
+func movlbs(words []uint16) []int {
+	var banks []int
+	for _, w := range words {
+		if w&0x3FE0 == 0x0020 {
+			banks = append(banks, int(w&0x1F))
+		}
+	}
+	return banks
+}
+
+func TestBankStates(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []PicOp
+		want []int
+	}{
+		{"straight", []PicOp{Clrf{F: "0xA0"}, Clrf{F: "0xA1"}, Clrf{F: "0x70"}, Clrf{F: "0x120"}}, []int{1, 2}},
+		{"label", []PicOp{Clrf{F: "0xA0"}, LabelOp{Name: "l"}, Clrf{F: "0xA1"}}, []int{1}},
+		{"join", []PicOp{
+			Clrf{F: "0xA0"}, Btfsc{F: "0x3", B: statusZ}, Goto{Label: "l"},
+			Clrf{F: "0xA1"}, LabelOp{Name: "l"}, Clrf{F: "0xA2"},
+		}, []int{1}},
+		{"join different", []PicOp{
+			Clrf{F: "0xA0"}, Btfsc{F: "0x3", B: statusZ}, Goto{Label: "l"},
+			Clrf{F: "0x120"}, LabelOp{Name: "l"}, Clrf{F: "0xA2"},
+		}, []int{1, 2, 1}},
+		{"skip", []PicOp{Clrf{F: "0xA0"}, Btfsc{F: "0x120", B: 0}, Clrf{F: "0x121"}, Clrf{F: "0x122"}}, []int{1, 2}},
+		{"loop", []PicOp{
+			Clrf{F: "0xA0"}, LabelOp{Name: "l"}, Clrf{F: "0xA1"}, Clrf{F: "0x120"},
+			Decfsz{F: "0x70", D: DestF}, Goto{Label: "l"}, Clrf{F: "0x121"},
+		}, []int{1, 1, 2}},
+		{"call", []PicOp{
+			Clrf{F: "0xA0"}, CallOp{Label: "f"}, Clrf{F: "0x121"}, Return{},
+			LabelOp{Name: "f"}, Clrf{F: "0xA1"}, Clrf{F: "0x120"}, Return{},
+		}, []int{1, 2}},
+		{"call different", []PicOp{
+			Clrf{F: "0xA0"}, CallOp{Label: "f"}, Clrf{F: "0x121"}, Return{},
+			LabelOp{Name: "f"}, Clrf{F: "0xA1"}, Btfsc{F: "0x3", B: statusZ}, Return{}, Clrf{F: "0x120"}, Return{},
+		}, []int{1, 2, 2}},
+		{"called twice", []PicOp{
+			Clrf{F: "0xA0"}, CallOp{Label: "f"}, Clrf{F: "0x120"}, CallOp{Label: "f"}, Return{},
+			LabelOp{Name: "f"}, Clrf{F: "0x70"}, Return{},
+		}, []int{1, 2}},
+		{"taken", []PicOp{
+			Clrf{F: "0xA0"}, MovlwLow{Label: "f"}, Callw{}, Clrf{F: "0xA1"},
+			LabelOp{Name: "f"}, Clrf{F: "0xA1"}, Return{},
+		}, []int{1, 1, 1}},
+		{"reset", []PicOp{OrgOp{Address: 0}, Clrf{F: "0x20"}, Return{}, OrgOp{Address: 4}, Clrf{F: "0x20"}, Return{}}, []int{0}},
+		{"bsr", []PicOp{Clrf{F: "0xA0"}, Movwf{F: "0x8"}, Clrf{F: "0xA1"}}, []int{1, 1}},
+	}
+	for _, tt := range tests {
+		words, _, err := Assemble(tt.ops, nil)
+		if err != nil {
+			t.Errorf("%s: Assemble failed: %v", tt.name, err)
+			continue
+		}
+		if got := movlbs(words); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected MOVLBs to banks %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestBankStatesProgram(t *testing.T) {
+	program := `
+section data
+banked:
+  a i8
+  b i8
+section program
+fn main() begin
+  set()
+  b = 2
+  case a of
+    0: b = 1
+    1: b = 3
+  end
+  if a == 2 then
+    set()
+  a = b
+end
+fn set() begin
+  a = 1
+end
+`
+	// Configuration words come before the reset vector in the output.
+	for _, config := range []string{"", "section configuration\n  conf: $3F3F\n"} {
+		ops, syms, err := compileBody(config+program, withStartup)
+		if err != nil {
+			t.Fatalf("Compile failed: %v", err)
+		}
+		words, _, err := Assemble(ops, syms)
+		if err != nil {
+			t.Fatalf("Assemble failed: %v", err)
+		}
+		// The interrupt vector only returns, so main is only reached from
+		// reset and bank 0 stays selected throughout.
+		if got := movlbs(words); len(got) != 0 {
+			var lines []string
+			for _, op := range ops {
+				lines = append(lines, op.Assembly())
+			}
+			t.Errorf("expected no MOVLBs, got them to banks %v in\n%s", got, strings.Join(lines, "\n"))
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Single bits are set, cleared, toggled and copied in place. None of the
+// sequences here writes a bit with anything but its final value, so a
+// bit that drives an output pin never glitches. Copying a bit tests the
+// source before each write, which only works if no bank switch falls
+// between a skip and the instruction it skips; otherwise the new value
+// is worked out in W and written with a single XORWF.
+
+// compileBitAssign compiles an assignment to bit b of register f, the
+// register named by lhs.
+//
+//	f[b] = 0        -> BCF f,b
+//	f[b] = 1        -> BSF f,b
+//	f[b] ^= 1       -> MOVLW 1<<b; XORWF f,1
+//	f[b] = g[c]     -> BTFSC g,c; BSF f,b; BTFSS g,c; BCF f,b
+//	f[b] = not g[c] -> BTFSS g,c; BSF f,b; BTFSC g,c; BCF f,b
+func (c *asmGen) compileBitAssign(lhs IndexExpr, b int, op TTy, rhs Expr) ([]PicOp, bool, error) {
+	f, err := c.register(lhs.Name, lhs.Range)
+	if err != nil {
+		return nil, false, err
+	}
+	if val, ok := getNum(rhs); ok {
+		switch {
+		case op == EQL && val == 0:
+			return []PicOp{Bcf{F: f, B: b}}, true, nil
+		case op == EQL && val == 1:
+			return []PicOp{Bsf{F: f, B: b}}, true, nil
+		case op == XOREQL && val == 0:
+			return nil, true, nil
+		case op == XOREQL && val == 1:
+			return []PicOp{Movlw{K: 1 << b}, Xorwf{F: f, D: DestF}}, true, nil
+		}
+		return nil, false, nil
+	}
+	if op != EQL {
+		return nil, false, nil
+	}
+
+	invert := false
+	if u, ok := rhs.(UnaryExpr); ok && u.Op == NOT {
+		invert, rhs = true, u.Expr
+	}
+	src, ok := rhs.(IndexExpr)
+	if !ok {
+		return nil, false, nil
+	}
+	sb, err := c.resolveBit(src.Name, src.Index)
+	if err != nil {
+		return nil, false, nil
+	}
+	g, err := c.register(src.Name, src.Range)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if f == g && b == sb {
+		// f[b] = f[b] does nothing, and f[b] = not f[b] is a toggle.
+		if !invert {
+			return nil, true, nil
+		}
+		return []PicOp{Movlw{K: 1 << b}, Xorwf{F: f, D: DestF}}, true, nil
+	}
+
+	set, clear := PicOp(Btfsc{F: g, B: sb}), PicOp(Btfss{F: g, B: sb})
+	if invert {
+		set, clear = clear, set
+	}
+	if sameBank(f, g) {
+		return []PicOp{set, Bsf{F: f, B: b}, clear, Bcf{F: f, B: b}}, true, nil
+	}
+	// W = the new bit, then W = the bits of f that change.
+	on, off := 1<<b, 0
+	if invert {
+		on, off = off, on
+	}
+	return []PicOp{
+		Movlw{K: off},
+		Btfsc{F: g, B: sb},
+		Movlw{K: on},
+		Xorwf{F: f, D: DestW},
+		Andlw{K: 1 << b},
+		Xorwf{F: f, D: DestF},
+	}, true, nil
+}
+
+// sameBank reports whether f can be used straight after g without a
+// bank switch between them.
+func sameBank(f, g string) bool {
+	a, ok := fileAddr(f)
+	if !ok {
+		return false
+	}
+	b, ok := fileAddr(g)
+	if !ok {
+		return false
+	}
+	return unbanked(a) || !unbanked(b) && a>>7 == b>>7
+}
+
+// fileAddr returns the address of a file register operand. Compiler
+// temporaries are always in common RAM.
+func fileAddr(f string) (int, bool) {
+	if strings.HasPrefix(f, "_") {
+		return 0x70, true
+	}
+	addr, err := strconv.ParseInt(f, 0, 0)
+	return int(addr), err == nil
+}
+
+// unbanked reports whether addr is reachable from every bank: a core
+// register or common RAM.
+func unbanked(addr int) bool {
+	return addr&0x7F <= regINTCON || addr >= 0x70 && addr <= 0x7F
+}
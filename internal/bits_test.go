@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const bitsData = `
+section constants
+porta: $0C [ ra2: 2 ]
+latc: $10E [ ]
+led: latc[3]
+section data
+common:
+  flags i8
+banked:
+  state i8 at $120
+section program
+`
+
+func TestCompileBits(t *testing.T) {
+	tests := []struct {
+		stmt     string
+		expected []string
+	}{
+		{"led ^= 1", []string{"MOVLW 8", "XORWF 0x10E,1"}},
+		{"led ^= 0", nil},
+		{"flags[0] = flags[0]", nil},
+		{"flags[5] = not flags[5]", []string{"MOVLW 32", "XORWF 0x70,1"}},
+		{"led = state[1]", []string{"BTFSC 0x120,1", "BSF 0x10E,3", "BTFSS 0x120,1", "BCF 0x10E,3"}},
+		{"flags[0] = not porta[ra2]", []string{"BTFSS 0xC,2", "BSF 0x70,0", "BTFSC 0xC,2", "BCF 0x70,0"}},
+		{"led = porta[2]", []string{"MOVLW 0", "BTFSC 0xC,2", "MOVLW 8", "XORWF 0x10E,0", "ANDLW 8", "XORWF 0x10E,1"}},
+		{"led = not flags[7]", []string{"MOVLW 8", "BTFSC 0x70,7", "MOVLW 0", "XORWF 0x10E,0", "ANDLW 8", "XORWF 0x10E,1"}},
+	}
+	for _, tt := range tests {
+		ops, _, err := compileBody(bitsData + inMain("  "+tt.stmt))
+		if err != nil {
+			t.Fatalf("Compile(%q) failed: %v", tt.stmt, err)
+		}
+		var got []string
+		for _, op := range ops[1:] {
+			got = append(got, op.Assembly())
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tt.stmt, strings.Join(tt.expected, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
+
+// TestBitsSim runs each way of copying a bit and checks that the
+// destination bit ends up right and the bits around it are left alone.
+func TestBitsSim(t *testing.T) {
+	stmts := []struct {
+		stmt   string
+		invert bool
+	}{
+		{"led = state[1]", false},
+		{"led = not state[1]", true},
+		{"led = flags[1]", false},
+		{"led = not flags[1]", true},
+	}
+	for _, s := range stmts {
+		ops, _, err := compileBody(bitsData + inMain("  "+s.stmt))
+		if err != nil {
+			t.Fatalf("Compile(%q) failed: %v", s.stmt, err)
+		}
+		for _, src := range []int{0, 1} {
+			for _, dst := range []int{0, 1} {
+				name := fmt.Sprintf("%s with source %d, led %d", s.stmt, src, dst)
+				regs := map[string]int{"0x120": 0x55 | src<<1, "0x70": 0xAA&^2 | src<<1, "0x10E": 0xF0&^8 | dst<<3}
+				m := newCPU(t, ops, regs)
+				m.run(0)
+				want := src
+				if s.invert {
+					want ^= 1
+				}
+				if m.regs["0x10E"] != 0xF0&^8|want<<3 {
+					t.Errorf("%s: expected latc $%02X, got $%02X", name, 0xF0&^8|want<<3, m.regs["0x10E"])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// The return stack is 16 levels deep and silently wraps around when it
+// overflows, so call depth is checked at compile time. The call graph
+// is built from the generated code rather than the source so that it
+// includes the runtime helpers, and a CALLW into a function table
+// counts as a call to every entry. An interrupt can arrive at any depth,
+// so if there is an at $4 handler, its return address and its own calls
+// are added to every other chain.
+
+const stackLevels = 16
+
+// checkStack reports recursion and call chains deeper than the stack,
+// or than the stack budget if one is declared.
+func (c *asmGen) checkStack(ops []PicOp) DiagnosticList {
+	routines := map[string]bool{}
+	for _, fn := range c.prog.Functions {
+		routines[fn.Name] = true
+	}
+	for _, t := range c.prog.Tasks {
+		routines[t.Name] = true
+	}
+	if len(c.prog.Tasks) > 0 {
+		routines[schedulerLabel] = true
+	}
+	for name := range helpers {
+		routines[name] = true
+	}
+	routines[startupLabel] = true
+	for _, name := range c.tables {
+		routines[tableLabel(name)] = true
+	}
+
+	// An edge is a CALL, or a GOTO into another routine, which is how
+	// table entries reach their functions without using the stack.
+	type edge struct {
+		to   string
+		call bool
+	}
+	graph := map[string][]edge{}
+	called := map[string]bool{}
+	var roots []string
+	cur, table := "", ""
+	for _, op := range ops {
+		var e edge
+		switch op := op.(type) {
+		case OrgOp:
+			cur = fmt.Sprintf("at $%X", op.Address)
+			roots = append(roots, cur)
+			continue
+		case LabelOp:
+			if routines[op.Name] {
+				cur = op.Name
+				roots = append(roots, cur)
+			}
+			continue
+		case AddlwLow:
+			table = op.Label
+			continue
+		case CallOp:
+			e = edge{to: op.Label, call: true}
+		case Callw:
+			e = edge{to: table, call: true}
+		case Goto:
+			if !routines[op.Label] {
+				continue
+			}
+			e = edge{to: op.Label}
+		default:
+			continue
+		}
+		graph[cur] = append(graph[cur], e)
+		called[e.to] = true
+	}
+
+	var diagnostics DiagnosticList
+	depth := map[string]int{} // -1 if part of a cycle
+	deepest := map[string]string{}
+	var path []string
+	var visit func(name string) int
+	visit = func(name string) int {
+		if d, ok := depth[name]; ok {
+			return d
+		}
+		if i := slices.Index(path, name); i >= 0 {
+			cycle := append(path[i:], name)
+			diagnostics = append(diagnostics, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("recursive call %s; the hardware stack can't hold unbounded recursion", strings.Join(c.routineNames(cycle), " -> ")),
+				Range:   c.routineRange(name),
+			})
+			return -1
+		}
+		path = append(path, name)
+		d := 0
+		for _, e := range graph[name] {
+			sub := visit(e.to)
+			if sub < 0 {
+				d = -1
+				break
+			}
+			if e.call {
+				sub++
+			}
+			if sub > d {
+				d = sub
+				deepest[name] = e.to
+			}
+		}
+		path = path[:len(path)-1]
+		depth[name] = d
+		return d
+	}
+
+	limit, over := stackLevels, fmt.Sprintf("the stack only has %d levels", stackLevels)
+	if b, ok := c.prog.Budgets[budgetStack]; ok && b.Limit < stackLevels {
+		limit, over = b.Limit, fmt.Sprintf("the stack budget is %d", b.Limit)
+	}
+	chainFrom := func(root string) string {
+		chain := []string{root}
+		for name := root; deepest[name] != ""; name = deepest[name] {
+			chain = append(chain, deepest[name])
+		}
+		return strings.Join(c.routineNames(chain), " -> ")
+	}
+	const isrRoot = "at $4"
+	isr, interrupted := 0, ""
+	if slices.ContainsFunc(c.prog.AtBlocks, func(blk AtBlock) bool { return blk.Address == 4 }) {
+		if d := visit(isrRoot); d >= 0 {
+			isr, interrupted = d+1, ", interrupted by "+chainFrom(isrRoot)
+		}
+	}
+	for _, root := range roots {
+		if called[root] {
+			continue
+		}
+		d := visit(root)
+		if d < 0 {
+			continue
+		}
+		suffix := ""
+		if root != isrRoot {
+			d, suffix = d+isr, interrupted
+		}
+		if d <= limit {
+			continue
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("calls nest %d deep, but %s: %s%s", d, over, chainFrom(root), suffix),
+			Range:   c.routineRange(root),
+		})
+	}
+	// Cycles that no root reaches
+	for _, name := range roots {
+		visit(name)
+	}
+	return diagnostics
+}
+
+// routineNames replaces table labels in names with the tables' names.
+func (c *asmGen) routineNames(names []string) []string {
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = name
+		if table, ok := strings.CutPrefix(name, "_table_"); ok {
+			out[i] = "table " + table
+		}
+	}
+	return out
+}
+
+// routineRange finds the declaration of a function or task, if name is
+// one.
+func (c *asmGen) routineRange(name string) Range {
+	for _, fn := range c.prog.Functions {
+		if fn.Name == name {
+			return fn.Range
+		}
+	}
+	for _, t := range c.prog.Tasks {
+		if t.Name == name {
+			return t.Range
+		}
+	}
+	return Range{}
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// A case statement evaluates its subject into W and dispatches on it.
+// Dense values index a table of GOTOs with BRW. BRW adds W to the whole
+// program counter, so unlike the classic ADDWF PCL table it needs no
+// PCLATH setup and the table is free to cross a 256-word boundary.
+// Sparse values are compared in turn with XORLW, which leaves the
+// subject XORed with the last value in W, so each comparison undoes
+// the previous one. Whichever dispatch is shorter is used. A case on an
+// enum with an arm for every member can only be given a member, so it
+// doesn't check for values outside the table or test the last value.
+
+func (c *asmGen) compileCase(s CaseStmt) ([]PicOp, error) {
+	end := c.newLabel("endcase")
+	def := end
+	if s.Else != nil {
+		def = c.newLabel("else")
+	}
+
+	// Arm bodies follow the dispatch in order, each jumping to the end.
+	targets := map[int]string{}
+	var values []int
+	var bodies []PicOp
+	for i, arm := range s.Arms {
+		label := c.newLabel("when")
+		for _, v := range arm.Values {
+			k, err := c.caseValue(s.Subject, v)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := targets[k]; ok {
+				return nil, Diagnostic{
+					Code:    ErrType,
+					Message: fmt.Sprintf("duplicate case value %v", v),
+					Range:   v.Position(),
+				}
+			}
+			targets[k] = label
+			values = append(values, k)
+		}
+		body, err := c.compileStmt(arm.Body)
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, LabelOp{Name: label})
+		bodies = append(bodies, body...)
+		if i < len(s.Arms)-1 || s.Else != nil {
+			bodies = append(bodies, Goto{Label: end})
+		}
+	}
+	if s.Else != nil {
+		bodies = append(bodies, LabelOp{Name: def})
+		for _, stmt := range s.Else {
+			compiled, err := c.compileStmt(stmt)
+			if err != nil {
+				return nil, err
+			}
+			bodies = append(bodies, compiled...)
+		}
+	}
+	if err := c.checkCoverage(s, targets); err != nil {
+		return nil, err
+	}
+	covered := s.Else == nil && c.enumOf(s.Subject) != ""
+	if len(values) == 0 {
+		return bodies, nil
+	}
+
+	ops, err := c.evalExpr(s.Subject)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := values[0], values[0]
+	for _, k := range values {
+		lo, hi = min(lo, k), max(hi, k)
+	}
+	table := caseTable(lo, hi-lo+1, targets, def, covered)
+	chain := caseChain(values, targets, def, covered)
+	if codeWords(table) <= codeWords(chain) {
+		ops = append(ops, table...)
+	} else {
+		ops = append(ops, chain...)
+	}
+	ops = append(ops, bodies...)
+	if jumpsTo(ops, end) {
+		ops = append(ops, LabelOp{Name: end})
+	}
+	return ops, nil
+}
+
+// caseValue resolves an arm value, which must be a byte constant of the
+// subject's enum, if it has one.
+func (c *asmGen) caseValue(subject, v Expr) (int, error) {
+	k, ok := c.literal(v)
+	if !ok {
+		return 0, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("case value %v is not a constant", v),
+			Range:   v.Position(),
+		}
+	}
+	if err := checkByte(k, v); err != nil {
+		return 0, err
+	}
+	if err := c.checkEnums(subject, v, v.Position()); err != nil {
+		return 0, err
+	}
+	return k & 0xFF, nil
+}
+
+// caseTable dispatches on W through a table of span GOTOs starting at
+// value lo. Values outside the table go to def, unless W is covered:
+// known to be one of the values.
+func caseTable(lo, span int, targets map[int]string, def string, covered bool) []PicOp {
+	var ops []PicOp
+	if lo != 0 {
+		ops = append(ops, Addlw{K: -lo & 0xFF})
+	}
+	if span < 256 && !covered {
+		// Adding 256 - span carries if W >= span.
+		ops = append(ops,
+			Addlw{K: 256 - span},
+			Btfsc{F: hexAddr(regSTATUS), B: statusC},
+			Goto{Label: def},
+			Addlw{K: span},
+		)
+	}
+	ops = append(ops, Brw{})
+	for i := range span {
+		label, ok := targets[(lo+i)&0xFF]
+		if !ok {
+			label = def
+		}
+		ops = append(ops, Goto{Label: label})
+	}
+	return ops
+}
+
+// caseChain dispatches on W by comparing it with each value in turn.
+// If W is covered, known to be one of the values, the last needs no
+// comparison.
+func caseChain(values []int, targets map[int]string, def string, covered bool) []PicOp {
+	var ops []PicOp
+	prev := 0
+	for i, k := range values {
+		if covered && i == len(values)-1 {
+			return append(ops, Goto{Label: targets[k]})
+		}
+		ops = append(ops,
+			Xorlw{K: k ^ prev},
+			Btfsc{F: hexAddr(regSTATUS), B: statusZ},
+			Goto{Label: targets[k]},
+		)
+		prev = k
+	}
+	return append(ops, Goto{Label: def})
+}
@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const caseData = `
+section constants
+enum state [ idle running stopped: 200 ]
+enum phase [ start run halt ]
+section data
+common:
+  mode state
+  s i8
+  x i8
+  y phase
+section program
+`
+
+func TestCompileCase(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want func(s int) int // value of x afterwards, starting from 0
+	}{
+		{
+			"case s of 0: x = 10 1: x = 11 2: x = 12 3: x = 13 end",
+			func(s int) int {
+				if s < 4 {
+					return 10 + s
+				}
+				return 0
+			},
+		},
+		{
+			"case s of 5: x = 10 7, 8: x = 11 6: begin x = 12 x += 1 end else x = 99 end",
+			func(s int) int {
+				switch s {
+				case 5:
+					return 10
+				case 7, 8:
+					return 11
+				case 6:
+					return 13
+				}
+				return 99
+			},
+		},
+		{
+			"case s of 3: x = 1 40: x = 2 255: x = 3 else x = 4 x += 1 end",
+			func(s int) int {
+				switch s {
+				case 3:
+					return 1
+				case 40:
+					return 2
+				case 255:
+					return 3
+				}
+				return 5
+			},
+		},
+		{
+			"case s + 1 of 0: x = 1 1: x = 2 end",
+			func(s int) int {
+				switch (s + 1) & 0xFF {
+				case 0:
+					return 1
+				case 1:
+					return 2
+				}
+				return 0
+			},
+		},
+		{
+			// mode only holds members, so 200 isn't tested for and
+			// anything else takes its arm.
+			"case mode of idle: x = 1 running, stopped: x = 2 end",
+			func(s int) int {
+				if s == 0 {
+					return 1
+				}
+				return 2
+			},
+		},
+		{
+			"case s of else x = 7 end",
+			func(s int) int { return 7 },
+		},
+	}
+	for _, tt := range tests {
+		ops, _, err := compileBody(caseData + inMain(tt.stmt))
+		if err != nil {
+			t.Fatalf("Compile(%q) failed: %v", tt.stmt, err)
+		}
+		for s := range 256 {
+			m := newCPU(t, ops, map[string]int{"0x70": s, "0x71": s})
+			m.run(0)
+			if got := m.regs["0x72"]; got != tt.want(s) {
+				t.Errorf("%s with s = %d: expected x = %d, got %d", tt.stmt, s, tt.want(s), got)
+				break
+			}
+		}
+	}
+}
+
+func TestCompileCaseShape(t *testing.T) {
+	tests := []struct {
+		stmt     string
+		expected []string
+	}{
+		{
+			"case s of 1: x = 1 2: x = 2 3: x = 3 else x = 0 end",
+			[]string{
+				"main:",
+				"MOVF 0x71,0",
+				"ADDLW 255",
+				"ADDLW 253",
+				"BTFSC 0x3,0",
+				" GOTO _else_2",
+				"ADDLW 3",
+				"BRW",
+				" GOTO _when_3",
+				" GOTO _when_4",
+				" GOTO _when_5",
+				"_when_3:",
+				"MOVLW 1",
+				"MOVWF 0x72",
+				" GOTO _endcase_1",
+				"_when_4:",
+				"MOVLW 2",
+				"MOVWF 0x72",
+				" GOTO _endcase_1",
+				"_when_5:",
+				"MOVLW 3",
+				"MOVWF 0x72",
+				" GOTO _endcase_1",
+				"_else_2:",
+				"MOVLW 0",
+				"MOVWF 0x72",
+				"_endcase_1:",
+			},
+		},
+		{
+			"case s of 1: x = 1 100: x = 2 end",
+			[]string{
+				"main:",
+				"MOVF 0x71,0",
+				"XORLW 1",
+				"BTFSC 0x3,2",
+				" GOTO _when_2",
+				"XORLW 101",
+				"BTFSC 0x3,2",
+				" GOTO _when_3",
+				" GOTO _endcase_1",
+				"_when_2:",
+				"MOVLW 1",
+				"MOVWF 0x72",
+				" GOTO _endcase_1",
+				"_when_3:",
+				"MOVLW 2",
+				"MOVWF 0x72",
+				"_endcase_1:",
+			},
+		},
+		{
+			// Every member has an arm, so there is no range check.
+			"case y of start: x = 1 run: x = 2 halt: x = 3 end",
+			[]string{
+				"main:",
+				"MOVF 0x73,0",
+				"BRW",
+				" GOTO _when_2",
+				" GOTO _when_3",
+				" GOTO _when_4",
+				"_when_2:",
+				"MOVLW 1",
+				"MOVWF 0x72",
+				" GOTO _endcase_1",
+				"_when_3:",
+				"MOVLW 2",
+				"MOVWF 0x72",
+				" GOTO _endcase_1",
+				"_when_4:",
+				"MOVLW 3",
+				"MOVWF 0x72",
+				"_endcase_1:",
+			},
+		},
+		{
+			"case mode of idle: x = 1 running: x = 2 stopped: x = 3 end",
+			[]string{
+				"main:",
+				"MOVF 0x70,0",
+				"XORLW 0",
+				"BTFSC 0x3,2",
+				" GOTO _when_2",
+				"XORLW 1",
+				"BTFSC 0x3,2",
+				" GOTO _when_3",
+				" GOTO _when_4",
+				"_when_2:",
+				"MOVLW 1",
+				"MOVWF 0x72",
+				" GOTO _endcase_1",
+				"_when_3:",
+				"MOVLW 2",
+				"MOVWF 0x72",
+				" GOTO _endcase_1",
+				"_when_4:",
+				"MOVLW 3",
+				"MOVWF 0x72",
+				"_endcase_1:",
+			},
+		},
+	}
+	for _, tt := range tests {
+		ops, _, err := compileBody(caseData + inMain(tt.stmt))
+		if err != nil {
+			t.Fatalf("Compile(%q) failed: %v", tt.stmt, err)
+		}
+		var got []string
+		for _, op := range ops {
+			got = append(got, op.Assembly())
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("%s:\nexpected\n%s\ngot\n%s", tt.stmt, strings.Join(tt.expected, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
+
+// TestCaseTableAcrossPage checks that a table straddling a 256-word
+// boundary still lines up with BRW's targets.
+func TestCaseTableAcrossPage(t *testing.T) {
+	padding := strings.Repeat("x = 1\n", 125)
+	ops, syms, err := compileBody(caseData + inMain(padding+"case s of 0: x = 10 1: x = 11 2: x = 12 3: x = 13 4: x = 14 5: x = 15 end"))
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	words, _, err := Assemble(ops, syms)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+
+	brw := -1
+	for i, w := range words {
+		if w == 0x000B {
+			brw = i
+		}
+	}
+	if brw < 0 || brw >= 0x100 || brw+6 < 0x100 {
+		t.Fatalf("expected the table to cross 0x100, BRW is at 0x%X", brw)
+	}
+	for i := range 6 {
+		addr, ok := syms.GetAddress(fmt.Sprintf("_when_%d", i+2))
+		if !ok {
+			t.Fatalf("label _when_%d not found", i+2)
+		}
+		if got := words[brw+1+i]; got != 0x2800|uint16(addr) {
+			t.Errorf("entry %d: expected GOTO 0x%X, got 0x%04X", i, addr, got)
+		}
+	}
+}
+
+func TestCaseErrors(t *testing.T) {
+	tests := []struct {
+		stmt string
+		msg  string
+	}{
+		{"case s of 1: x = 1 1: x = 2 end", "duplicate case value 1"},
+		{"case s of 1, 257: x = 1 end", "does not fit in 8 bits"},
+		{"case s of x: x = 1 end", "not a constant"},
+		{"case mode of idle: x = 1 first: x = 2 end", "cannot mix"},
+		{"case mode of idle: x = 1 3: x = 2 else x = 3 end", ""},
+		{"case mode of idle: x = 1 3: x = 2 end", "case on mode (enum state) has no arm for running; add them or an else"},
+		{"case s of 0 x = 1 end", "expected : after case value"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody(`
+section constants
+enum state [ idle running ]
+enum other [ first ]
+section data
+common:
+  mode state
+  s i8
+  x i8
+section program
+fn main() begin
+  ` + tt.stmt + `
+end
+`)
+		if tt.msg == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.stmt, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.stmt, tt.msg, err)
+		}
+	}
+}
@@ -2,40 +2,32 @@ package internal
 
 import (
 	"fmt"
-	"sort"
-	"strconv"
-	"strings"
+	"slices"
 )
 
+// Compile lowers prog to PIC ops. Warnings are discarded; use
+// CompileWithWarnings to see them.
 func Compile(prog Program) ([]PicOp, SymbolTable, error) {
-	// Allocate variables
-	commonAddr := 0x70
-	bankedAddr := 0x20
+	ops, syms, _, err := CompileWithWarnings(prog)
+	return ops, syms, err
+}
 
+// CompileWithWarnings is like Compile but also returns the warnings
+// produced along the way, such as rounded delays.
+func CompileWithWarnings(prog Program) ([]PicOp, SymbolTable, DiagnosticList, error) {
+	// Allocate variables
+	declareTaskStates(prog)
 	syms := NewSymbolTable()
-
-	var names []string
-	for name := range prog.Variables {
-		names = append(names, name)
-	}
-	sort.Strings(names)
-
-	for _, name := range names {
-		v := prog.Variables[name]
-		if v.Banked {
-			v.Address = bankedAddr
-			bankedAddr++
-		} else {
-			v.Address = commonAddr
-			commonAddr++
-		}
-		prog.Variables[name] = v
+	ram, diagnostics := allocate(prog)
+	for name, v := range prog.Variables {
 		syms.SetAddress(name, v.Address)
 	}
 
 	c := &asmGen{prog: prog}
 	var ops []PicOp
-	var diagnostics DiagnosticList
+	diagnostics = append(diagnostics, c.checkEnumTypes()...)
+	diagnostics = append(diagnostics, c.checkTasks()...)
+	diagnostics = append(diagnostics, c.checkAsserts()...)
 
 	// Configuration
 	// Map configuration names to addresses.
@@ -60,21 +52,45 @@ func Compile(prog Program) ([]PicOp, SymbolTable, error) {
 		}
 	}
 
+	// Startup code runs from the reset vector: the at $0 block if there
+	// is one, or else the one generated to jump to main.
+	bytes, d := c.startupBytes()
+	diagnostics = append(diagnostics, d...)
+	atBlock := func(addr int) bool {
+		return slices.ContainsFunc(prog.AtBlocks, func(blk AtBlock) bool { return blk.Address == addr })
+	}
+	hasMain := slices.ContainsFunc(prog.Functions, func(fn Function) bool { return fn.Name == "main" })
+	reset := atBlock(0) || hasMain
+	if !reset {
+		c.warn(Range{}, "nothing runs at reset: there is no fn main or at $0 block")
+		for _, b := range bytes {
+			if b.init {
+				diagnostics = append(diagnostics, Diagnostic{
+					Code:    ErrUnknown,
+					Message: "initial values are set by startup code, which needs fn main or an at $0 block to run from",
+					Range:   prog.Variables[ram.owner[b.addr]].Range,
+				})
+				break
+			}
+		}
+	}
+	startup := reset && len(bytes) > 0
+	if !atBlock(0) && hasMain {
+		ops = append(ops, resetOps(startup, atBlock(4))...)
+	}
+
 	// AtBlocks
 	for _, blk := range prog.AtBlocks {
 		ops = append(ops, OrgOp{Address: blk.Address})
+		if blk.Address == 0 && startup {
+			// The block runs on with PCLATH as a reset leaves it.
+			ops = append(ops, startupCall()...)
+			ops = append(ops, Movlp{K: 0})
+		}
 		for _, stmt := range blk.Body {
 			compiled, err := c.compileStmt(stmt)
 			if err != nil {
-				if d, ok := err.(Diagnostic); ok {
-					diagnostics = append(diagnostics, d)
-				} else {
-					diagnostics = append(diagnostics, Diagnostic{
-						Code:    ErrUnknown,
-						Message: err.Error(),
-						Range:   stmt.Position(),
-					})
-				}
+				diagnostics = append(diagnostics, asDiagnostic(err, stmt.Position()))
 				continue
 			}
 			ops = append(ops, compiled...)
@@ -86,29 +102,89 @@ func Compile(prog Program) ([]PicOp, SymbolTable, error) {
 		for _, stmt := range fn.Body {
 			compiled, err := c.compileStmt(stmt)
 			if err != nil {
-				if d, ok := err.(Diagnostic); ok {
-					diagnostics = append(diagnostics, d)
-				} else {
-					diagnostics = append(diagnostics, Diagnostic{
-						Code:    ErrUnknown,
-						Message: err.Error(),
-						Range:   stmt.Position(),
-					})
-				}
+				diagnostics = append(diagnostics, asDiagnostic(err, stmt.Position()))
 				continue
 			}
 			ops = append(ops, compiled...)
 		}
 	}
+	for _, t := range prog.Tasks {
+		compiled, d := c.compileTask(t)
+		ops = append(ops, compiled...)
+		diagnostics = append(diagnostics, d...)
+	}
+	ops = append(ops, c.schedulerOps()...)
 
-	if len(diagnostics) > 0 {
-		return nil, nil, diagnostics
+	ops = append(ops, c.tableOps()...)
+	ops = append(ops, c.helperOps()...)
+	if startup {
+		ops = append(ops, c.startupOps(bytes)...)
+	}
+	romOps, d := c.romOps()
+	ops = append(ops, romOps...)
+	diagnostics = append(diagnostics, d...)
+	ops = c.safeSkips(ops)
+	diagnostics = append(diagnostics, c.checkStack(ops)...)
+
+	// Compiler temporaries live in common RAM so that using them never
+	// needs a bank switch.
+	for _, name := range c.temps {
+		addr, ok := ram.alloc(true, 1, name)
+		if !ok {
+			diagnostics = append(diagnostics, outOfRAM(true, "compiler temporary "+name, Range{}))
+			continue
+		}
+		syms.SetAddress(name, addr)
 	}
-	return ops, syms, nil
+
+	if !diagnostics.HasErrors() {
+		diagnostics = append(diagnostics, c.checkTiming(ops, syms)...)
+		diagnostics = append(diagnostics, c.checkBudgets(ops, syms)...)
+	}
+
+	if diagnostics.HasErrors() {
+		return nil, nil, c.warnings, diagnostics
+	}
+	return ops, syms, c.warnings, nil
 }
 
 type asmGen struct {
-	prog Program
+	prog     Program
+	temps    []string
+	labels   int
+	helpers  []string // runtime routines called so far
+	tables   []string // function tables called through CALLW so far
+	atomics  int      // atomic blocks so far
+	gie      *gieSave // where the enclosing atomic block saved GIE, if any
+	task     *taskGen // the task being compiled, if any
+	timed    []timedBlock
+	warnings DiagnosticList
+}
+
+// temp returns the name of a compiler temporary, allocating it the first
+// time it is requested. Piccolo identifiers can't contain underscores,
+// so the names can't collide with user symbols.
+func (c *asmGen) temp(name string) string {
+	name = "_" + name
+	if !slices.Contains(c.temps, name) {
+		c.temps = append(c.temps, name)
+	}
+	return name
+}
+
+// newLabel returns a fresh label for generated code.
+func (c *asmGen) newLabel(prefix string) string {
+	c.labels++
+	return fmt.Sprintf("_%s_%d", prefix, c.labels)
+}
+
+func (c *asmGen) warn(rng Range, msg string) {
+	c.warnings = append(c.warnings, Diagnostic{
+		Code:     ErrUnknown,
+		Severity: SeverityWarning,
+		Message:  msg,
+		Range:    rng,
+	})
 }
 
 func (c *asmGen) resolveBit(name string, idx Expr) (int, error) {
@@ -129,32 +205,198 @@ func (c *asmGen) resolveBit(name string, idx Expr) (int, error) {
 }
 
 func (c *asmGen) resolveAddr(name string) (string, error) {
-	// If it's in Consts or SFRs, resolve to address string
-	if val, ok := c.prog.Consts[name]; ok {
-		return fmt.Sprintf("0x%X", val), nil
-	}
+	// Value constants are not registers; see register.
 	if sfr, ok := c.prog.SFRs[name]; ok {
-		return fmt.Sprintf("0x%X", sfr.Address), nil
+		return hexAddr(sfr.Address), nil
 	}
 	if v, ok := c.prog.Variables[name]; ok {
-		return fmt.Sprintf("0x%X", v.Address), nil
+		return hexAddr(v.Address), nil
+	}
+	if r, ok := c.coreRegister(name); ok {
+		return hexAddr(r.Address), nil
 	}
-	// Otherwise return name as is (might be handled by assembler later or is W/FSR)
+	// Otherwise return name as is (might be handled by assembler later)
 	return name, nil
 }
 
+// expand replaces aliases in e with what they name. The result keeps
+// the ranges of e so that diagnostics point at the use, not the alias.
+func (c *asmGen) expand(e Expr) (Expr, error) {
+	return c.expandSeen(e, nil)
+}
+
+func (c *asmGen) expandSeen(e Expr, seen []string) (Expr, error) {
+	switch e := e.(type) {
+	case IdentExpr:
+		alias, ok := c.prog.Aliases[e.Name]
+		if !ok {
+			return e, nil
+		}
+		if slices.Contains(seen, e.Name) {
+			return nil, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("alias %s refers to itself", e.Name),
+				Range:   alias.Range,
+			}
+		}
+		target, err := c.expandSeen(alias.Target, append(seen, e.Name))
+		if err != nil {
+			return nil, err
+		}
+		switch t := target.(type) {
+		case IdentExpr:
+			t.Range = e.Range
+			return t, nil
+		case IndexExpr:
+			t.Range = e.Range
+			return t, nil
+		}
+		return target, nil
+	case IndexExpr:
+		idx, err := c.expandSeen(e.Index, seen)
+		if err != nil {
+			return nil, err
+		}
+		e.Index = idx
+		base, err := c.expandSeen(IdentExpr{Name: e.Name, Range: e.Range}, seen)
+		if err != nil {
+			return nil, err
+		}
+		id, ok := base.(IdentExpr)
+		if !ok {
+			return nil, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("cannot index %s, which is an alias for %v", e.Name, base),
+				Range:   e.Range,
+			}
+		}
+		e.Name = id.Name
+		return e, nil
+	case UnaryExpr:
+		inner, err := c.expandSeen(e.Expr, seen)
+		if err != nil {
+			return nil, err
+		}
+		e.Expr = inner
+		return e, nil
+	case PostfixExpr:
+		inner, err := c.expandSeen(e.Expr, seen)
+		if err != nil {
+			return nil, err
+		}
+		e.Expr = inner
+		return e, nil
+	case BinaryExpr:
+		lhs, err := c.expandSeen(e.Lhs, seen)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := c.expandSeen(e.Rhs, seen)
+		if err != nil {
+			return nil, err
+		}
+		e.Lhs, e.Rhs = lhs, rhs
+		return e, nil
+	default:
+		return e, nil
+	}
+}
+
+// expandStmt expands the aliases in the expressions of stmt.
+// Nested statements are expanded when they are compiled.
+func (c *asmGen) expandStmt(stmt Stmt) (Stmt, error) {
+	var err error
+	switch s := stmt.(type) {
+	case AssignStmt:
+		if s.Lhs, err = c.expand(s.Lhs); err != nil {
+			return nil, err
+		}
+		if s.Expr, err = c.expand(s.Expr); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case IfStmt:
+		if s.Cond, err = c.expand(s.Cond); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case DelayStmt:
+		if s.Amount, err = c.expand(s.Amount); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case WaitStmt:
+		if s.Cond, err = c.expand(s.Cond); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case CallStmt:
+		if s.Index != nil {
+			if s.Index, err = c.expand(s.Index); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case CaseStmt:
+		if s.Subject, err = c.expand(s.Subject); err != nil {
+			return nil, err
+		}
+		arms := make([]CaseArm, len(s.Arms))
+		for i, arm := range s.Arms {
+			arms[i] = CaseArm{Values: make([]Expr, len(arm.Values)), Body: arm.Body}
+			for j, v := range arm.Values {
+				if arms[i].Values[j], err = c.expand(v); err != nil {
+					return nil, err
+				}
+			}
+		}
+		s.Arms = arms
+		return s, nil
+	default:
+		return stmt, nil
+	}
+}
+
 func (c *asmGen) compileStmt(stmt Stmt) ([]PicOp, error) {
+	stmt, err := c.expandStmt(stmt)
+	if err != nil {
+		return nil, err
+	}
 	switch s := stmt.(type) {
 	case AssignStmt:
 		return c.compileAssign(s)
 	case IfStmt:
 		return c.compileIf(s)
 	case ReturnStmt:
-		return []PicOp{Return{}}, nil
+		ops := append(c.restoreGIE(), c.restartTask()...)
+		return append(ops, Return{}), nil
+	case YieldStmt, WaitStmt:
+		return c.compileSuspend(s)
+	case AtomicStmt:
+		return c.compileAtomic(s)
+	case TimedStmt:
+		return c.compileTimed(s)
 	case CallStmt:
+		if s.Index != nil {
+			return c.compileTableCall(s)
+		}
 		return []PicOp{CallOp{Label: s.Name}}, nil
 	case LabelStmt:
 		return []PicOp{LabelOp{Name: s.Name}}, nil
+	case DelayStmt:
+		return c.compileDelay(s)
+	case CaseStmt:
+		return c.compileCase(s)
+	case BlockStmt:
+		var ops []PicOp
+		for _, stmt := range s.Body {
+			compiled, err := c.compileStmt(stmt)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, compiled...)
+		}
+		return ops, nil
 	default:
 		return nil, Diagnostic{
 			Code:    ErrUnknown,
@@ -164,76 +406,98 @@ func (c *asmGen) compileStmt(stmt Stmt) ([]PicOp, error) {
 	}
 }
 
-func (c *asmGen) compileIf(s IfStmt) ([]PicOp, error) {
-	cond := s.Cond
+// compare emits code that sets STATUS.Z if the operands of bin are equal.
+// W is clobbered unless one side is compared against zero.
+func (c *asmGen) compare(bin BinaryExpr) ([]PicOp, error) {
+	if err := c.checkEnums(bin.Lhs, bin.Rhs, bin.Position()); err != nil {
+		return nil, err
+	}
 
-	isZero := func(e Expr) bool {
-		val, ok := getNum(e)
-		return ok && val == 0
+	a, okA, err := c.operand(bin.Lhs)
+	if err != nil {
+		return nil, err
+	}
+	b, okB, err := c.operand(bin.Rhs)
+	if err != nil {
+		return nil, err
 	}
 
-	// 1. f[b] -> BTFSC f,b
-	if idx, ok := cond.(IndexExpr); ok {
-		b, err := c.resolveBit(idx.Name, idx.Index)
-		if err == nil {
-			f, _ := c.resolveAddr(idx.Name)
-			ops := []PicOp{Btfsc{F: f, B: b}}
-			bodyOps, err := c.compileStmt(s.Then)
-			if err != nil {
-				return nil, err
-			}
-			return append(ops, bodyOps...), nil
+	var ops []PicOp
+	switch {
+	case !okA && !okB:
+		// a == b -> a ^ b into W, which ends with an XORWF that sets Z
+		return c.evalExpr(BinaryExpr{Lhs: bin.Lhs, Op: CARET, Rhs: bin.Rhs, Range: bin.Range})
+	case !okA || !okB:
+		// Evaluate the compound side into W and compare W with the other.
+		e, other := bin.Lhs, b
+		if okA {
+			e, other = bin.Rhs, a
 		}
+		if other.kind == wOperand {
+			tmp := c.temp("w")
+			ops = append(ops, Movwf{F: tmp})
+			other = operand{kind: registerOperand, f: tmp}
+		}
+		evalOps, err := c.evalExpr(e)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, evalOps...)
+		a, b = operand{kind: wOperand}, other
 	}
 
-	// 2. not f[b] -> BTFSS f,b
-	if unary, ok := cond.(UnaryExpr); ok && unary.Op == NOT {
-		if idx, ok := unary.Expr.(IndexExpr); ok {
-			b, err := c.resolveBit(idx.Name, idx.Index)
-			if err == nil {
-				f, _ := c.resolveAddr(idx.Name)
-				ops := []PicOp{Btfss{F: f, B: b}}
-				bodyOps, err := c.compileStmt(s.Then)
-				if err != nil {
-					return nil, err
-				}
-				return append(ops, bodyOps...), nil
-			}
-		}
+	cmpOps, err := c.compareOperands(bin, a, b)
+	if err != nil {
+		return nil, err
 	}
+	return append(ops, cmpOps...), nil
+}
 
-	// 3. (f--) != 0 -> DECFSZ f,1
-	// 4. (f++) != 0 -> INCFSZ f,1
-	if bin, ok := cond.(BinaryExpr); ok && bin.Op == NEQ {
-		if isZero(bin.Rhs) {
-			if post, ok := bin.Lhs.(PostfixExpr); ok {
-				if id, ok := post.Expr.(IdentExpr); ok {
-					f, _ := c.resolveAddr(id.Name)
-					switch post.Op {
-					case DEC:
-						ops := []PicOp{Decfsz{F: f, D: DestF}}
-						bodyOps, err := c.compileStmt(s.Then)
-						if err != nil {
-							return nil, err
-						}
-						return append(ops, bodyOps...), nil
-					case INC:
-						ops := []PicOp{Incfsz{F: f, D: DestF}}
-						bodyOps, err := c.compileStmt(s.Then)
-						if err != nil {
-							return nil, err
-						}
-						return append(ops, bodyOps...), nil
-					}
-				}
-			}
+// compareOperands sets STATUS.Z if a and b, the operands of bin, are equal.
+func (c *asmGen) compareOperands(bin BinaryExpr, a, b operand) ([]PicOp, error) {
+	// Put literals on the right and W on the left.
+	if a.kind == literalOperand || b.kind == wOperand {
+		a, b = b, a
+	}
+	if a.kind == literalOperand {
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("comparison of two constants: %v", bin),
+			Range:   bin.Position(),
 		}
 	}
 
-	return nil, Diagnostic{
-		Code:    ErrType,
-		Message: fmt.Sprintf("unsupported if condition: %v", cond),
-		Range:   s.Cond.Position(),
+	switch {
+	case b.kind == literalOperand:
+		if err := checkByte(b.k, bin.Rhs); err != nil {
+			return nil, err
+		}
+		switch {
+		case a.kind == wOperand && b.k == 0:
+			// w == 0 -> IORLW 0 (leaves W alone)
+			return []PicOp{Iorlw{K: 0}}, nil
+		case a.kind == wOperand:
+			// w == k -> XORLW k
+			return []PicOp{Xorlw{K: b.k}}, nil
+		case b.k == 0:
+			// f == 0 -> MOVF f,1
+			return []PicOp{Movf{F: a.f, D: DestF}}, nil
+		default:
+			// f == k -> MOVF f,0; XORLW k
+			return []PicOp{Movf{F: a.f, D: DestW}, Xorlw{K: b.k}}, nil
+		}
+	case a.kind == wOperand && b.kind == wOperand:
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("comparison of w with itself: %v", bin),
+			Range:   bin.Position(),
+		}
+	case a.kind == wOperand:
+		// w == f -> XORWF f,0
+		return []PicOp{Xorwf{F: b.f, D: DestW}}, nil
+	default:
+		// f1 == f2 -> MOVF f1,0; XORWF f2,0
+		return []PicOp{Movf{F: a.f, D: DestW}, Xorwf{F: b.f, D: DestW}}, nil
 	}
 }
 
@@ -242,20 +506,22 @@ func (c *asmGen) compileAssign(s AssignStmt) ([]PicOp, error) {
 	op := s.Op
 	rhs := s.Expr
 
-	// Handle f[b] = 0/1
+	// Handle f[b] = bit and f[field] = value
 	if idx, ok := lhsExpr.(IndexExpr); ok {
-		if op == EQL {
-			b, err := c.resolveBit(idx.Name, idx.Index)
-			if err == nil {
-				f, _ := c.resolveAddr(idx.Name)
-				if val, ok := getNum(rhs); ok {
-					switch val {
-					case 0:
-						return []PicOp{Bcf{F: f, B: b}}, nil
-					case 1:
-						return []PicOp{Bsf{F: f, B: b}}, nil
-					}
-				}
+		if field, ok := c.resolveField(idx.Name, idx.Index); ok && op == EQL {
+			if err := c.checkEnums(lhsExpr, rhs, s.Position()); err != nil {
+				return nil, err
+			}
+			f, err := c.register(idx.Name, idx.Range)
+			if err != nil {
+				return nil, err
+			}
+			return c.writeField(f, field, rhs)
+		}
+		if b, err := c.resolveBit(idx.Name, idx.Index); err == nil {
+			ops, ok, err := c.compileBitAssign(idx, b, op, rhs)
+			if err != nil || ok {
+				return ops, err
 			}
 		}
 		return nil, Diagnostic{
@@ -275,100 +541,146 @@ func (c *asmGen) compileAssign(s AssignStmt) ([]PicOp, error) {
 		}
 	}
 
-	switch op {
-	case EQL: // =
-		if isW(lhsName) {
-			// w = k -> MOVLW k
-			if k, ok := getNum(rhs); ok {
-				return []PicOp{Movlw{K: k}}, nil
-			}
-			// w = f -> MOVF f,0
-			if name, ok := getIdent(rhs); ok {
-				f, _ := c.resolveAddr(name)
-				return []PicOp{Movf{F: f, D: DestW}}, nil
-			}
-		} else {
-			// f = w -> MOVWF f
-			if name, ok := getIdent(rhs); ok && isW(name) {
-				f, _ := c.resolveAddr(lhsName)
-				return []PicOp{Movwf{F: f}}, nil
-			}
-			// f = k -> MOVLW k; MOVWF f
-			if k, ok := getNum(rhs); ok {
-				f, _ := c.resolveAddr(lhsName)
-				return []PicOp{
-					Movlw{K: k},
-					Movwf{F: f},
-				}, nil
-			}
-			// f1 = f2 -> MOVF f2,0; MOVWF f1
-			if name, ok := getIdent(rhs); ok {
-				f1, _ := c.resolveAddr(lhsName)
-				f2, _ := c.resolveAddr(name)
-				return []PicOp{
-					Movf{F: f2, D: DestW},
-					Movwf{F: f1},
-				}, nil
-			}
+	if r, ok := c.coreRegister(lhsName); ok && r.Width == 2 {
+		return c.compileFSRAssign(r, s)
+	}
+
+	if v, ok := c.prog.Variables[lhsName]; ok && v.Type == "i16" {
+		return c.compileWordAssign(v, s)
+	}
+
+	dst, _, err := c.operand(lhsExpr)
+	if err != nil {
+		return nil, err
+	}
+	if dst.kind == literalOperand {
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("cannot assign to %s, which is a value, not a register", lhsName),
+			Range:   s.Lhs.Position(),
 		}
+	}
 
-	case ADDEQL: // +=
-		if isW(lhsName) {
-			// w += f -> ADDWF f,0
-			if name, ok := getIdent(rhs); ok {
-				f, _ := c.resolveAddr(name)
-				return []PicOp{Addwf{F: f, D: DestW}}, nil
-			}
-		} else if strings.HasPrefix(strings.ToLower(lhsName), "fsr") {
-			// fsrn += k -> ADDFSR fsrn, k
-			fsrStr := strings.ToLower(lhsName)
-			fsrNumStr := strings.TrimPrefix(fsrStr, "fsr")
-			fsrNum, err := strconv.Atoi(fsrNumStr)
-			if err == nil {
-				if k, ok := getNum(rhs); ok {
-					return []PicOp{Addfsr{FSR: fsrNum, K: k}}, nil
-				}
+	if op == EQL {
+		if err := c.checkEnums(lhsExpr, rhs, s.Position()); err != nil {
+			return nil, err
+		}
+	}
+
+	// x = f[field] -> field into W, then store
+	if idx, ok := rhs.(IndexExpr); ok && op == EQL {
+		if field, ok := c.resolveField(idx.Name, idx.Index); ok {
+			f, err := c.register(idx.Name, idx.Range)
+			if err != nil {
+				return nil, err
 			}
-		} else {
-			// f += w -> ADDWF f,1
-			if name, ok := getIdent(rhs); ok && isW(name) {
-				f, _ := c.resolveAddr(lhsName)
-				return []PicOp{Addwf{F: f, D: DestF}}, nil
+			ops := c.readField(f, field)
+			if dst.kind == registerOperand {
+				ops = append(ops, Movwf{F: dst.f})
 			}
+			return ops, nil
 		}
+	}
 
-	case SUBEQL: // -=
-		if strings.HasPrefix(strings.ToLower(lhsName), "fsr") {
-			// fsrn -= k -> ADDFSR fsrn, -k
-			fsrStr := strings.ToLower(lhsName)
-			fsrNumStr := strings.TrimPrefix(fsrStr, "fsr")
-			fsrNum, err := strconv.Atoi(fsrNumStr)
-			if err == nil {
-				if k, ok := getNum(rhs); ok {
-					return []PicOp{Addfsr{FSR: fsrNum, K: -k}}, nil
-				}
-			}
+	src, simple, err := c.operand(rhs)
+	if err != nil {
+		return nil, err
+	}
+	if simple && src.kind == literalOperand {
+		if err := checkByte(src.k, rhs); err != nil {
+			return nil, err
 		}
+	}
 
-	case ANDEQL: // &=
-		if isW(lhsName) {
-			// w &= k -> ANDLW k
-			if k, ok := getNum(rhs); ok {
-				return []PicOp{Andlw{K: k}}, nil
+	if op == EQL {
+		if !simple {
+			// x = expr -> expr into W, then MOVWF x
+			ops, err := c.evalExpr(rhs)
+			if err != nil {
+				return nil, err
 			}
-			// w &= f -> ANDWF f,0
-			if name, ok := getIdent(rhs); ok {
-				f, _ := c.resolveAddr(name)
-				return []PicOp{Andwf{F: f, D: DestW}}, nil
+			if dst.kind == registerOperand {
+				ops = append(ops, Movwf{F: dst.f})
 			}
-		} else {
-			// f &= w -> ANDWF f,1
-			if name, ok := getIdent(rhs); ok && isW(name) {
-				f, _ := c.resolveAddr(lhsName)
-				return []PicOp{Andwf{F: f, D: DestF}}, nil
+			return ops, nil
+		}
+		if dst.kind == wOperand {
+			switch src.kind {
+			case literalOperand:
+				// w = k -> MOVLW k
+				return []PicOp{Movlw{K: src.k}}, nil
+			case registerOperand:
+				// w = f -> MOVF f,0
+				return []PicOp{Movf{F: src.f, D: DestW}}, nil
+			default:
+				return nil, nil
 			}
 		}
+		switch src.kind {
+		case wOperand:
+			// f = w -> MOVWF f
+			return []PicOp{Movwf{F: dst.f}}, nil
+		case literalOperand:
+			// f = k -> MOVLW k; MOVWF f
+			return []PicOp{
+				Movlw{K: src.k},
+				Movwf{F: dst.f},
+			}, nil
+		default:
+			// f1 = f2 -> MOVF f2,0; MOVWF f1
+			return []PicOp{
+				Movf{F: src.f, D: DestW},
+				Movwf{F: dst.f},
+			}, nil
+		}
+	}
+
+	binOp, ok := compoundOps[op]
+	if !ok {
+		return nil, fmt.Errorf("cannot compile assignment: %v %v %v", lhsName, op, rhs)
+	}
+
+	// w op= x -> w op x
+	if dst.kind == wOperand {
+		return c.evalExpr(BinaryExpr{Lhs: lhsExpr, Op: binOp, Rhs: rhs, Range: s.Position()})
+	}
+
+	// f += 1 -> INCF f,1
+	// f -= 1 -> DECF f,1
+	if simple && src.kind == literalOperand && src.k == 1 {
+		switch binOp {
+		case PLUS:
+			return []PicOp{Incf{F: dst.f, D: DestF}}, nil
+		case MINUS:
+			return []PicOp{Decf{F: dst.f, D: DestF}}, nil
+		}
+	}
+
+	// f op= x -> x into W, then e.g. ADDWF f,1
+	ops, err := c.evalExpr(rhs)
+	if err != nil {
+		return nil, err
 	}
+	switch binOp {
+	case PLUS:
+		ops = append(ops, Addwf{F: dst.f, D: DestF})
+	case MINUS:
+		ops = append(ops, Subwf{F: dst.f, D: DestF})
+	case AMP:
+		ops = append(ops, Andwf{F: dst.f, D: DestF})
+	case PIPE:
+		ops = append(ops, Iorwf{F: dst.f, D: DestF})
+	case CARET:
+		ops = append(ops, Xorwf{F: dst.f, D: DestF})
+	}
+	return ops, nil
+}
 
-	return nil, fmt.Errorf("cannot compile assignment: %v %v %v", lhsName, op, rhs)
+// compoundOps maps each compound assignment to its binary operator.
+var compoundOps = map[TTy]TTy{
+	ADDEQL: PLUS,
+	SUBEQL: MINUS,
+	ANDEQL: AMP,
+	OREQL:  PIPE,
+	XOREQL: CARET,
 }
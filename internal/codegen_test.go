@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"slices"
 	"testing"
 )
 
@@ -27,17 +28,7 @@ fn main() begin
   return
 end
 `
-	tokens, err := Lex(input)
-	if err != nil {
-		t.Fatalf("Tokens failed: %v", err)
-	}
-
-	prog, err := Parse(tokens)
-	if err != nil {
-		t.Fatalf("Parse failed: %v", err)
-	}
-
-	ops, _, err := Compile(prog)
+	ops, _, err := compileBody(input)
 	if err != nil {
 		t.Fatalf("Compile failed: %v", err)
 	}
@@ -73,3 +64,139 @@ end
 		}
 	}
 }
+
+func TestCompileAliases(t *testing.T) {
+	input := `
+section constants
+porta: $0C [
+  rdy: 5
+]
+latc: $10E []
+led: latc[3]
+button: porta[2]
+port: porta
+section data
+common:
+  counter i8
+section constants
+count: counter
+section program
+fn main() begin
+  led = 1
+  if not button then
+    led = 0
+  if port[rdy] then
+    count = w
+  w = count
+  return
+end
+`
+	ops, _, err := compileBody(input)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	// porta and latc are in different banks, so the BCF needs a MOVLB
+	// and can't be skipped.
+	expected := []string{
+		"main:",
+		"BSF 0x10E,3",
+		"; branch around BCF 0x10E,3, which needs a bank switch",
+		"BTFSC 0xC,2",
+		" GOTO _skipped_3",
+		"BCF 0x10E,3",
+		"_skipped_3:",
+		"BTFSC 0xC,5",
+		"MOVWF 0x70",
+		"MOVF 0x70,0",
+		"RETURN",
+	}
+
+	if len(ops) != len(expected) {
+		t.Fatalf("Expected %d ops, got %d", len(expected), len(ops))
+	}
+
+	for i, op := range ops {
+		if op.Assembly() != expected[i] {
+			t.Errorf("Op %d: expected %q, got %q", i, expected[i], op.Assembly())
+		}
+	}
+}
+
+func TestCompileAliasCycle(t *testing.T) {
+	input := `
+section constants
+a: b
+b: a
+section program
+fn main() begin
+  a = 1
+end
+`
+	if _, _, err := compileBody(input); err == nil {
+		t.Error("expected an error for a self-referential alias")
+	}
+}
+
+// inMain returns a main function running body.
+func inMain(body string) string {
+	return "fn main() begin\n" + body + "\nend\n"
+}
+
+// compileOption changes what compileBody returns.
+type compileOption int
+
+const (
+	withStartup compileOption = iota // keep the reset vector and startup code
+	assembled                        // also assemble the code, returning any error
+)
+
+// compileBody compiles input and drops the reset vector and startup code
+// that a program with a main function gets, leaving the code under test.
+func compileBody(input string, opts ...compileOption) ([]PicOp, SymbolTable, error) {
+	toks, err := Lex(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	prog, err := Parse(toks)
+	if err != nil {
+		return nil, nil, err
+	}
+	ops, syms, err := Compile(prog)
+	if err == nil && slices.Contains(opts, assembled) {
+		_, _, err = Assemble(ops, syms)
+	}
+	if slices.Contains(opts, withStartup) {
+		return ops, syms, err
+	}
+
+	var body []PicOp
+	reset := false
+	for i, op := range ops {
+		switch op := op.(type) {
+		case OrgOp:
+			if op.Address == 0 {
+				reset = true
+				continue
+			}
+			if reset && op.Address == 4 && i+1 < len(ops) && ops[i+1] == PicOp(Retfie{}) {
+				continue
+			}
+			reset = false
+		case Retfie:
+			if reset {
+				reset = false
+				continue
+			}
+		case LabelOp:
+			if op.Name == startupLabel {
+				return body, syms, err
+			}
+			reset = false
+		}
+		if !reset {
+			body = append(body, op)
+		}
+	}
+	return body, syms, err
+}
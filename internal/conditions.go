@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// Conditions are compiled to skip instructions. Each bit test, comparison
+// or inc/dec test becomes a test that can skip the following instruction
+// either when it is false or when it is true, and and/or chain tests
+// together with GOTOs to generated labels. The last test of a condition
+// skips over a one-word body directly, which is why the body is
+// compiled first.
+
+// A test is one condition compiled to setup code and a skip.
+type test struct {
+	setup   []PicOp
+	ifFalse []PicOp // skips the next instruction if the condition is false
+	ifTrue  []PicOp // skips the next instruction if the condition is true
+}
+
+func (c *asmGen) compileIf(s IfStmt) ([]PicOp, error) {
+	body, err := c.compileStmt(s.Then)
+	if err != nil {
+		return nil, err
+	}
+
+	end := c.newLabel("endif")
+	var ops []PicOp
+	if codeWords(body) == 1 {
+		// Skip the body unless the condition holds.
+		condOps, pre, err := c.condSkip(s.Cond, end)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(condOps, pre...)
+	} else {
+		// Jump over the body unless the condition holds.
+		ops, err = c.condJump(s.Cond, end, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ops = append(ops, body...)
+	if jumpsTo(ops, end) {
+		ops = append(ops, LabelOp{Name: end})
+	}
+	return ops, nil
+}
+
+// condJump emits code that jumps to label if the value of e is jump,
+// and falls through otherwise.
+func (c *asmGen) condJump(e Expr, label string, jump bool) ([]PicOp, error) {
+	switch e := e.(type) {
+	case UnaryExpr:
+		if e.Op == NOT {
+			return c.condJump(e.Expr, label, !jump)
+		}
+	case BinaryExpr:
+		if e.Op != AND && e.Op != OR {
+			break
+		}
+		if (e.Op == OR) == jump {
+			// Either side decides: a or b jumps if a does, a and b
+			// doesn't get past a false a.
+			lhs, err := c.condJump(e.Lhs, label, jump)
+			if err != nil {
+				return nil, err
+			}
+			rhs, err := c.condJump(e.Rhs, label, jump)
+			if err != nil {
+				return nil, err
+			}
+			return append(lhs, rhs...), nil
+		}
+		// The left side can only rule the jump out, so it skips the
+		// right side.
+		next := c.newLabel("next")
+		lhs, err := c.condJump(e.Lhs, next, !jump)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := c.condJump(e.Rhs, label, jump)
+		if err != nil {
+			return nil, err
+		}
+		ops := append(lhs, rhs...)
+		return append(ops, LabelOp{Name: next}), nil
+	}
+
+	t, err := c.test(e)
+	if err != nil {
+		return nil, err
+	}
+	ops := t.setup
+	if jump {
+		ops = append(ops, t.ifFalse...)
+	} else {
+		ops = append(ops, t.ifTrue...)
+	}
+	return append(ops, Goto{Label: label}), nil
+}
+
+// condSkip emits code ending in a skip that skips the next instruction
+// if e is false. Jumps past that instruction go to end, and pre holds
+// labels that must come just before it.
+func (c *asmGen) condSkip(e Expr, end string) (ops, pre []PicOp, err error) {
+	switch e := e.(type) {
+	case UnaryExpr:
+		if inner, ok := e.Expr.(BinaryExpr); ok && e.Op == NOT && (inner.Op == AND || inner.Op == OR) {
+			return c.condSkip(negate(inner), end)
+		}
+	case BinaryExpr:
+		switch e.Op {
+		case AND:
+			// a and b -> jump to end unless a, then skip unless b
+			lhs, err := c.condJump(e.Lhs, end, false)
+			if err != nil {
+				return nil, nil, err
+			}
+			rhs, pre, err := c.condSkip(e.Rhs, end)
+			if err != nil {
+				return nil, nil, err
+			}
+			return append(lhs, rhs...), pre, nil
+		case OR:
+			// a or b -> jump to the body if a, then skip unless b
+			then := c.newLabel("then")
+			lhs, err := c.condJump(e.Lhs, then, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			rhs, pre, err := c.condSkip(e.Rhs, end)
+			if err != nil {
+				return nil, nil, err
+			}
+			return append(lhs, rhs...), append(pre, LabelOp{Name: then}), nil
+		}
+	}
+
+	t, err := c.test(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(t.setup, t.ifFalse...), nil, nil
+}
+
+// negate applies De Morgan's laws to push not inside and/or.
+func negate(e Expr) Expr {
+	switch e := e.(type) {
+	case UnaryExpr:
+		if e.Op == NOT {
+			return e.Expr
+		}
+	case BinaryExpr:
+		switch e.Op {
+		case AND:
+			e.Op = OR
+		case OR:
+			e.Op = AND
+		default:
+			return UnaryExpr{Op: NOT, Expr: e, Range: e.Range}
+		}
+		e.Lhs, e.Rhs = negate(e.Lhs), negate(e.Rhs)
+		return e
+	}
+	return UnaryExpr{Op: NOT, Expr: e, Range: e.Position()}
+}
+
+// test compiles a condition that isn't built from and/or.
+func (c *asmGen) test(e Expr) (test, error) {
+	isZero := func(e Expr) bool {
+		val, ok := getNum(e)
+		return ok && val == 0
+	}
+	status := hexAddr(regSTATUS)
+
+	switch e := e.(type) {
+	case UnaryExpr:
+		if e.Op == NOT {
+			// not x -> x with the skips swapped
+			t, err := c.test(e.Expr)
+			t.ifFalse, t.ifTrue = t.ifTrue, t.ifFalse
+			return t, err
+		}
+
+	case IndexExpr:
+		// f[b] -> BTFSC f,b
+		b, err := c.resolveBit(e.Name, e.Index)
+		if err != nil {
+			break
+		}
+		f, err := c.register(e.Name, e.Range)
+		if err != nil {
+			return test{}, err
+		}
+		return test{
+			ifFalse: []PicOp{Btfsc{F: f, B: b}},
+			ifTrue:  []PicOp{Btfss{F: f, B: b}},
+		}, nil
+
+	case BinaryExpr:
+		// (f--) != 0 -> DECFSZ f,1
+		// (f++) != 0 -> INCFSZ f,1
+		// Skipping when true needs the result in Z instead.
+		if post, ok := e.Lhs.(PostfixExpr); ok && e.Op == NEQ && isZero(e.Rhs) {
+			id, ok := post.Expr.(IdentExpr)
+			if !ok {
+				break
+			}
+			f, err := c.register(id.Name, id.Range)
+			if err != nil {
+				return test{}, err
+			}
+			switch post.Op {
+			case DEC:
+				return test{
+					ifFalse: []PicOp{Decfsz{F: f, D: DestF}},
+					ifTrue:  []PicOp{Decf{F: f, D: DestF}, Btfsc{F: status, B: statusZ}},
+				}, nil
+			case INC:
+				return test{
+					ifFalse: []PicOp{Incfsz{F: f, D: DestF}},
+					ifTrue:  []PicOp{Incf{F: f, D: DestF}, Btfsc{F: status, B: statusZ}},
+				}, nil
+			}
+		}
+
+		// x == y -> set Z if equal, then BTFSC STATUS,Z
+		// x != y -> set Z if equal, then BTFSS STATUS,Z
+		if e.Op == EQEQ || e.Op == NEQ {
+			ops, err := c.compare(e)
+			if err != nil {
+				return test{}, err
+			}
+			t := test{
+				setup:   ops,
+				ifFalse: []PicOp{Btfsc{F: status, B: statusZ}},
+				ifTrue:  []PicOp{Btfss{F: status, B: statusZ}},
+			}
+			if e.Op == NEQ {
+				t.ifFalse, t.ifTrue = t.ifTrue, t.ifFalse
+			}
+			return t, nil
+		}
+	}
+
+	return test{}, Diagnostic{
+		Code:    ErrType,
+		Message: fmt.Sprintf("unsupported if condition: %v", e),
+		Range:   e.Position(),
+	}
+}
+
+// codeWords counts the instructions in ops, ignoring labels and comments.
+func codeWords(ops []PicOp) int {
+	n := 0
+	for _, op := range ops {
+		switch op.(type) {
+		case LabelOp, CommentOp:
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// jumpsTo reports whether any op in ops jumps to label.
+func jumpsTo(ops []PicOp, label string) bool {
+	for _, op := range ops {
+		if g, ok := op.(Goto); ok && g.Label == label {
+			return true
+		}
+	}
+	return false
+}
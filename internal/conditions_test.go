@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+// runCond runs ops with the given registers, following skips and GOTOs.
+// It only understands the instructions that conditions are built from.
+func runCond(t *testing.T, ops []PicOp, regs map[string]int) {
+	t.Helper()
+	labels := map[string]int{}
+	for i, op := range ops {
+		if l, ok := op.(LabelOp); ok {
+			labels[l.Name] = i
+		}
+	}
+
+	var w int
+	var z bool
+	skip := false
+	for pc, steps := 0, 0; pc < len(ops); pc++ {
+		if steps++; steps > 1000 {
+			t.Fatal("ops don't terminate")
+		}
+		op := ops[pc]
+		if _, ok := op.(LabelOp); ok {
+			continue
+		}
+		if skip {
+			skip = false
+			continue
+		}
+		switch op := op.(type) {
+		case Btfsc:
+			skip = regs[op.F]&(1<<op.B) == 0
+		case Btfss:
+			skip = regs[op.F]&(1<<op.B) != 0
+		case Bsf:
+			regs[op.F] |= 1 << op.B
+		case Bcf:
+			regs[op.F] &^= 1 << op.B
+		case Goto:
+			target, ok := labels[op.Label]
+			if !ok {
+				t.Fatalf("GOTO to undefined label %s", op.Label)
+			}
+			pc = target
+		case Movlw:
+			w = op.K
+		case Movwf:
+			regs[op.F] = w
+		case Movf:
+			z = regs[op.F] == 0
+			if op.D == DestW {
+				w = regs[op.F]
+			}
+		case Xorlw:
+			w ^= op.K
+			z = w == 0
+		default:
+			t.Fatalf("unexpected op in condition: %s", op.Assembly())
+		}
+		if z {
+			regs["0x3"] |= 1 << statusZ
+		} else {
+			regs["0x3"] &^= 1 << statusZ
+		}
+	}
+}
+
+func TestCompileConditions(t *testing.T) {
+	bit := func(v, b int) bool { return v&(1<<b) != 0 }
+	tests := []struct {
+		cond string
+		want func(v int) bool
+	}{
+		{"flags[0] and flags[1]", func(v int) bool { return bit(v, 0) && bit(v, 1) }},
+		{"flags[0] or flags[1]", func(v int) bool { return bit(v, 0) || bit(v, 1) }},
+		{"not flags[0] and not flags[1]", func(v int) bool { return !bit(v, 0) && !bit(v, 1) }},
+		{"flags[0] and (flags[1] or flags[2])", func(v int) bool { return bit(v, 0) && (bit(v, 1) || bit(v, 2)) }},
+		{"(flags[0] or flags[1]) and flags[2]", func(v int) bool { return (bit(v, 0) || bit(v, 1)) && bit(v, 2) }},
+		{"(flags[0] or flags[1]) and (flags[2] or not flags[0])", func(v int) bool { return (bit(v, 0) || bit(v, 1)) && (bit(v, 2) || !bit(v, 0)) }},
+		{"not (flags[0] and flags[1]) or flags[2]", func(v int) bool { return !(bit(v, 0) && bit(v, 1)) || bit(v, 2) }},
+		{"flags[0] or flags[1] or flags[2]", func(v int) bool { return bit(v, 0) || bit(v, 1) || bit(v, 2) }},
+		{"not (flags[0] or flags[1] and flags[2])", func(v int) bool { return !(bit(v, 0) || bit(v, 1) && bit(v, 2)) }},
+		{"flags == 3 or flags[2]", func(v int) bool { return v == 3 || bit(v, 2) }},
+		{"flags != 5 and not (flags == 1)", func(v int) bool { return v != 5 && v != 1 }},
+	}
+	bodies := []string{
+		"hit[0] = 1",
+		"begin hit[0] = 1 hit[1] = 1 end",
+	}
+	for _, tt := range tests {
+		for _, body := range bodies {
+			input := fmt.Sprintf(`
+section data
+common:
+  flags i8
+  hit i8
+section program
+fn main() begin
+  if %s then %s
+end
+`, tt.cond, body)
+			ops, _, err := compileBody(input)
+			if err != nil {
+				t.Errorf("Compile(%q) failed: %v", tt.cond, err)
+				continue
+			}
+
+			for v := range 8 {
+				regs := map[string]int{"0x70": v}
+				runCond(t, ops, regs)
+				if got := regs["0x71"]&1 != 0; got != tt.want(v) {
+					t.Errorf("if %s then %s with flags = %d: expected %v, got %v", tt.cond, body, v, tt.want(v), got)
+				}
+			}
+		}
+	}
+}
+
+func TestCompileConditionShape(t *testing.T) {
+	input := `
+section constants
+porta: $0C []
+flags: $70 [ busy: 3 ]
+section program
+fn main() begin
+  if porta[2] and not flags[busy] then
+    flags[0] = 1
+  if porta[2] or porta[3] then
+    flags[0] = 0
+  if porta[2] and porta[3] then begin
+    flags[0] = 1
+    flags[1] = 1
+  end
+end
+`
+	ops, _, err := compileBody(input)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	expected := []string{
+		"main:",
+		"BTFSS 0xC,2",
+		" GOTO _endif_1",
+		"BTFSS 0x70,3",
+		"BSF 0x70,0",
+		"_endif_1:",
+		"BTFSC 0xC,2",
+		" GOTO _then_3",
+		"BTFSC 0xC,3",
+		"_then_3:",
+		"BCF 0x70,0",
+		"BTFSS 0xC,2",
+		" GOTO _endif_4",
+		"BTFSS 0xC,3",
+		" GOTO _endif_4",
+		"BSF 0x70,0",
+		"BSF 0x70,1",
+		"_endif_4:",
+	}
+
+	if len(ops) != len(expected) {
+		t.Fatalf("Expected %d ops, got %d", len(expected), len(ops))
+	}
+	for i, op := range ops {
+		if op.Assembly() != expected[i] {
+			t.Errorf("Op %d: expected %q, got %q", i, expected[i], op.Assembly())
+		}
+	}
+}
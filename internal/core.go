@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// The core registers sit at $00-$0B of every bank, so they are built in
+// rather than declared. FSR0 and FSR1 are also available as 16-bit
+// pairs, which can be pointed at a variable or stepped with ADDFSR.
+// W itself has no address; where a register is needed, such as w[0],
+// it is read through WREG.
+
+type coreRegister struct {
+	Address int
+	Width   int // in bytes
+}
+
+var coreRegisters = map[string]coreRegister{
+	"indf0":  {regINDF0, 1},
+	"indf1":  {regINDF1, 1},
+	"pcl":    {regPCL, 1},
+	"status": {regSTATUS, 1},
+	"fsr0l":  {regFSR0L, 1},
+	"fsr0h":  {regFSR0H, 1},
+	"fsr1l":  {regFSR1L, 1},
+	"fsr1h":  {regFSR1H, 1},
+	"fsr0":   {regFSR0L, 2},
+	"fsr1":   {regFSR1L, 2},
+	"bsr":    {regBSR, 1},
+	"wreg":   {regWREG, 1},
+	"pclath": {regPCLATH, 1},
+	"intcon": {regINTCON, 1},
+}
+
+// coreRegister looks up name as a core register. An SFR or variable of
+// the same name takes precedence.
+func (c *asmGen) coreRegister(name string) (coreRegister, bool) {
+	if _, ok := c.prog.SFRs[name]; ok {
+		return coreRegister{}, false
+	}
+	if _, ok := c.prog.Variables[name]; ok {
+		return coreRegister{}, false
+	}
+	if isW(name) {
+		name = "wreg"
+	}
+	r, ok := coreRegisters[name]
+	return r, ok
+}
+
+// compileFSRAssign compiles an assignment to fsr0 or fsr1.
+//
+//	fsrn = x      -> address of x into FSRnL and FSRnH
+//	fsrn = rom    -> $8000 plus the address of rom
+//	fsrn = k      -> k into FSRnL and FSRnH
+//	fsrn += k     -> ADDFSR n,k, or a 16-bit add if k is out of range
+func (c *asmGen) compileFSRAssign(r coreRegister, s AssignStmt) ([]PicOp, error) {
+	lo, hi := hexAddr(r.Address), hexAddr(r.Address+1)
+	name, _ := getIdent(s.Lhs)
+
+	if id, ok := s.Expr.(IdentExpr); ok && s.Op == EQL {
+		if a, ok := c.prog.Rom[id.Name]; ok {
+			return c.pointAtRom(r, a, id.Range)
+		}
+	}
+
+	var k int
+	if id, ok := s.Expr.(IdentExpr); ok && c.isAddressable(id.Name) {
+		addr, err := c.addressOf(id)
+		if err != nil {
+			return nil, err
+		}
+		k = addr
+	} else if op, ok, err := c.operand(s.Expr); err != nil {
+		return nil, err
+	} else if ok && op.kind == literalOperand {
+		k = op.k
+	} else {
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s can only be set to an address or a constant, got %v", name, s.Expr),
+			Range:   s.Expr.Position(),
+		}
+	}
+
+	switch s.Op {
+	case EQL:
+		if k < 0 || k > 0xFFFF {
+			return nil, Diagnostic{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("%v = %d does not fit in 16 bits", s.Expr, k),
+				Range:   s.Expr.Position(),
+			}
+		}
+		var ops []PicOp
+		for _, b := range []struct {
+			f string
+			k int
+		}{{lo, k & 0xFF}, {hi, k >> 8}} {
+			if b.k == 0 {
+				ops = append(ops, Clrf{F: b.f})
+			} else {
+				ops = append(ops, Movlw{K: b.k}, Movwf{F: b.f})
+			}
+		}
+		return ops, nil
+	case ADDEQL, SUBEQL:
+		if s.Op == SUBEQL {
+			k = -k
+		}
+		if k >= -32 && k <= 31 {
+			return []PicOp{Addfsr{FSR: (r.Address - regFSR0L) / 2, K: k}}, nil
+		}
+		k &= 0xFFFF
+		return []PicOp{
+			Movlw{K: k & 0xFF},
+			Addwf{F: lo, D: DestF},
+			Movlw{K: k >> 8},
+			Addwfc{F: hi, D: DestF},
+		}, nil
+	}
+	return nil, Diagnostic{
+		Code:    ErrType,
+		Message: fmt.Sprintf("%s is 16 bits, so it can only be set, added to or subtracted from", name),
+		Range:   s.Position(),
+	}
+}
+
+// pointAtRom points the FSR r at the rom data a.
+func (c *asmGen) pointAtRom(r coreRegister, a RomArray, rng Range) ([]PicOp, error) {
+	if a.Packed {
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s is packed, and an FSR only reads the low byte of each word", a.Name),
+			Range:   rng,
+		}
+	}
+	lo, hi := hexAddr(r.Address), hexAddr(r.Address+1)
+	return []PicOp{
+		MovlwLow{Label: romLabel(a.Name)},
+		Movwf{F: lo},
+		MovlwHigh{Label: romLabel(a.Name)},
+		Movwf{F: hi},
+		Bsf{F: hi, B: 7},
+	}, nil
+}
+
+// isAddressable reports whether name is a register, as opposed to a
+// value constant or W.
+func (c *asmGen) isAddressable(name string) bool {
+	if _, ok := c.prog.Variables[name]; ok {
+		return true
+	}
+	if _, ok := c.prog.SFRs[name]; ok {
+		return true
+	}
+	_, ok := c.coreRegister(name)
+	return ok && !isW(name)
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+const coreData = "section data\ncommon:\n  x i8\nbanked:\n  buffer i8 at $120\n  wide i16\nsection program\n"
+
+func TestCoreRegisters(t *testing.T) {
+	ops, _, err := compileBody(coreData + `
+fn main() begin
+  fsr0 = buffer
+  fsr1 = &x
+  fsr0 = $2000
+  fsr1 = wide
+  fsr0 += 5
+  fsr1 -= 32
+  fsr0 += 100
+  fsr1 -= $101
+  fsr0l = w
+  x = fsr1h
+  status[2] = 0
+  if w[0] then
+    x = 1
+  if not wreg[7] then
+    x = 2
+  w[1] = 1
+  x = &intcon
+end
+`)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	expected := []string{
+		"main:",
+		"MOVLW 32",
+		"MOVWF 0x4",
+		"MOVLW 1",
+		"MOVWF 0x5",
+		"MOVLW 112",
+		"MOVWF 0x6",
+		"CLRF 0x7",
+		"CLRF 0x4",
+		"MOVLW 32",
+		"MOVWF 0x5",
+		"MOVLW 32",
+		"MOVWF 0x6",
+		"CLRF 0x7",
+		"ADDFSR 0,5",
+		"ADDFSR 1,-32",
+		"MOVLW 100",
+		"ADDWF 0x4,1",
+		"MOVLW 0",
+		"ADDWFC 0x5,1",
+		"MOVLW 255",
+		"ADDWF 0x6,1",
+		"MOVLW 254",
+		"ADDWFC 0x7,1",
+		"MOVWF 0x4",
+		"MOVF 0x7,0",
+		"MOVWF 0x70",
+		"BCF 0x3,2",
+		"BTFSS 0x9,0",
+		" GOTO _endif_1",
+		"MOVLW 1",
+		"MOVWF 0x70",
+		"_endif_1:",
+		"BTFSC 0x9,7",
+		" GOTO _endif_2",
+		"MOVLW 2",
+		"MOVWF 0x70",
+		"_endif_2:",
+		"BSF 0x9,1",
+		"MOVLW 11",
+		"MOVWF 0x70",
+	}
+	var got []string
+	for _, op := range ops {
+		got = append(got, op.Assembly())
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestCoreRegisterErrors(t *testing.T) {
+	tests := []struct {
+		stmt string
+		msg  string
+	}{
+		{"x = fsr0", "fsr0 is 16 bits; use fsr0l or fsr0h for one byte"},
+		{"fsr1 = x + 1", "fsr1 can only be set to an address or a constant"},
+		{"fsr0 = $10000", "does not fit in 16 bits"},
+		{"fsr0 &= 3", "fsr0 is 16 bits, so it can only be set, added to or subtracted from"},
+		{"fsr0[1] = 1", "fsr0 is 16 bits"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody(coreData + "fn main() begin\n  " + tt.stmt + "\nend\n")
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.stmt, tt.msg, err)
+		}
+	}
+}
+
+// TestUppercaseW checks that W is recognised whatever its case, as it
+// was before it became a core register.
+func TestUppercaseW(t *testing.T) {
+	ops, _, err := compileBody(coreData+"fn main() begin\n  W = 5\n  x = W\n  W[0] = 1\nend\n", assembled)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	expected := []string{"main:", "MOVLW 5", "MOVWF 0x70", "BSF 0x9,0"}
+	var got []string
+	for _, op := range ops {
+		got = append(got, op.Assembly())
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
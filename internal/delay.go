@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// Delays are built from counted loops of the form
+//
+//	MOVLW n       ; 1
+//	MOVWF t       ; 1
+//	loop:
+//	  <body>      ; B
+//	  DECFSZ t,1  ; 1, or 2 when it skips
+//	  GOTO loop   ; 2
+//
+// which take 1 + n*(B+3) cycles. The body is itself a delay using the
+// next counter, so each nesting level multiplies the reach by about 256.
+const (
+	delayMaxDepth = 3 // number of nested loop counters
+	delayMaxNops  = 6 // below this many cycles, NOPs are shorter than a loop
+)
+
+// delayReach returns the longest delay that can be built using the
+// counters from depth onwards.
+func delayReach(depth int) int64 {
+	if depth >= delayMaxDepth {
+		return delayMaxNops
+	}
+	return 1 + 256*(delayReach(depth+1)+3)
+}
+
+func (c *asmGen) compileDelay(s DelayStmt) ([]PicOp, error) {
+	cycles, err := c.delayCycles("delay", s)
+	if err != nil {
+		return nil, err
+	}
+	if cycles > delayReach(0) {
+		return nil, Diagnostic{
+			Code:    ErrInvalidNumber,
+			Message: fmt.Sprintf("delay of %d cycles is longer than the maximum of %d", cycles, delayReach(0)),
+			Range:   s.Position(),
+		}
+	}
+
+	ops := []PicOp{CommentOp{Text: fmt.Sprintf("delay %d cycles", cycles)}}
+	return append(ops, c.delayOps(cycles, 0)...), nil
+}
+
+// delayCycles returns the number of instruction cycles in the amount of
+// s. The amounts of within and exactly blocks work the same way, so what
+// names the statement in messages.
+func (c *asmGen) delayCycles(what string, s DelayStmt) (int64, error) {
+	if s.Unit == "" {
+		var err error
+		if s, err = c.delayUnit(what, s); err != nil {
+			return 0, err
+		}
+	}
+	amount, ok := c.literal(s.Amount)
+	if !ok {
+		return 0, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s amount must be a constant, got %v", what, s.Amount),
+			Range:   s.Amount.Position(),
+		}
+	}
+	if amount < 0 {
+		return 0, Diagnostic{
+			Code:    ErrInvalidNumber,
+			Message: fmt.Sprintf("%s amount must not be negative, got %d", what, amount),
+			Range:   s.Amount.Position(),
+		}
+	}
+
+	cycles := int64(amount)
+	if s.Unit != "cycles" {
+		if c.prog.Fosc == 0 {
+			return 0, Diagnostic{
+				Code:    ErrUndefinedSymbol,
+				Message: fmt.Sprintf("%s in %s needs the oscillator frequency; declare %s in the configuration section", what, s.Unit, foscKey),
+				Range:   s.Position(),
+			}
+		}
+		// One instruction cycle is four oscillator periods.
+		num := int64(amount) * int64(c.prog.Fosc)
+		den := 4 * delayUnits[s.Unit]
+		cycles = num / den
+		if rem := num % den; rem != 0 {
+			if 2*rem >= den {
+				cycles++
+			}
+			c.warn(s.Position(), fmt.Sprintf("%s %d%s is %.2f cycles at %d Hz; rounded to %d cycles",
+				what, amount, s.Unit, float64(num)/float64(den), c.prog.Fosc, cycles))
+		}
+	}
+	return cycles, nil
+}
+
+// delayUnit rewrites delay 1ms, whose amount carries its unit, as
+// delay 1000000 ns.
+func (c *asmGen) delayUnit(what string, s DelayStmt) (DelayStmt, error) {
+	q, ok, err := c.quantity(s.Amount)
+	if err != nil {
+		return s, err
+	}
+	if n, isNum := s.Amount.(NumExpr); isNum && n.Ty == NUMUNIT && n.Unit == NoUnit {
+		s.Unit = "cycles" // delay 100cycles
+		return s, nil
+	}
+	if !ok || q.Unit == NoUnit {
+		return s, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s %v needs a unit: cycles, s, ms, us or ns", what, s.Amount),
+			Range:   s.Range,
+		}
+	}
+	if q.Unit != TimeUnit {
+		return s, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s needs a time, but %v is a %s", what, s.Amount, q.Unit),
+			Range:   s.Amount.Position(),
+		}
+	}
+	s.Amount = NumExpr{Val: fmt.Sprint(q.Value), Value: q.Value, Ty: NUMDECIMAL, Range: s.Amount.Position()}
+	s.Unit = "ns"
+	return s, nil
+}
+
+// delayOps returns code that takes exactly cycles instruction cycles,
+// using the loop counters from depth onwards.
+func (c *asmGen) delayOps(cycles int64, depth int) []PicOp {
+	if cycles <= delayMaxNops || depth >= delayMaxDepth {
+		ops := make([]PicOp, 0, cycles)
+		for range cycles {
+			ops = append(ops, Nop{})
+		}
+		return ops
+	}
+
+	// An outer loop that runs once only costs words and a counter, so
+	// start from the innermost counter that reaches far enough, unless
+	// starting further out gives shorter code.
+	start, words := depth, 0
+	for d := delayMaxDepth - 1; d >= depth; d-- {
+		if d > depth && delayReach(d) < cycles {
+			continue
+		}
+		if n := codeWords((&asmGen{}).delayLoop(cycles, d)); words == 0 || n < words {
+			start, words = d, n
+		}
+	}
+	return c.delayLoop(cycles, start)
+}
+
+// delayLoop returns a loop using the counter at depth that, with
+// whatever follows it, takes exactly cycles instruction cycles.
+func (c *asmGen) delayLoop(cycles int64, depth int) []PicOp {
+	// A loop with an empty body covers up to 769 cycles, and a few NOPs
+	// after it a little more. Beyond that, pick the fewest iterations
+	// whose body can still fit and give the body as much of the budget as
+	// divides evenly. Whatever is left over is less than one cycle per
+	// iteration and is delayed after the loop.
+	var n, body int64
+	if cycles-1 <= 3*256+delayMaxNops {
+		n = min((cycles-1)/3, 256)
+	} else {
+		n = (cycles - 1 + delayReach(depth+1) + 2) / (delayReach(depth+1) + 3)
+		body = (cycles-1)/n - 3
+	}
+	rest := cycles - 1 - n*(body+3)
+
+	counter := c.temp(fmt.Sprintf("delay%d", depth))
+	loop := c.newLabel("delay")
+	ops := []PicOp{
+		Movlw{K: int(n & 0xFF)}, // 256 iterations is a count of 0
+		Movwf{F: counter},
+		LabelOp{Name: loop},
+	}
+	ops = append(ops, c.delayOps(body, depth+1)...)
+	ops = append(ops,
+		Decfsz{F: counter, D: DestF},
+		Goto{Label: loop},
+	)
+	return append(ops, c.delayOps(rest, depth)...)
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// countDelayCycles runs the ops produced for a delay and returns how many
+// instruction cycles they take. It only understands the instructions
+// that delays are built from.
+func countDelayCycles(t *testing.T, ops []PicOp) int64 {
+	t.Helper()
+	labels := map[string]int{}
+	for i, op := range ops {
+		if l, ok := op.(LabelOp); ok {
+			labels[l.Name] = i
+		}
+	}
+
+	var cycles int64
+	var w int
+	regs := map[string]int{}
+	for pc := 0; pc < len(ops); pc++ {
+		switch op := ops[pc].(type) {
+		case LabelOp, CommentOp:
+		case Nop:
+			cycles++
+		case Movlw:
+			w = op.K
+			cycles++
+		case Movwf:
+			regs[op.F] = w
+			cycles++
+		case Decfsz:
+			regs[op.F] = (regs[op.F] - 1) & 0xFF
+			cycles++
+			if regs[op.F] == 0 {
+				pc++
+				cycles++
+			}
+		case Goto:
+			pc = labels[op.Label]
+			cycles += 2
+		default:
+			t.Fatalf("unexpected op in delay: %s", op.Assembly())
+		}
+	}
+	return cycles
+}
+
+func TestDelayCycleExact(t *testing.T) {
+	for _, want := range []int64{0, 1, 5, 6, 7, 8, 9, 100, 768, 769, 770, 771, 1000, 2305, 2306, 65536, 100_000, 590_849, 1_000_003, 20_000_000} {
+		c := &asmGen{}
+		got := countDelayCycles(t, c.delayOps(want, 0))
+		if got != want {
+			t.Errorf("delay of %d cycles took %d", want, got)
+		}
+	}
+}
+
+// TestDelayNesting checks that a delay only nests as deep as it needs to,
+// rather than wrapping its loops in counters that run once.
+func TestDelayNesting(t *testing.T) {
+	tests := []struct {
+		cycles   int64
+		words    int
+		counters []string
+	}{
+		{770, 5, []string{"_delay2"}},
+		{2000, 14, []string{"_delay2"}},
+		{100_000, 18, []string{"_delay1", "_delay2"}},
+	}
+	for _, tt := range tests {
+		ops := (&asmGen{}).delayOps(tt.cycles, 0)
+		if got := codeWords(ops); got != tt.words {
+			t.Errorf("delay of %d cycles: expected %d words, got %d", tt.cycles, tt.words, got)
+		}
+		var counters []string
+		for _, op := range ops {
+			if m, ok := op.(Movwf); ok && !slices.Contains(counters, m.F) {
+				counters = append(counters, m.F)
+			}
+		}
+		slices.Sort(counters)
+		if !slices.Equal(counters, tt.counters) {
+			t.Errorf("delay of %d cycles: expected counters %v, got %v", tt.cycles, tt.counters, counters)
+		}
+	}
+}
+
+func TestDelayUnits(t *testing.T) {
+	input := `
+section configuration
+  fosc: 32_000_000
+
+section program
+fn main() begin
+  delay 250 us
+  delay 3 us
+  delay 1200 cycles
+end
+`
+	toks, err := Lex(input)
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	prog, err := Parse(toks)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if prog.Fosc != 32_000_000 {
+		t.Errorf("expected fosc 32000000, got %d", prog.Fosc)
+	}
+
+	ops, _, warnings, err := CompileWithWarnings(prog)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	var comments []string
+	for _, op := range ops {
+		if c, ok := op.(CommentOp); ok {
+			comments = append(comments, c.Text)
+		}
+	}
+	want := []string{"delay 2000 cycles", "delay 24 cycles", "delay 1200 cycles"}
+	if strings.Join(comments, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, comments)
+	}
+
+	// 3us at 8 MIPS is exactly 24 cycles, so nothing should be rounded.
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got %v", warnings)
+	}
+}
+
+func TestDelayRounding(t *testing.T) {
+	input := `
+section configuration
+  fosc: 4_000_000
+
+section program
+fn main() begin
+  delay 1500 ns
+end
+`
+	toks, err := Lex(input)
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	prog, err := Parse(toks)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	_, _, warnings, err := CompileWithWarnings(prog)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "rounded to 2 cycles") {
+		t.Errorf("expected a rounding warning, got %v", warnings)
+	}
+}
+
+func TestDelayNeedsFosc(t *testing.T) {
+	if _, _, err := compileBody("section program\nfn main() begin delay 1 ms end"); err == nil {
+		t.Error("expected an error for a timed delay without fosc")
+	}
+}
@@ -15,6 +15,14 @@ const (
 	ErrInvalidNumber
 )
 
+// Severity distinguishes hard errors from diagnostics that only inform.
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
 type Position struct {
 	Line int
 	Col  int
@@ -30,12 +38,16 @@ type Range struct {
 }
 
 type Diagnostic struct {
-	Code    ErrorCode
-	Message string
-	Range   Range
+	Code     ErrorCode
+	Severity Severity
+	Message  string
+	Range    Range
 }
 
 func (d Diagnostic) Error() string {
+	if d.Severity == SeverityWarning {
+		return fmt.Sprintf("%s: warning: %s", d.Range.Start, d.Message)
+	}
 	return fmt.Sprintf("%s: %s", d.Range.Start, d.Message)
 }
 
@@ -54,5 +66,19 @@ func (l DiagnosticList) Error() string {
 }
 
 func (l DiagnosticList) HasErrors() bool {
-	return len(l) > 0
+	for _, d := range l {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// asDiagnostic returns err as a Diagnostic, placing it at rng if it is
+// a plain error.
+func asDiagnostic(err error, rng Range) Diagnostic {
+	if d, ok := err.(Diagnostic); ok {
+		return d
+	}
+	return Diagnostic{Code: ErrUnknown, Message: err.Error(), Range: rng}
 }
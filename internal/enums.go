@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// enumOf returns the enum that e belongs to: the enum of a member, or
+// the enum a variable or field was declared with, looking through
+// aliases. Untyped expressions return "".
+func (c *asmGen) enumOf(e Expr) string {
+	e, err := c.expand(e)
+	if err != nil {
+		return ""
+	}
+	switch e := e.(type) {
+	case IdentExpr:
+		if m, ok := c.prog.EnumMembers[e.Name]; ok {
+			return m.Enum
+		}
+		return c.prog.Variables[e.Name].Enum
+	case IndexExpr:
+		if field, ok := c.resolveField(e.Name, e.Index); ok {
+			return field.Enum
+		}
+	}
+	return ""
+}
+
+// checkEnums reports an error if a and b belong to different enums.
+// Either side may be untyped; plain i8 values mix with anything.
+func (c *asmGen) checkEnums(a, b Expr, rng Range) error {
+	ea, eb := c.enumOf(a), c.enumOf(b)
+	if ea == "" || eb == "" || ea == eb {
+		return nil
+	}
+	return Diagnostic{
+		Code:    ErrType,
+		Message: fmt.Sprintf("cannot mix %v (enum %s) with %v (enum %s)", a, ea, b, eb),
+		Range:   rng,
+	}
+}
+
+// checkEnumTypes reports variables and fields declared with an enum that
+// doesn't exist.
+func (c *asmGen) checkEnumTypes() DiagnosticList {
+	var diagnostics DiagnosticList
+	for _, v := range c.prog.Variables {
+		if v.Enum == "" {
+			continue
+		}
+		if _, ok := c.prog.Enums[v.Enum]; !ok {
+			diagnostics = append(diagnostics, Diagnostic{
+				Code:    ErrUndefinedSymbol,
+				Message: fmt.Sprintf("unknown type %s for variable %s", v.Enum, v.Name),
+				Range:   v.Range,
+			})
+		}
+	}
+	for name, sfr := range c.prog.SFRs {
+		for fieldName, field := range sfr.Fields {
+			if field.Enum == "" {
+				continue
+			}
+			if _, ok := c.prog.Enums[field.Enum]; !ok {
+				diagnostics = append(diagnostics, Diagnostic{
+					Code:    ErrUndefinedSymbol,
+					Message: fmt.Sprintf("unknown type %s for field %s of %s", field.Enum, fieldName, name),
+					Range:   sfr.Range,
+				})
+			}
+		}
+	}
+	return diagnostics
+}
+
+// checkCoverage reports the members of subject's enum that a case
+// without an else has no arm for. values are the arms' values.
+func (c *asmGen) checkCoverage(s CaseStmt, values map[int]string) error {
+	enum := c.enumOf(s.Subject)
+	if enum == "" || s.Else != nil {
+		return nil
+	}
+	var missing []string
+	for _, name := range c.prog.Enums[enum].Members {
+		if _, ok := values[c.prog.EnumMembers[name].Value&0xFF]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return Diagnostic{
+		Code:    ErrType,
+		Message: fmt.Sprintf("case on %v (enum %s) has no arm for %s; add them or an else", s.Subject, enum, strings.Join(missing, ", ")),
+		Range:   s.Range,
+	}
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEnum(t *testing.T) {
+	input := `
+section constants
+enum state [
+  idle
+  running
+  stopped: 10
+  failed
+]
+`
+	toks, err := Lex(input)
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	prog, err := Parse(toks)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	want := map[string]int{"idle": 0, "running": 1, "stopped": 10, "failed": 11}
+	for name, val := range want {
+		m, ok := prog.EnumMembers[name]
+		if !ok {
+			t.Errorf("member %s not found", name)
+			continue
+		}
+		if m.Enum != "state" || m.Value != val {
+			t.Errorf("member %s: expected state=%d, got %s=%d", name, val, m.Enum, m.Value)
+		}
+	}
+	if got := len(prog.Enums["state"].Members); got != 4 {
+		t.Errorf("expected 4 members, got %d", got)
+	}
+}
+
+func TestCompileEnums(t *testing.T) {
+	input := `
+section constants
+enum state [ idle running stopped ]
+section data
+common:
+  mode state
+  raw i8
+section program
+fn main() begin
+  mode = running
+  raw = stopped
+  if mode == idle then
+    mode = running
+  if mode != stopped then
+    w = raw
+  if raw == 0 then
+    return
+end
+`
+	ops, _, err := compileBody(input)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	expected := []string{
+		"main:",
+		"MOVLW 1",
+		"MOVWF 0x70",
+		"MOVLW 2",
+		"MOVWF 0x71",
+		"MOVF 0x70,1",
+		"BTFSS 0x3,2",
+		" GOTO _endif_1",
+		"MOVLW 1",
+		"MOVWF 0x70",
+		"_endif_1:",
+		"MOVF 0x70,0",
+		"XORLW 2",
+		"BTFSS 0x3,2",
+		"MOVF 0x71,0",
+		"MOVF 0x71,1",
+		"BTFSC 0x3,2",
+		"RETURN",
+	}
+
+	if len(ops) != len(expected) {
+		t.Fatalf("Expected %d ops, got %d", len(expected), len(ops))
+	}
+	for i, op := range ops {
+		if op.Assembly() != expected[i] {
+			t.Errorf("Op %d: expected %q, got %q", i, expected[i], op.Assembly())
+		}
+	}
+}
+
+func TestEnumMixing(t *testing.T) {
+	header := `
+section constants
+enum state [ idle running ]
+enum color [ red green ]
+section data
+common:
+  mode state
+  hue color
+section program
+fn main() begin
+`
+	bad := []string{
+		"mode = red",
+		"mode = hue",
+		"if mode == green then return",
+		"if hue != running then return",
+	}
+	for _, stmt := range bad {
+		_, _, err := compileBody(header + stmt + "\nend")
+		diags, ok := err.(DiagnosticList)
+		if !ok || len(diags) != 1 || diags[0].Code != ErrType {
+			t.Errorf("%q: expected one type error, got %v", stmt, err)
+		}
+	}
+}
+
+func TestEnumCoverage(t *testing.T) {
+	header := `
+section constants
+enum state [ idle running stopped ]
+enum clock [ fosc timer1 intosc ]
+enum color [ red green ]
+osccon: $99 [
+  spllen: 7
+  scs: 0..1 clock
+]
+clk: osccon[scs]
+sel: osccon
+section data
+common:
+  mode state
+section constants
+current: mode
+section program
+fn main() begin
+`
+	// Aliases are reported by what they stand for.
+	tests := []struct {
+		stmt string
+		msg  string
+	}{
+		{"case mode of idle: w = 1 running: w = 2 end", "case on mode (enum state) has no arm for stopped; add them or an else"},
+		{"case mode of idle: w = 1 end", "has no arm for running, stopped"},
+		{"case mode of idle: w = 1 else w = 2 end", ""},
+		{"case mode of idle: w = 1 running, stopped: w = 2 end", ""},
+		{"case current of idle: w = 1 end", "case on mode (enum state) has no arm for running, stopped"},
+		{"case osccon[scs] of fosc: w = 1 end", "case on osccon[scs] (enum clock) has no arm for timer1, intosc"},
+		{"case clk of fosc, timer1: w = 1 end", "case on osccon[scs] (enum clock) has no arm for intosc"},
+		{"case sel[scs] of fosc, timer1, intosc: w = 1 end", ""},
+		{"case clk of red: w = 1 else w = 2 end", "cannot mix osccon[scs] (enum clock) with red (enum color)"},
+		{"osccon[scs] = intosc", ""},
+		{"sel[scs] = timer1", ""},
+		{"clk = green", "cannot mix osccon[scs] (enum clock) with green (enum color)"},
+		{"current = red", "cannot mix mode (enum state) with red (enum color)"},
+		{"mode = osccon[scs]", "cannot mix mode (enum state) with osccon[scs] (enum clock)"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody(header + tt.stmt + "\nend\n")
+		if tt.msg == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error %v", tt.stmt, err)
+			}
+			continue
+		}
+		diags, ok := err.(DiagnosticList)
+		if !ok || len(diags) != 1 || diags[0].Code != ErrType || !strings.Contains(diags[0].Message, tt.msg) {
+			t.Errorf("%q: expected one type error containing %q, got %v", tt.stmt, tt.msg, err)
+		}
+	}
+}
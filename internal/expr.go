@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// Expressions are evaluated into W, which serves as the accumulator.
+// Each binary operator applies its simpler operand to W directly with
+// the literal (ADDLW) or file (ADDWF) form of the instruction, so
+// temporaries are only needed when both operands are compound. A spill
+// at nesting depth d uses _tmpd, leaving deeper levels free for the
+// other operand.
+
+// isArith reports whether op is a binary operator on i8 values.
+func isArith(op TTy) bool {
+	switch op {
+	case PLUS, MINUS, AMP, PIPE, CARET, SHL, SHR, STAR, SLASH, PERCENT:
+		return true
+	}
+	return false
+}
+
+// foldOp applies op to two constants.
+func foldOp(op TTy, a, b int) (int, bool) {
+	switch op {
+	case PLUS:
+		return a + b, true
+	case MINUS:
+		return a - b, true
+	case AMP:
+		return a & b, true
+	case PIPE:
+		return a | b, true
+	case CARET:
+		return a ^ b, true
+	case SHL:
+		if b >= 0 {
+			return a << b, true
+		}
+	case SHR:
+		if b >= 0 {
+			return a >> b, true
+		}
+	case STAR:
+		return a * b, true
+	case SLASH:
+		if b != 0 {
+			return a / b, true
+		}
+	case PERCENT:
+		if b != 0 {
+			return a % b, true
+		}
+	}
+	return 0, false
+}
+
+// compareOp applies the comparison op to two constants.
+func compareOp(op TTy, a, b int) bool {
+	switch op {
+	case LT:
+		return a < b
+	case GT:
+		return a > b
+	case LE:
+		return a <= b
+	case GE:
+		return a >= b
+	case EQEQ:
+		return a == b
+	}
+	return a != b
+}
+
+// countW returns how many times e reads W.
+func countW(e Expr) int {
+	switch e := e.(type) {
+	case IdentExpr:
+		if isW(e.Name) {
+			return 1
+		}
+	case UnaryExpr:
+		return countW(e.Expr)
+	case BinaryExpr:
+		return countW(e.Lhs) + countW(e.Rhs)
+	}
+	return 0
+}
+
+// replaceW returns e with every read of W replaced by a read of f.
+func replaceW(e Expr, f string) Expr {
+	switch e := e.(type) {
+	case IdentExpr:
+		if isW(e.Name) {
+			e.Name = f
+		}
+		return e
+	case UnaryExpr:
+		e.Expr = replaceW(e.Expr, f)
+		return e
+	case BinaryExpr:
+		e.Lhs = replaceW(e.Lhs, f)
+		e.Rhs = replaceW(e.Rhs, f)
+		return e
+	}
+	return e
+}
+
+// evalExpr emits code leaving the value of e in W.
+func (c *asmGen) evalExpr(e Expr) ([]PicOp, error) {
+	// W only survives until the first instruction that loads something
+	// else, which is fine for w op x but not in general. Otherwise,
+	// save it and read the copy instead.
+	var ops []PicOp
+	if _, simple, _ := c.operand(e); !simple && countW(e) > 0 {
+		bin, ok := e.(BinaryExpr)
+		if !ok || countW(e) > 1 || countW(bin.Lhs) != 1 || !isWExpr(bin.Lhs) {
+			tmp := c.temp("w")
+			ops = append(ops, Movwf{F: tmp})
+			e = replaceW(e, tmp)
+		}
+	}
+	evalOps, err := c.evalW(e, 0)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops, evalOps...), nil
+}
+
+func isWExpr(e Expr) bool {
+	name, ok := getIdent(e)
+	return ok && isW(name)
+}
+
+// evalW emits code leaving the value of e in W. Temporaries from depth
+// onwards are free for use.
+func (c *asmGen) evalW(e Expr, depth int) ([]PicOp, error) {
+	x, ok, err := c.operand(e)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		switch x.kind {
+		case literalOperand:
+			if err := checkByte(x.k, e); err != nil {
+				return nil, err
+			}
+			return []PicOp{Movlw{K: x.k}}, nil
+		case registerOperand:
+			return []PicOp{Movf{F: x.f, D: DestW}}, nil
+		default:
+			return nil, nil
+		}
+	}
+
+	if idx, ok := e.(IndexExpr); ok {
+		if a, ok := c.prog.Rom[idx.Name]; ok {
+			return c.romRead(a, idx, depth)
+		}
+		if field, ok := c.resolveField(idx.Name, idx.Index); ok {
+			f, err := c.register(idx.Name, idx.Range)
+			if err != nil {
+				return nil, err
+			}
+			return c.readField(f, field), nil
+		}
+	}
+
+	bin, ok := e.(BinaryExpr)
+	if !ok || !isArith(bin.Op) {
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("cannot evaluate %v", e),
+			Range:   e.Position(),
+		}
+	}
+	switch bin.Op {
+	case SHL, SHR:
+		return c.evalShift(bin, depth)
+	case STAR, SLASH, PERCENT:
+		return c.evalMulDiv(bin, depth)
+	}
+
+	rhs, ok, err := c.operand(bin.Rhs)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// a op x -> a into W, then apply x
+		ops, err := c.evalW(bin.Lhs, depth)
+		if err != nil {
+			return nil, err
+		}
+		applyOps, err := c.applyW(bin.Op, rhs, bin.Rhs, false)
+		if err != nil {
+			return nil, err
+		}
+		return append(ops, applyOps...), nil
+	}
+
+	lhs, ok, err := c.operand(bin.Lhs)
+	if err != nil {
+		return nil, err
+	}
+	if ok && lhs.kind != wOperand {
+		// x op b -> b into W, then apply x
+		ops, err := c.evalW(bin.Rhs, depth)
+		if err != nil {
+			return nil, err
+		}
+		applyOps, err := c.applyW(bin.Op, lhs, bin.Lhs, true)
+		if err != nil {
+			return nil, err
+		}
+		return append(ops, applyOps...), nil
+	}
+
+	// a op b -> a into a temporary, b into W, then apply the temporary
+	tmp := c.temp(fmt.Sprintf("tmp%d", depth))
+	ops, err := c.evalW(bin.Lhs, depth)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, Movwf{F: tmp})
+	rhsOps, err := c.evalW(bin.Rhs, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, rhsOps...)
+	applyOps, err := c.applyW(bin.Op, operand{kind: registerOperand, f: tmp}, bin.Lhs, true)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops, applyOps...), nil
+}
+
+// applyW combines W with the operand x, which was written as e. If
+// reversed, x is the left operand of op and W the right.
+func (c *asmGen) applyW(op TTy, x operand, e Expr, reversed bool) ([]PicOp, error) {
+	switch x.kind {
+	case literalOperand:
+		if err := checkByte(x.k, e); err != nil {
+			return nil, err
+		}
+		switch op {
+		case PLUS:
+			return []PicOp{Addlw{K: x.k}}, nil
+		case MINUS:
+			if reversed {
+				// k - W -> SUBLW k
+				return []PicOp{Sublw{K: x.k}}, nil
+			}
+			// W - k -> ADDLW -k
+			return []PicOp{Addlw{K: -x.k & 0xFF}}, nil
+		case AMP:
+			return []PicOp{Andlw{K: x.k}}, nil
+		case PIPE:
+			return []PicOp{Iorlw{K: x.k}}, nil
+		case CARET:
+			return []PicOp{Xorlw{K: x.k}}, nil
+		}
+	case registerOperand:
+		switch op {
+		case PLUS:
+			return []PicOp{Addwf{F: x.f, D: DestW}}, nil
+		case MINUS:
+			if reversed {
+				// f - W -> SUBWF f,0
+				return []PicOp{Subwf{F: x.f, D: DestW}}, nil
+			}
+			// W - f -> SUBWF f,0; SUBLW 0
+			return []PicOp{Subwf{F: x.f, D: DestW}, Sublw{K: 0}}, nil
+		case AMP:
+			return []PicOp{Andwf{F: x.f, D: DestW}}, nil
+		case PIPE:
+			return []PicOp{Iorwf{F: x.f, D: DestW}}, nil
+		case CARET:
+			return []PicOp{Xorwf{F: x.f, D: DestW}}, nil
+		}
+	}
+	return nil, Diagnostic{
+		Code:    ErrType,
+		Message: fmt.Sprintf("cannot apply %v to %v here", op, e),
+		Range:   e.Position(),
+	}
+}
+
+// evalShift emits code leaving a << n or a >> n in W. The shift amount
+// must be constant. Shifts by four or more start with SWAPF, and the rest
+// go through a temporary since W can't be shifted in place.
+func (c *asmGen) evalShift(bin BinaryExpr, depth int) ([]PicOp, error) {
+	n, ok := c.literal(bin.Rhs)
+	if !ok || n < 0 {
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("shift amount must be a non-negative constant, got %v", bin.Rhs),
+			Range:   bin.Rhs.Position(),
+		}
+	}
+	if n >= 8 {
+		return []PicOp{Movlw{K: 0}}, nil
+	}
+
+	shift := func(f string, d int) PicOp {
+		if bin.Op == SHL {
+			return Lslf{F: f, D: d}
+		}
+		return Lsrf{F: f, D: d}
+	}
+	tmp := c.temp(fmt.Sprintf("tmp%d", depth))
+
+	// src is where the value being shifted lives. Only a temporary can be
+	// shifted in place.
+	var ops []PicOp
+	src := tmp
+	if x, ok, err := c.operand(bin.Lhs); err != nil {
+		return nil, err
+	} else if ok && x.kind == registerOperand {
+		src = x.f
+	} else {
+		lhsOps, err := c.evalW(bin.Lhs, depth)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return lhsOps, nil
+		}
+		ops = append(lhsOps, Movwf{F: tmp})
+	}
+	if n == 0 {
+		return []PicOp{Movf{F: src, D: DestW}}, nil
+	}
+
+	if n >= 4 {
+		mask := 0xF0
+		if bin.Op == SHR {
+			mask = 0x0F
+		}
+		ops = append(ops, Swapf{F: src, D: DestW}, Andlw{K: mask})
+		n -= 4
+		if n == 0 {
+			return ops, nil
+		}
+		ops = append(ops, Movwf{F: tmp})
+		src = tmp
+	}
+	if src != tmp {
+		ops = append(ops, shift(src, DestW))
+		n--
+		if n == 0 {
+			return ops, nil
+		}
+		ops = append(ops, Movwf{F: tmp})
+		src = tmp
+	}
+	for range n - 1 {
+		ops = append(ops, shift(tmp, DestF))
+	}
+	return append(ops, shift(tmp, DestW)), nil
+}
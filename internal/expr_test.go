@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+// runArith runs straight-line ops on the given registers and returns W.
+// It only understands the instructions that expressions are built from.
+func runArith(t *testing.T, ops []PicOp, regs map[string]int, w int) int {
+	t.Helper()
+	store := func(f string, d, v int) {
+		v &= 0xFF
+		if d == DestW {
+			w = v
+		} else {
+			regs[f] = v
+		}
+	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case LabelOp, CommentOp:
+		case Movlw:
+			w = op.K & 0xFF
+		case Movf:
+			store(op.F, op.D, regs[op.F])
+		case Movwf:
+			regs[op.F] = w
+		case Addlw:
+			w = (w + op.K) & 0xFF
+		case Addwf:
+			store(op.F, op.D, regs[op.F]+w)
+		case Sublw:
+			w = (op.K - w) & 0xFF
+		case Subwf:
+			store(op.F, op.D, regs[op.F]-w)
+		case Andlw:
+			w &= op.K
+		case Andwf:
+			store(op.F, op.D, regs[op.F]&w)
+		case Iorlw:
+			w |= op.K
+		case Iorwf:
+			store(op.F, op.D, regs[op.F]|w)
+		case Xorlw:
+			w = (w ^ op.K) & 0xFF
+		case Xorwf:
+			store(op.F, op.D, regs[op.F]^w)
+		case Lslf:
+			store(op.F, op.D, regs[op.F]<<1)
+		case Lsrf:
+			store(op.F, op.D, regs[op.F]>>1)
+		case Swapf:
+			store(op.F, op.D, regs[op.F]>>4|regs[op.F]<<4)
+		case Incf:
+			store(op.F, op.D, regs[op.F]+1)
+		case Decf:
+			store(op.F, op.D, regs[op.F]-1)
+		default:
+			t.Fatalf("unexpected op in expression: %s", op.Assembly())
+		}
+	}
+	return w
+}
+
+func TestCompileExpressions(t *testing.T) {
+	const a, b, cc, w = 200, 57, 13, 91
+	tests := []struct {
+		stmt string
+		want int
+	}{
+		{"x = a + b", a + b},
+		{"x = a - b", a - b},
+		{"x = 5 - a", 5 - a},
+		{"x = a - 5", a - 5},
+		{"x = a - limit + limit", a},
+		{"x = (a + b) - (cc ^ b)", (a + b) - (cc ^ b)},
+		{"x = a << 3", a << 3},
+		{"x = a >> 5", a >> 5},
+		{"x = a >> 4", a >> 4},
+		{"x = a << 9", 0},
+		{"x = (a + 1) << 2", (a + 1) << 2},
+		{"x = (a | b) >> 6", (a | b) >> 6},
+		{"x = a & (b | cc)", a & (b | cc)},
+		{"x = a + b & cc", (a + b) & cc},
+		{"x = (a - b) - (b - cc)", (a - b) - (b - cc)},
+		{"x = ((a + b) + (cc + b)) + ((a - b) ^ (cc - a))", ((a + b) + (cc + b)) + ((a - b) ^ (cc - a))},
+		{"x = w + a", w + a},
+		{"x = a - w", a - w},
+		{"x = a - (b + w)", a - (b + w)},
+		{"x = w ^ (w << 1)", w ^ (w << 1)},
+		{"x = limit + 1 - a", 3 + 1 - a},
+		{"x = &x + 1", 0x75},
+		{"x += a + b", 77 + a + b},
+		{"x -= b", 77 - b},
+		{"x ^= w", 77 ^ w},
+		{"x |= 1", 77 | 1},
+		{"x += 1", 78},
+		{"x -= 1", 76},
+		{"w -= a\nx = w", w - a},
+		{"w -= 1\nx = w", w - 1},
+		{"w += w\nx = w", w + w},
+	}
+	for _, tt := range tests {
+		input := fmt.Sprintf(`
+section constants
+limit: 3
+section data
+common:
+  a i8
+  b i8
+  cc i8
+  unused i8
+  x i8
+section program
+fn main() begin
+  %s
+end
+`, tt.stmt)
+		ops, _, err := compileBody(input)
+		if err != nil {
+			t.Errorf("Compile(%q) failed: %v", tt.stmt, err)
+			continue
+		}
+
+		regs := map[string]int{"0x70": a, "0x71": b, "0x72": cc, "0x74": 77}
+		runArith(t, ops, regs, w)
+		if got := regs["0x74"]; got != tt.want&0xFF {
+			t.Errorf("%q: expected x = %d, got %d", tt.stmt, tt.want&0xFF, got)
+		}
+	}
+}
+
+func TestCompileExpressionTemps(t *testing.T) {
+	input := `
+section data
+common:
+  a i8
+  b i8
+  x i8
+section program
+fn main() begin
+  x = a + b
+  x = 7 - (a + b)
+  x = (a + b) ^ (a - b)
+  if a + b == 3 then
+    return
+end
+`
+	ops, _, err := compileBody(input)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	// Only the third statement needs a temporary.
+	expected := []string{
+		"main:",
+		"MOVF 0x70,0",
+		"ADDWF 0x71,0",
+		"MOVWF 0x72",
+		"MOVF 0x70,0",
+		"ADDWF 0x71,0",
+		"SUBLW 7",
+		"MOVWF 0x72",
+		"MOVF 0x70,0",
+		"ADDWF 0x71,0",
+		"MOVWF _tmp0",
+		"MOVF 0x70,0",
+		"SUBWF 0x71,0",
+		"SUBLW 0",
+		"XORWF _tmp0,0",
+		"MOVWF 0x72",
+		"MOVF 0x70,0",
+		"ADDWF 0x71,0",
+		"XORLW 3",
+		"BTFSC 0x3,2",
+		"RETURN",
+	}
+
+	if len(ops) != len(expected) {
+		t.Fatalf("Expected %d ops, got %d", len(expected), len(ops))
+	}
+	for i, op := range ops {
+		if op.Assembly() != expected[i] {
+			t.Errorf("Op %d: expected %q, got %q", i, expected[i], op.Assembly())
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// resolveField looks up a multi-bit field declared in the SFR name.
+func (c *asmGen) resolveField(name string, idx Expr) (BitField, bool) {
+	id, ok := idx.(IdentExpr)
+	if !ok {
+		return BitField{}, false
+	}
+	field, ok := c.prog.SFRs[name].Fields[id.Name]
+	return field, ok
+}
+
+// writeField stores rhs into field of register f, leaving the other bits
+// of f untouched. W is clobbered unless the field is written bit by bit.
+func (c *asmGen) writeField(f string, field BitField, rhs Expr) ([]PicOp, error) {
+	mask := field.Mask()
+
+	src, ok, err := c.operand(rhs)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("cannot assign %v to a field", rhs),
+			Range:   rhs.Position(),
+		}
+	}
+
+	if src.kind == literalOperand {
+		val := src.k
+		width := field.Hi - field.Lo + 1
+		if val < 0 || val >= 1<<width {
+			return nil, Diagnostic{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("value %d does not fit in a %d-bit field", val, width),
+				Range:   rhs.Position(),
+			}
+		}
+		bits := val << field.Lo
+
+		// Read, mask, merge and write back...
+		rmw := []PicOp{Movf{F: f, D: DestW}}
+		if bits != mask {
+			rmw = append(rmw, Andlw{K: ^mask & 0xFF})
+		}
+		if bits != 0 {
+			rmw = append(rmw, Iorlw{K: bits})
+		}
+		rmw = append(rmw, Movwf{F: f})
+
+		// ...unless setting and clearing each bit is shorter.
+		if width >= len(rmw) {
+			return rmw, nil
+		}
+		var ops []PicOp
+		for b := field.Lo; b <= field.Hi; b++ {
+			if bits&(1<<b) != 0 {
+				ops = append(ops, Bsf{F: f, B: b})
+			} else {
+				ops = append(ops, Bcf{F: f, B: b})
+			}
+		}
+		return ops, nil
+	}
+
+	// Shift the value into place in a temporary, then merge it with
+	// the bits of f outside the field.
+	tmp := c.temp("field")
+	var ops []PicOp
+	if src.kind == registerOperand {
+		ops = append(ops, Movf{F: src.f, D: DestW})
+	}
+	ops = append(ops, Movwf{F: tmp})
+	shift := field.Lo
+	if shift >= 4 {
+		// Bits swapped in from the high nibble land below the field
+		// and are masked off below.
+		ops = append(ops, Swapf{F: tmp, D: DestF})
+		shift -= 4
+	}
+	for range shift {
+		ops = append(ops, Lslf{F: tmp, D: DestF})
+	}
+	ops = append(ops,
+		Movlw{K: mask},
+		Andwf{F: tmp, D: DestF},
+		Movf{F: f, D: DestW},
+		Andlw{K: ^mask & 0xFF},
+		Iorwf{F: tmp, D: DestW},
+		Movwf{F: f},
+	)
+	return ops, nil
+}
+
+// readField loads field of register f into W, shifted down to bit 0.
+func (c *asmGen) readField(f string, field BitField) []PicOp {
+	var ops []PicOp
+	shift := field.Lo
+	switch {
+	case shift == 0:
+		ops = append(ops, Movf{F: f, D: DestW})
+	case shift >= 4:
+		ops = append(ops, Swapf{F: f, D: DestW})
+		shift -= 4
+	default:
+		ops = append(ops, Lsrf{F: f, D: DestW})
+		shift--
+	}
+
+	// W can't be shifted in place, so go through a temporary.
+	if shift > 0 {
+		tmp := c.temp("field")
+		ops = append(ops, Movwf{F: tmp})
+		for range shift - 1 {
+			ops = append(ops, Lsrf{F: tmp, D: DestF})
+		}
+		ops = append(ops, Lsrf{F: tmp, D: DestW})
+	}
+
+	// LSRF shifts in zeros, so a field that runs to bit 7 needs no
+	// masking unless SWAPF brought the low nibble up.
+	if field.Hi < 7 || field.Lo >= 4 {
+		ops = append(ops, Andlw{K: field.Mask() >> field.Lo})
+	}
+	return ops
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestCompileFields(t *testing.T) {
+	input := `
+section constants
+option-reg: $95 [
+  ps: 0..2
+  psa: 3
+]
+osccon: $99 [
+  ircf: 3..6
+  scs: 0..1
+]
+section data
+common:
+  speed i8
+section program
+fn main() begin
+  option-reg[ps] = 5
+  osccon[ircf] = 9
+  osccon[scs] = 2
+  w = osccon[ircf]
+  speed = osccon[scs]
+  osccon[ircf] = speed
+end
+`
+	tokens, err := Lex(input)
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+
+	prog, err := Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if f := prog.SFRs["osccon"].Fields["ircf"]; f.Lo != 3 || f.Hi != 6 {
+		t.Errorf("expected ircf to be 3..6, got %d..%d", f.Lo, f.Hi)
+	}
+
+	ops, _, err := compileBody(input)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	expected := []string{
+		"main:",
+		// option-reg[ps] = 5: three bit ops beat read-modify-write
+		"BSF 0x95,0",
+		"BCF 0x95,1",
+		"BSF 0x95,2",
+		// osccon[ircf] = 9: read-modify-write ties four bit ops
+		// and writes the register only once
+		"MOVF 0x99,0",
+		"ANDLW 135",
+		"IORLW 72",
+		"MOVWF 0x99",
+		// osccon[scs] = 2: two bit ops beat read-modify-write
+		"BCF 0x99,0",
+		"BSF 0x99,1",
+		// w = osccon[ircf]
+		"LSRF 0x99,0",
+		"MOVWF _field",
+		"LSRF _field,1",
+		"LSRF _field,0",
+		"ANDLW 15",
+		// speed = osccon[scs]
+		"MOVF 0x99,0",
+		"ANDLW 3",
+		"MOVWF 0x70",
+		// osccon[ircf] = speed
+		"MOVF 0x70,0",
+		"MOVWF _field",
+		"LSLF _field,1",
+		"LSLF _field,1",
+		"LSLF _field,1",
+		"MOVLW 120",
+		"ANDWF _field,1",
+		"MOVF 0x99,0",
+		"ANDLW 135",
+		"IORWF _field,0",
+		"MOVWF 0x99",
+	}
+
+	if len(ops) != len(expected) {
+		t.Fatalf("Expected %d ops, got %d", len(expected), len(ops))
+	}
+
+	for i, op := range ops {
+		if op.Assembly() != expected[i] {
+			t.Errorf("Op %d: expected %q, got %q", i, expected[i], op.Assembly())
+		}
+	}
+}
+
+func TestFieldValueOutOfRange(t *testing.T) {
+	input := `
+section constants
+option-reg: $95 [
+  ps: 0..2
+]
+section program
+fn main() begin
+  option-reg[ps] = 8
+end
+`
+	if _, _, err := compileBody(input); err == nil {
+		t.Error("expected an error for a value that doesn't fit the field")
+	}
+}
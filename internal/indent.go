@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"strings"
+)
+
+// A file whose first line of code is preceded by the comment
+//
+//	// piccolo: indent
+//
+// may write the blocks of its program section by indentation instead of
+// begin and end. A line indented further than the one before it opens a
+// block, emitted as INDENT, and each enclosing level it returns to
+// closes one, emitted as DEDENT. Lines inside brackets continue the line
+// they started on. Begin and end still work in such a file, so it can be
+// converted a function at a time.
+
+const indentPragma = "piccolo: indent"
+
+// indentMode reports whether text asks for indented blocks.
+func indentMode(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		comment, ok := strings.CutPrefix(line, "//")
+		if !ok {
+			return false
+		}
+		if strings.TrimSpace(comment) == indentPragma {
+			return true
+		}
+	}
+	return false
+}
+
+// indentTokens inserts INDENT and DEDENT tokens into the program
+// sections of toks.
+func indentTokens(text string, toks []Tok) ([]Tok, DiagnosticList) {
+	lines := strings.Split(text, "\n")
+	var result []Tok
+	var diagnostics DiagnosticList
+
+	levels := []string{""}
+	closeTo := func(n int, at Position) {
+		for len(levels) > n {
+			levels = levels[:len(levels)-1]
+			result = append(result, Tok{ty: DEDENT, Range: Range{Start: at, End: at}})
+		}
+	}
+
+	program, depth, line := false, 0, 0
+	for i, tok := range toks {
+		start := tok.Range.Start
+		if tok.ty == EOF || tok.ty == SECTION {
+			closeTo(1, start)
+			program = tok.ty == SECTION && i+1 < len(toks) && toks[i+1].ty == PROGRAM
+			depth = 0
+		} else if program && depth == 0 && start.Line != line && start.Line <= len(lines) {
+			l := lines[start.Line-1]
+			indent := l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+			n := len(levels)
+			for n > 1 && indent != levels[n-1] && strings.HasPrefix(levels[n-1], indent) {
+				n--
+			}
+			dedented := n < len(levels)
+			closeTo(n, start)
+			switch top := levels[n-1]; {
+			case indent == top:
+			case !dedented && strings.HasPrefix(indent, top):
+				levels = append(levels, indent)
+				result = append(result, Tok{ty: INDENT, Range: Range{Start: start, End: start}})
+			default:
+				diagnostics = append(diagnostics, Diagnostic{
+					Code:    ErrSyntax,
+					Message: "inconsistent indentation: this line lines up with no enclosing block",
+					Range:   tok.Range,
+				})
+			}
+		}
+		switch tok.ty {
+		case LBRACK, LPAREN:
+			depth++
+		case RBRACK, RPAREN:
+			depth = max(depth-1, 0)
+		}
+		line = tok.Range.End.Line
+		result = append(result, tok)
+	}
+	return result, diagnostics
+}
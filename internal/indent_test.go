@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+const indentHeader = `// A program laid out by indentation.
+// piccolo: indent
+section constants
+debug: 1
+section data
+common:
+  x i8
+  y i8
+section program
+`
+
+// indented and withEnds are the same program.
+const indented = `
+when debug
+  fn trace()
+    x = $FF
+    return
+fn main()
+  if x == 1 then
+    y = 2
+    x = (y +
+      1)
+  case x of
+    0: y = 1
+    1, 2:
+      y = 2
+      x = 0
+    else
+      y = 3
+  end
+  case y of
+    0: x = 1
+  else
+    x = 2
+  end
+  atomic
+    x = 1
+  when not debug
+    y = 9
+  if y == 2 then begin
+    x = 5
+  end
+  return
+at $4
+  x = 0
+`
+
+const withEnds = `
+when debug begin
+  fn trace() begin
+    x = $FF
+    return
+  end
+end
+fn main() begin
+  if x == 1 then begin
+    y = 2
+    x = (y +
+      1)
+  end
+  case x of
+    0: y = 1
+    1, 2: begin
+      y = 2
+      x = 0
+    end
+    else
+      y = 3
+  end
+  case y of
+    0: x = 1
+  else
+    x = 2
+  end
+  atomic begin
+    x = 1
+  end
+  when not debug begin
+    y = 9
+  end
+  if y == 2 then begin
+    x = 5
+  end
+  return
+end
+at $4 begin
+  x = 0
+end
+`
+
+func TestIndent(t *testing.T) {
+	ops, _, err := compileBody(indentHeader + indented)
+	if err != nil {
+		t.Fatalf("indented: %v", err)
+	}
+	want, _, err := compileBody(indentHeader + withEnds)
+	if err != nil {
+		t.Fatalf("with ends: %v", err)
+	}
+	var got, expected []string
+	for _, op := range ops {
+		got = append(got, op.Assembly())
+	}
+	for _, op := range want {
+		expected = append(expected, op.Assembly())
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+	if !slices.Contains(got, "trace:") {
+		t.Errorf("expected the when block to keep trace:\n%s", strings.Join(got, "\n"))
+	}
+
+	// Without the pragma, indentation means nothing.
+	if _, _, err := compileBody(strings.Replace(indentHeader, indentPragma, "", 1) + withEnds); err != nil {
+		t.Errorf("with ends, no pragma: %v", err)
+	}
+	if _, _, err := compileBody(strings.Replace(indentHeader, indentPragma, "", 1) + indented); err == nil {
+		t.Errorf("indented, no pragma: expected an error")
+	}
+}
+
+func TestIndentTokens(t *testing.T) {
+	toks, err := Lex("// piccolo: indent\nsection data\ncommon:\n  x i8\nsection program\nfn f()\n  x = [\n1]\n  if x then\n    return\nsection constants\n")
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	var got []string
+	for _, tok := range toks {
+		got = append(got, tok.ty.String())
+	}
+	want := "SECTION DATA COMMON COLON IDENT I8 SECTION PROGRAM FN IDENT LPAREN RPAREN " +
+		"INDENT IDENT EQL LBRACK NUMDECIMAL RBRACK IF IDENT THEN INDENT RETURN DEDENT DEDENT SECTION CONSTANTS EOF"
+	if strings.Join(got, " ") != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, strings.Join(got, " "))
+	}
+}
+
+func TestIndentErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		msg   string
+	}{
+		{"fn main()\n    x = 1\n  y = 1\n", "inconsistent indentation"},
+		{"fn main()\n  x = 1\n\ty = 1\n", "inconsistent indentation"},
+		{"fn main()\nx = 1\n", "who starts a function with"},
+		{"fn main() begin\n  x = 1\n", "alas, functions must come to an END"},
+		{"fn main()\n  case x of\n    0: y = 1\n  x = 1\n", "expected end after case"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody(indentHeader + tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.msg, err)
+		}
+	}
+}
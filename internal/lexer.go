@@ -19,16 +19,31 @@ const (
 	EOF
 
 	// Operators
-	EQL    // =
-	NEQ    // !=
-	INC    // ++
-	DEC    // --
-	ANDEQL // &=
-	OREQL  // |=
-	XOREQL // ^=
-	ADDEQL // +=
-	SUBEQL // -=
-	MINUS  // -
+	EQL     // =
+	EQEQ    // ==
+	NEQ     // !=
+	INC     // ++
+	DEC     // --
+	ANDEQL  // &=
+	OREQL   // |=
+	XOREQL  // ^=
+	ADDEQL  // +=
+	SUBEQL  // -=
+	MINUS   // -
+	PLUS    // +
+	STAR    // *
+	SLASH   // /
+	PERCENT // %
+	AMP     // &
+	PIPE    // |
+	CARET   // ^
+	SHL     // <<
+	SHR     // >>
+	LT      // <
+	GT      // >
+	LE      // <=
+	GE      // >=
+	HASH    // #
 
 	// Punctuation
 	LBRACK // [
@@ -36,6 +51,12 @@ const (
 	LPAREN // (
 	RPAREN // )
 	COLON  // :
+	COMMA  // ,
+	DOTDOT // ..
+
+	// Indentation, in files that ask for it
+	INDENT
+	DEDENT
 
 	// Keywords
 	FN
@@ -45,6 +66,8 @@ const (
 	IF
 	THEN
 	NOT
+	AND
+	OR
 	SECTION
 	CONSTANTS
 	DATA
@@ -53,15 +76,37 @@ const (
 	BANKED
 	COMMON
 	I8
+	I16
 	AT
+	DELAY
+	ENUM
+	CASE
+	OF
+	ELSE
+	TABLE
+	OVERLAY
+	WHEN
+	ATOMIC
+	ROM
+	PACKED
+	TASK
+	YIELD
+	WAIT
+	UNTIL
+	ASSERT
+	BUDGET
+	WITHIN
+	EXACTLY
 
 	// Names and literals
 	IDENT
+	STRING
 
 	NUM_First
 	NUMDECIMAL
 	NUMHEX
 	NUMBINARY
+	NUMUNIT // a decimal with a unit, such as 1ms
 	NUM_Last
 )
 
@@ -75,7 +120,7 @@ func (tok *Tok) Number() (int, error) {
 	// Remove underscores
 	clean := strings.ReplaceAll(tok.val, "_", "")
 
-	var base int
+	var base, scale int = 0, 1
 	switch tok.ty {
 	case NUMHEX:
 		base = 16
@@ -83,6 +128,10 @@ func (tok *Tok) Number() (int, error) {
 		base = 2
 	case NUMDECIMAL:
 		base = 10
+	case NUMUNIT:
+		var suffix string
+		clean, suffix = splitUnit(clean)
+		base, scale = 10, unitSuffixes[suffix].scale
 	default:
 		return 0, fmt.Errorf("invalid number type: %v", tok.ty)
 	}
@@ -91,7 +140,7 @@ func (tok *Tok) Number() (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return int(val), nil
+	return int(val) * scale, nil
 }
 
 var keywords = map[string]TTy{
@@ -102,6 +151,8 @@ var keywords = map[string]TTy{
 	"if":            IF,
 	"then":          THEN,
 	"not":           NOT,
+	"and":           AND,
+	"or":            OR,
 	"section":       SECTION,
 	"constants":     CONSTANTS,
 	"data":          DATA,
@@ -110,7 +161,27 @@ var keywords = map[string]TTy{
 	"banked":        BANKED,
 	"common":        COMMON,
 	"i8":            I8,
+	"i16":           I16,
 	"at":            AT,
+	"delay":         DELAY,
+	"enum":          ENUM,
+	"case":          CASE,
+	"of":            OF,
+	"else":          ELSE,
+	"table":         TABLE,
+	"overlay":       OVERLAY,
+	"when":          WHEN,
+	"atomic":        ATOMIC,
+	"rom":           ROM,
+	"packed":        PACKED,
+	"task":          TASK,
+	"yield":         YIELD,
+	"wait":          WAIT,
+	"until":         UNTIL,
+	"assert":        ASSERT,
+	"budget":        BUDGET,
+	"within":        WITHIN,
+	"exactly":       EXACTLY,
 }
 
 func Lex(text string) ([]Tok, error) {
@@ -141,12 +212,27 @@ func Lex(text string) ([]Tok, error) {
 			result = append(result, l.finishTokVal(NUMHEX, l.scanHex()))
 			continue
 		case '%':
+			// % followed by a binary digit starts a number; otherwise
+			// it's the modulo operator.
+			if l.peekNext() != '0' && l.peekNext() != '1' {
+				l.advance()
+				result = append(result, l.finishTok(PERCENT))
+				continue
+			}
 			result = append(result, l.finishTokVal(NUMBINARY, l.scanBinary()))
 			continue
 		case '=':
 			l.advance()
 			result = append(result, l.finishTok(EQL))
 			continue
+		case '<':
+			l.advance()
+			result = append(result, l.finishTok(LT))
+			continue
+		case '>':
+			l.advance()
+			result = append(result, l.finishTok(GT))
+			continue
 		case '[':
 			l.advance()
 			result = append(result, l.finishTok(LBRACK))
@@ -167,14 +253,74 @@ func Lex(text string) ([]Tok, error) {
 			l.advance()
 			result = append(result, l.finishTok(COLON))
 			continue
+		case ',':
+			l.advance()
+			result = append(result, l.finishTok(COMMA))
+			continue
 		case '-':
 			l.advance()
 			result = append(result, l.finishTok(MINUS))
 			continue
+		case '+':
+			l.advance()
+			result = append(result, l.finishTok(PLUS))
+			continue
+		case '*':
+			l.advance()
+			result = append(result, l.finishTok(STAR))
+			continue
+		case '/':
+			l.advance()
+			result = append(result, l.finishTok(SLASH))
+			continue
+		case '&':
+			l.advance()
+			result = append(result, l.finishTok(AMP))
+			continue
+		case '|':
+			l.advance()
+			result = append(result, l.finishTok(PIPE))
+			continue
+		case '^':
+			l.advance()
+			result = append(result, l.finishTok(CARET))
+			continue
+		case '#':
+			l.advance()
+			result = append(result, l.finishTok(HASH))
+			continue
+		case '"':
+			str, err := l.scanString()
+			if err != nil {
+				diagnostics = append(diagnostics, Diagnostic{
+					Code:    ErrSyntax,
+					Message: err.Error(),
+					Range:   l.currentRange(),
+				})
+			}
+			result = append(result, l.finishTokVal(STRING, str))
+			continue
 		}
 
 		if unicode.IsDigit(l.peek()) {
-			result = append(result, l.finishTokVal(NUMDECIMAL, l.scanDecimal()))
+			num := l.scanDecimal()
+			if !isIdentStart(l.peek()) {
+				result = append(result, l.finishTokVal(NUMDECIMAL, num))
+				continue
+			}
+			var sb strings.Builder
+			for unicode.IsLetter(l.peek()) {
+				sb.WriteRune(l.advance())
+			}
+			unit := sb.String()
+			if _, ok := unitSuffixes[unit]; !ok {
+				diagnostics = append(diagnostics, Diagnostic{
+					Code:    ErrSyntax,
+					Message: fmt.Sprintf("unknown unit %q; expected cycles, s, ms, us, ns, Hz, kHz, MHz or baud", unit),
+					Range:   l.currentRange(),
+				})
+			}
+			result = append(result, l.finishTokVal(NUMUNIT, num+unit))
 			continue
 		}
 
@@ -200,6 +346,12 @@ func Lex(text string) ([]Tok, error) {
 	l.startTok()
 	result = append(result, l.finishTok(EOF))
 
+	if indentMode(text) {
+		var errs DiagnosticList
+		result, errs = indentTokens(text, result)
+		diagnostics = append(diagnostics, errs...)
+	}
+
 	if len(diagnostics) > 0 {
 		return result, diagnostics
 	}
@@ -312,6 +464,10 @@ func (l *lexer) scanIdent() string {
 
 func (l *lexer) tryTwoCharOp() (TTy, bool) {
 	switch {
+	case l.peek() == '=' && l.peekNext() == '=':
+		l.advance()
+		l.advance()
+		return EQEQ, true
 	case l.peek() == '!' && l.peekNext() == '=':
 		l.advance()
 		l.advance()
@@ -344,6 +500,26 @@ func (l *lexer) tryTwoCharOp() (TTy, bool) {
 		l.advance()
 		l.advance()
 		return SUBEQL, true
+	case l.peek() == '<' && l.peekNext() == '<':
+		l.advance()
+		l.advance()
+		return SHL, true
+	case l.peek() == '>' && l.peekNext() == '>':
+		l.advance()
+		l.advance()
+		return SHR, true
+	case l.peek() == '<' && l.peekNext() == '=':
+		l.advance()
+		l.advance()
+		return LE, true
+	case l.peek() == '>' && l.peekNext() == '=':
+		l.advance()
+		l.advance()
+		return GE, true
+	case l.peek() == '.' && l.peekNext() == '.':
+		l.advance()
+		l.advance()
+		return DOTDOT, true
 	default:
 		return UNKNOWN, false
 	}
@@ -367,6 +543,35 @@ func (l *lexer) scanBinary() string {
 	return sb.String()
 }
 
+var stringEscapes = map[rune]rune{'"': '"', '\\': '\\', 'n': '\n', 'r': '\r', 't': '\t', '0': 0}
+
+// scanString scans a string literal and returns what it holds. The
+// escapes are \", \\, \n, \r, \t and \0.
+func (l *lexer) scanString() (string, error) {
+	var sb strings.Builder
+	l.advance() // "
+	for {
+		r := l.peek()
+		switch r {
+		case 0, '\n':
+			return sb.String(), fmt.Errorf("unterminated string")
+		case '"':
+			l.advance()
+			return sb.String(), nil
+		case '\\':
+			l.advance()
+			esc, ok := stringEscapes[l.peek()]
+			if !ok {
+				return sb.String(), fmt.Errorf("unknown escape \\%c in string", l.peek())
+			}
+			l.advance()
+			sb.WriteRune(esc)
+		default:
+			sb.WriteRune(l.advance())
+		}
+	}
+}
+
 func (l *lexer) scanDecimal() string {
 	var sb strings.Builder
 	for unicode.IsDigit(l.peek()) || l.peek() == '_' {
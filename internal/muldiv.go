@@ -0,0 +1,522 @@
+package internal
+
+import (
+	"fmt"
+	"math/bits"
+	"slices"
+	"strconv"
+)
+
+// The PIC16 has no multiply or divide instructions. Multiplying by a
+// constant becomes a run of shifts and adds, and dividing by a power of
+// two a shift. Everything else calls one of the helper routines below,
+// which are emitted once, after the program's own functions, into
+// programs that use them. Each call is annotated with the routine's
+// worst-case cycle count. The helpers share their argument and result
+// temporaries, since common RAM is scarce.
+//
+// Dividing by zero gives all ones for the quotient and the dividend for
+// the remainder.
+
+// helper is a runtime routine called by generated code.
+type helper struct {
+	cycles int // worst case, including the CALL
+	ops    func(c *asmGen) []PicOp
+}
+
+var helpers = map[string]helper{
+	"_mul8":   {cycles: 73, ops: (*asmGen).mul8Ops},
+	"_div8":   {cycles: 111, ops: (*asmGen).div8Ops},
+	"_mul16":  {cycles: 215, ops: (*asmGen).mul16Ops},
+	"_div16":  {cycles: 327, ops: (*asmGen).div16Ops},
+	"_unpack": {cycles: 13, ops: (*asmGen).unpackOps},
+}
+
+// callHelper returns code calling the named helper and records that the
+// program needs it.
+func (c *asmGen) callHelper(name string) []PicOp {
+	if !slices.Contains(c.helpers, name) {
+		c.helpers = append(c.helpers, name)
+	}
+	return []PicOp{
+		CommentOp{Text: fmt.Sprintf("%s takes at most %d cycles", name, helpers[name].cycles)},
+		CallOp{Label: name},
+	}
+}
+
+// helperOps returns the code of every helper the program called.
+func (c *asmGen) helperOps() []PicOp {
+	var ops []PicOp
+	for _, name := range c.helpers {
+		ops = append(ops, LabelOp{Name: name})
+		ops = append(ops, helpers[name].ops(c)...)
+	}
+	return ops
+}
+
+// log2 returns n if k is 1 << n.
+func log2(k int) (int, bool) {
+	if k <= 0 || k&(k-1) != 0 {
+		return 0, false
+	}
+	return bits.TrailingZeros(uint(k)), true
+}
+
+func numExpr(k int, rng Range) NumExpr {
+	return NumExpr{Val: strconv.Itoa(k), Value: k, Ty: NUMDECIMAL, Range: rng}
+}
+
+// evalMulDiv emits code leaving a * b, a / b or a % b in W.
+func (c *asmGen) evalMulDiv(bin BinaryExpr, depth int) ([]PicOp, error) {
+	if bin.Op == STAR {
+		if k, ok := c.literal(bin.Rhs); ok {
+			return c.mulConst(bin.Lhs, k, depth)
+		}
+		if k, ok := c.literal(bin.Lhs); ok {
+			return c.mulConst(bin.Rhs, k, depth)
+		}
+	} else if k, ok := c.literal(bin.Rhs); ok {
+		if err := checkByte(k, bin.Rhs); err != nil {
+			return nil, err
+		}
+		k &= 0xFF
+		if k == 0 {
+			return nil, Diagnostic{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("division by zero in %v", bin),
+				Range:   bin.Rhs.Position(),
+			}
+		}
+		if n, ok := log2(k); ok {
+			if bin.Op == SLASH {
+				// a / 2^n -> a >> n
+				return c.evalShift(BinaryExpr{Lhs: bin.Lhs, Op: SHR, Rhs: numExpr(n, bin.Rhs.Position()), Range: bin.Range}, depth)
+			}
+			// a % 2^n -> a & (2^n - 1)
+			ops, err := c.evalW(bin.Lhs, depth)
+			if err != nil {
+				return nil, err
+			}
+			return append(ops, Andlw{K: k - 1}), nil
+		}
+	}
+
+	// Load the operands into the helper's arguments. If b is compound, a
+	// waits in a temporary while b is evaluated.
+	a, b := c.temp("arga"), c.temp("argb")
+	name := "_mul8"
+	if bin.Op != STAR {
+		name = "_div8"
+	}
+	ops, err := c.evalW(bin.Lhs, depth)
+	if err != nil {
+		return nil, err
+	}
+	if _, simple, _ := c.operand(bin.Rhs); simple {
+		rhsOps, err := c.evalW(bin.Rhs, depth)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, Movwf{F: a})
+		ops = append(ops, rhsOps...)
+		ops = append(ops, Movwf{F: b})
+	} else {
+		tmp := c.temp(fmt.Sprintf("tmp%d", depth))
+		rhsOps, err := c.evalW(bin.Rhs, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, Movwf{F: tmp})
+		ops = append(ops, rhsOps...)
+		ops = append(ops, Movwf{F: b}, Movf{F: tmp, D: DestW}, Movwf{F: a})
+	}
+	ops = append(ops, c.callHelper(name)...)
+	if bin.Op == PERCENT {
+		ops = append(ops, Movf{F: c.temp("res"), D: DestW})
+	}
+	return ops, nil
+}
+
+// mulConst emits code leaving x * k in W, adding up shifted copies of x
+// for each bit set in k.
+func (c *asmGen) mulConst(x Expr, k, depth int) ([]PicOp, error) {
+	k &= 0xFF
+	if k == 0 {
+		return []PicOp{Movlw{K: 0}}, nil
+	}
+	if n, ok := log2(k); ok {
+		return c.evalShift(BinaryExpr{Lhs: x, Op: SHL, Rhs: numExpr(n, x.Position()), Range: x.Position()}, depth)
+	}
+
+	tmp := c.temp(fmt.Sprintf("tmp%d", depth))
+	ops, err := c.evalW(x, depth)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, Movwf{F: tmp})
+	first := true
+	for i := 0; k>>i != 0; i++ {
+		if k&(1<<i) != 0 {
+			switch {
+			case first && i == 0:
+				// W already holds x.
+			case first:
+				ops = append(ops, Movf{F: tmp, D: DestW})
+			default:
+				ops = append(ops, Addwf{F: tmp, D: DestW})
+			}
+			first = false
+		}
+		if k>>(i+1) != 0 {
+			ops = append(ops, Lslf{F: tmp, D: DestF})
+		}
+	}
+	return ops, nil
+}
+
+// word is an operand of 16-bit code. An i8 register has no high byte
+// and is zero-extended.
+type word struct {
+	kind   operandKind
+	k      int
+	lo, hi string
+}
+
+// wordOperand classifies e for 16-bit code.
+func (c *asmGen) wordOperand(e Expr) (word, bool, error) {
+	if id, ok := e.(IdentExpr); ok {
+		if v, ok := c.prog.Variables[id.Name]; ok && v.Type == "i16" {
+			return word{kind: registerOperand, lo: hexAddr(v.Address), hi: hexAddr(v.Address + 1)}, true, nil
+		}
+	}
+	if k, ok := c.literal(e); ok {
+		if k < -0x8000 || k > 0xFFFF {
+			return word{}, false, Diagnostic{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("%v = %d does not fit in 16 bits", e, k),
+				Range:   e.Position(),
+			}
+		}
+		return word{kind: literalOperand, k: k & 0xFFFF}, true, nil
+	}
+	if _, ok := e.(BinaryExpr); ok {
+		// Only constant expressions are simple; operand would reject
+		// the i16 operands of the others.
+		return word{}, false, nil
+	}
+	x, ok, err := c.operand(e)
+	if err != nil || !ok {
+		return word{}, ok, err
+	}
+	return word{kind: x.kind, lo: x.f}, true, nil
+}
+
+// narrow reports whether x fits in a byte.
+func (x word) narrow() bool {
+	if x.kind == literalOperand {
+		return x.k <= 0xFF
+	}
+	return x.hi == ""
+}
+
+// loadWord copies x into the register pair lo, hi.
+func loadWord(x word, lo, hi string) []PicOp {
+	switch x.kind {
+	case literalOperand:
+		ops := loadByte(word{kind: literalOperand, k: x.k & 0xFF}, lo)
+		return append(ops, loadByte(word{kind: literalOperand, k: x.k >> 8}, hi)...)
+	case wOperand:
+		return []PicOp{Movwf{F: lo}, Clrf{F: hi}}
+	}
+	ops := []PicOp{Movf{F: x.lo, D: DestW}, Movwf{F: lo}}
+	if x.hi == "" {
+		return append(ops, Clrf{F: hi})
+	}
+	return append(ops, Movf{F: x.hi, D: DestW}, Movwf{F: hi})
+}
+
+// compileWordAssign compiles an assignment to the i16 variable v.
+func (c *asmGen) compileWordAssign(v Variable, s AssignStmt) ([]PicOp, error) {
+	lo, hi := hexAddr(v.Address), hexAddr(v.Address+1)
+	unsupported := Diagnostic{
+		Code:    ErrType,
+		Message: fmt.Sprintf("%s is an i16; only x = y, x = y * z, x = y / z and x = y %% z are supported, with variables or constants for y and z", v.Name),
+		Range:   s.Position(),
+	}
+	if s.Op != EQL {
+		return nil, unsupported
+	}
+
+	// x = rom[i]
+	if idx, ok := s.Expr.(IndexExpr); ok {
+		if a, ok := c.prog.Rom[idx.Name]; ok {
+			return c.romReadWord(a, idx, lo, hi)
+		}
+	}
+
+	// x = y
+	if y, ok, err := c.wordOperand(s.Expr); err != nil {
+		return nil, err
+	} else if ok {
+		return loadWord(y, lo, hi), nil
+	}
+
+	bin, ok := s.Expr.(BinaryExpr)
+	if !ok || (bin.Op != STAR && bin.Op != SLASH && bin.Op != PERCENT) {
+		return nil, unsupported
+	}
+	a, okA, err := c.wordOperand(bin.Lhs)
+	if err != nil {
+		return nil, err
+	}
+	b, okB, err := c.wordOperand(bin.Rhs)
+	if err != nil {
+		return nil, err
+	}
+	if !okA || !okB {
+		return nil, unsupported
+	}
+
+	if bin.Op == STAR {
+		if a.kind == literalOperand {
+			a, b = b, a
+		}
+		if b.kind == literalOperand {
+			return c.mulConstWord(a, b.k, lo, hi), nil
+		}
+	} else if b.kind == literalOperand {
+		if b.k == 0 {
+			return nil, Diagnostic{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("division by zero in %v", bin),
+				Range:   bin.Rhs.Position(),
+			}
+		}
+		if n, ok := log2(b.k); ok {
+			ops := loadWord(a, lo, hi)
+			if bin.Op == SLASH {
+				// x / 2^n -> x >> n
+				for range n {
+					ops = append(ops, Lsrf{F: hi, D: DestF}, Rrf{F: lo, D: DestF})
+				}
+				return ops, nil
+			}
+			// x % 2^n -> x & (2^n - 1)
+			mask := b.k - 1
+			ops = append(ops, Movlw{K: mask & 0xFF}, Andwf{F: lo, D: DestF})
+			if mask>>8 == 0 {
+				return append(ops, Clrf{F: hi}), nil
+			}
+			return append(ops, Movlw{K: mask >> 8}, Andwf{F: hi, D: DestF}), nil
+		}
+	}
+
+	// The 8-bit helpers give a full 16-bit result, so use them when both
+	// operands fit.
+	var ops []PicOp
+	var resLo, resHi string
+	narrow := a.narrow() && b.narrow()
+	switch {
+	case bin.Op == STAR && narrow:
+		ops = append(loadByte(a, c.temp("arga")), loadByte(b, c.temp("argb"))...)
+		ops = append(ops, c.callHelper("_mul8")...)
+		resLo, resHi = c.temp("res"), c.temp("resh")
+	case bin.Op == STAR:
+		ops = append(loadWord(a, c.temp("arga"), c.temp("argah")), loadWord(b, c.temp("argb"), c.temp("argbh"))...)
+		ops = append(ops, c.callHelper("_mul16")...)
+		resLo, resHi = c.temp("res"), c.temp("resh")
+	case narrow:
+		ops = append(loadByte(a, c.temp("arga")), loadByte(b, c.temp("argb"))...)
+		ops = append(ops, c.callHelper("_div8")...)
+		resLo = c.temp("arga")
+		if bin.Op == PERCENT {
+			resLo = c.temp("res")
+		}
+	default:
+		ops = append(loadWord(a, c.temp("arga"), c.temp("argah")), loadWord(b, c.temp("argb"), c.temp("argbh"))...)
+		ops = append(ops, c.callHelper("_div16")...)
+		resLo, resHi = c.temp("arga"), c.temp("argah")
+		if bin.Op == PERCENT {
+			resLo, resHi = c.temp("res"), c.temp("resh")
+		}
+	}
+	ops = append(ops, Movf{F: resLo, D: DestW}, Movwf{F: lo})
+	if resHi == "" {
+		return append(ops, Clrf{F: hi}), nil
+	}
+	return append(ops, Movf{F: resHi, D: DestW}, Movwf{F: hi}), nil
+}
+
+// loadByte copies a narrow word operand into f.
+func loadByte(x word, f string) []PicOp {
+	switch x.kind {
+	case literalOperand:
+		if x.k == 0 {
+			return []PicOp{Clrf{F: f}}
+		}
+		return []PicOp{Movlw{K: x.k}, Movwf{F: f}}
+	case wOperand:
+		return []PicOp{Movwf{F: f}}
+	}
+	return []PicOp{Movf{F: x.lo, D: DestW}, Movwf{F: f}}
+}
+
+// mulConstWord emits code storing x * k in the register pair lo, hi.
+// Shifted copies of x are added up in the destination, so x is copied
+// into a temporary first in case it is the destination.
+func (c *asmGen) mulConstWord(x word, k int, lo, hi string) []PicOp {
+	k &= 0xFFFF
+	if k == 0 {
+		return []PicOp{Clrf{F: lo}, Clrf{F: hi}}
+	}
+	if n, ok := log2(k); ok {
+		ops := loadWord(x, lo, hi)
+		for range n {
+			ops = append(ops, Lslf{F: lo, D: DestF}, Rlf{F: hi, D: DestF})
+		}
+		return ops
+	}
+
+	t, th := c.temp("wtmp"), c.temp("wtmph")
+	ops := loadWord(x, t, th)
+	first := true
+	for i := 0; k>>i != 0; i++ {
+		if k&(1<<i) != 0 {
+			if first {
+				ops = append(ops, Movf{F: t, D: DestW}, Movwf{F: lo}, Movf{F: th, D: DestW}, Movwf{F: hi})
+			} else {
+				ops = append(ops, Movf{F: t, D: DestW}, Addwf{F: lo, D: DestF}, Movf{F: th, D: DestW}, Addwfc{F: hi, D: DestF})
+			}
+			first = false
+		}
+		if k>>(i+1) != 0 {
+			ops = append(ops, Lslf{F: t, D: DestF}, Rlf{F: th, D: DestF})
+		}
+	}
+	return ops
+}
+
+// mul8Ops multiplies _arga by _argb, giving the 16-bit product in _res
+// and _resh and its low byte in W. Each step adds the multiplicand to
+// the high byte if the next multiplier bit is set, then shifts the
+// product right. _argb is destroyed.
+func (c *asmGen) mul8Ops() []PicOp {
+	a, b := c.temp("arga"), c.temp("argb")
+	res, resh, count := c.temp("res"), c.temp("resh"), c.temp("count")
+	status := hexAddr(regSTATUS)
+	return []PicOp{
+		Clrf{F: resh},
+		Clrf{F: res},
+		Movlw{K: 8},
+		Movwf{F: count},
+		Movf{F: a, D: DestW},
+		LabelOp{Name: "_mul8_loop"},
+		Lsrf{F: b, D: DestF},
+		Btfsc{F: status, B: statusC},
+		Addwf{F: resh, D: DestF},
+		Rrf{F: resh, D: DestF},
+		Rrf{F: res, D: DestF},
+		Decfsz{F: count, D: DestF},
+		Goto{Label: "_mul8_loop"},
+		Movf{F: res, D: DestW},
+		Return{},
+	}
+}
+
+// div8Ops divides _arga by _argb, leaving the quotient in _arga and W
+// and the remainder in _res. This is restoring division; a remainder
+// that overflows into a ninth bit is always at least the divisor.
+func (c *asmGen) div8Ops() []PicOp {
+	a, b := c.temp("arga"), c.temp("argb")
+	res, count := c.temp("res"), c.temp("count")
+	status := hexAddr(regSTATUS)
+	return []PicOp{
+		Clrf{F: res},
+		Movlw{K: 8},
+		Movwf{F: count},
+		LabelOp{Name: "_div8_loop"},
+		Lslf{F: a, D: DestF},
+		Rlf{F: res, D: DestF},
+		Movf{F: b, D: DestW},
+		Btfss{F: status, B: statusC},
+		Subwf{F: res, D: DestW},
+		Btfss{F: status, B: statusC},
+		Goto{Label: "_div8_next"},
+		Movf{F: b, D: DestW},
+		Subwf{F: res, D: DestF},
+		Bsf{F: a, B: 0},
+		LabelOp{Name: "_div8_next"},
+		Decfsz{F: count, D: DestF},
+		Goto{Label: "_div8_loop"},
+		Movf{F: a, D: DestW},
+		Return{},
+	}
+}
+
+// mul16Ops multiplies _arga:_argah by _argb:_argbh, giving the low 16
+// bits of the product in _res:_resh. Both arguments are destroyed.
+func (c *asmGen) mul16Ops() []PicOp {
+	a, ah := c.temp("arga"), c.temp("argah")
+	b, bh := c.temp("argb"), c.temp("argbh")
+	res, resh, count := c.temp("res"), c.temp("resh"), c.temp("count")
+	status := hexAddr(regSTATUS)
+	return []PicOp{
+		Clrf{F: res},
+		Clrf{F: resh},
+		Movlw{K: 16},
+		Movwf{F: count},
+		LabelOp{Name: "_mul16_loop"},
+		Lsrf{F: bh, D: DestF},
+		Rrf{F: b, D: DestF},
+		Btfss{F: status, B: statusC},
+		Goto{Label: "_mul16_shift"},
+		Movf{F: a, D: DestW},
+		Addwf{F: res, D: DestF},
+		Movf{F: ah, D: DestW},
+		Addwfc{F: resh, D: DestF},
+		LabelOp{Name: "_mul16_shift"},
+		Lslf{F: a, D: DestF},
+		Rlf{F: ah, D: DestF},
+		Decfsz{F: count, D: DestF},
+		Goto{Label: "_mul16_loop"},
+		Return{},
+	}
+}
+
+// div16Ops divides _arga:_argah by _argb:_argbh, leaving the quotient in
+// _arga:_argah and the remainder in _res:_resh. It works like div8Ops.
+func (c *asmGen) div16Ops() []PicOp {
+	a, ah := c.temp("arga"), c.temp("argah")
+	b, bh := c.temp("argb"), c.temp("argbh")
+	res, resh, count := c.temp("res"), c.temp("resh"), c.temp("count")
+	status := hexAddr(regSTATUS)
+	return []PicOp{
+		Clrf{F: res},
+		Clrf{F: resh},
+		Movlw{K: 16},
+		Movwf{F: count},
+		LabelOp{Name: "_div16_loop"},
+		Lslf{F: a, D: DestF},
+		Rlf{F: ah, D: DestF},
+		Rlf{F: res, D: DestF},
+		Rlf{F: resh, D: DestF},
+		Movf{F: b, D: DestW},
+		Btfsc{F: status, B: statusC},
+		Goto{Label: "_div16_sub"},
+		Subwf{F: res, D: DestW},
+		Movf{F: bh, D: DestW},
+		Subwfb{F: resh, D: DestW},
+		Btfss{F: status, B: statusC},
+		Goto{Label: "_div16_next"},
+		Movf{F: b, D: DestW},
+		LabelOp{Name: "_div16_sub"},
+		Subwf{F: res, D: DestF},
+		Movf{F: bh, D: DestW},
+		Subwfb{F: resh, D: DestF},
+		Bsf{F: a, B: 0},
+		LabelOp{Name: "_div16_next"},
+		Decfsz{F: count, D: DestF},
+		Goto{Label: "_div16_loop"},
+		Return{},
+	}
+}
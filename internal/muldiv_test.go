@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const mulDivData = `
+section data
+banked:
+  a i8
+  b i8
+  x i8
+  p i16
+  q i16
+  y i16
+section program
+`
+
+func TestMulDivHelperCycles8(t *testing.T) {
+	ops, _, err := compileBody(mulDivData + inMain("x = a * b\nx = a / b"))
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	for _, name := range []string{"_mul8", "_div8"} {
+		worst := 0
+		for a := range 256 {
+			for b := range 256 {
+				m := newCPU(t, ops, map[string]int{"_arga": a, "_argb": b})
+				want, wantRem := a*b, a
+				if name == "_div8" {
+					want = 0xFF
+					if b != 0 {
+						want, wantRem = a/b, a%b
+					}
+				}
+				cycles := m.call(name)
+				worst = max(worst, cycles)
+
+				if name == "_mul8" {
+					got := m.regs["_resh"]<<8 | m.regs["_res"]
+					if got != want || m.w != want&0xFF {
+						t.Fatalf("%d * %d: expected %d, got %d (W = %d)", a, b, want, got, m.w)
+					}
+				} else if m.regs["_arga"] != want || m.regs["_res"] != wantRem || m.w != want {
+					t.Fatalf("%d / %d: expected %d rem %d, got %d rem %d (W = %d)", a, b, want, wantRem, m.regs["_arga"], m.regs["_res"], m.w)
+				}
+			}
+		}
+		if worst != helpers[name].cycles {
+			t.Errorf("%s: declared %d cycles, worst case is %d", name, helpers[name].cycles, worst)
+		}
+	}
+}
+
+func TestMulDivHelperCycles16(t *testing.T) {
+	ops, _, err := compileBody(mulDivData + inMain("y = p * q\ny = p / q"))
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	cases := [][2]int{{0, 0}, {0xFFFF, 0xFFFF}, {0xFFFF, 1}, {1, 0xFFFF}, {0x8000, 3}, {1234, 0}, {0xFFFF, 0x8001}}
+	for range 5000 {
+		cases = append(cases, [2]int{rng.Intn(0x10000), rng.Intn(0x10000)})
+	}
+	for _, name := range []string{"_mul16", "_div16"} {
+		worst := 0
+		for _, tc := range cases {
+			a, b := tc[0], tc[1]
+			m := newCPU(t, ops, map[string]int{
+				"_arga": a & 0xFF, "_argah": a >> 8,
+				"_argb": b & 0xFF, "_argbh": b >> 8,
+			})
+			worst = max(worst, m.call(name))
+
+			if name == "_mul16" {
+				want := a * b & 0xFFFF
+				if got := m.regs["_resh"]<<8 | m.regs["_res"]; got != want {
+					t.Fatalf("%d * %d: expected %d, got %d", a, b, want, got)
+				}
+				continue
+			}
+			want, wantRem := 0xFFFF, a
+			if b != 0 {
+				want, wantRem = a/b, a%b
+			}
+			got := m.regs["_argah"]<<8 | m.regs["_arga"]
+			rem := m.regs["_resh"]<<8 | m.regs["_res"]
+			if got != want || rem != wantRem {
+				t.Fatalf("%d / %d: expected %d rem %d, got %d rem %d", a, b, want, wantRem, got, rem)
+			}
+		}
+		if worst != helpers[name].cycles {
+			t.Errorf("%s: declared %d cycles, worst case is %d", name, helpers[name].cycles, worst)
+		}
+	}
+}
+
+func TestCompileMulDiv(t *testing.T) {
+	const a, b, p, q = 201, 13, 40000, 300
+	tests := []struct {
+		stmt string
+		want int
+	}{
+		{"x = a * b", a * b},
+		{"x = a * 10", a * 10},
+		{"x = 10 * a", a * 10},
+		{"x = a * 8", a * 8},
+		{"x = a * 0", 0},
+		{"x = (a + 1) * (b - 2)", (a + 1) * (b - 2)},
+		{"x = a / b", a / b},
+		{"x = a % b", a % b},
+		{"x = a / 16", a / 16},
+		{"x = a % 16", a % 16},
+		{"x = a / 7 + a % 7", a/7 + a%7},
+		{"x = (a + b) / (b - 3)", (a + b) & 0xFF / (b - 3)},
+		{"x = a - a / b * b", a % b},
+		{"y = a * b", a * b},
+		{"y = p", p},
+		{"y = a", a},
+		{"y = 1000", 1000},
+		{"y = p * 3", p * 3},
+		{"y = 3 * a", 3 * a},
+		{"y = p * 256", p * 256},
+		{"y = p * q", p * q},
+		{"y = p / q", p / q},
+		{"y = p % q", p % q},
+		{"y = p / b", p / b},
+		{"y = a / b", a / b},
+		{"y = a % b", a % b},
+		{"y = p / 64", p / 64},
+		{"y = p % 512", p % 512},
+		{"y = p % 16", p % 16},
+		{"p = p * 5", p * 5},
+	}
+	for _, tt := range tests {
+		ops, _, err := compileBody(mulDivData + inMain(tt.stmt))
+		if err != nil {
+			t.Fatalf("Compile(%q) failed: %v", tt.stmt, err)
+		}
+		m := newCPU(t, ops, map[string]int{
+			"0x20": a, "0x21": b,
+			"0x22": p & 0xFF, "0x23": p >> 8,
+			"0x24": q & 0xFF, "0x25": q >> 8,
+		})
+		m.run(0)
+
+		var got, want int
+		switch {
+		case strings.HasPrefix(tt.stmt, "x"):
+			got, want = m.regs["0x26"], tt.want&0xFF
+		case strings.HasPrefix(tt.stmt, "y"):
+			got, want = m.regs["0x28"]<<8|m.regs["0x27"], tt.want&0xFFFF
+		default:
+			got, want = m.regs["0x23"]<<8|m.regs["0x22"], tt.want&0xFFFF
+		}
+		if got != want {
+			t.Errorf("%s: expected %d, got %d", tt.stmt, want, got)
+		}
+	}
+}
+
+func TestMulDivHelpersOnlyWhenUsed(t *testing.T) {
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{"x = a * 10\nx = a / 4\nx = a % 8", nil},
+		{"x = a * b", []string{"_mul8"}},
+		{"x = a % b\nx = a / b", []string{"_div8"}},
+		{"y = p * q\nx = a * b", []string{"_mul16", "_mul8"}},
+		{"y = p / b", []string{"_div16"}},
+	}
+	for _, tt := range tests {
+		ops, _, err := compileBody(mulDivData + inMain(tt.body))
+		if err != nil {
+			t.Fatalf("Compile(%q) failed: %v", tt.body, err)
+		}
+		var got []string
+		for _, op := range ops {
+			if l, ok := op.(LabelOp); ok {
+				if _, ok := helpers[l.Name]; ok {
+					got = append(got, l.Name)
+				}
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q: expected helpers %v, got %v", tt.body, tt.want, got)
+		}
+	}
+}
+
+func TestMulDivErrors(t *testing.T) {
+	tests := []struct {
+		body string
+		msg  string
+	}{
+		{"x = a / 0", "division by zero"},
+		{"x = a % (2 - 2)", "division by zero"},
+		{"y = p / 0", "division by zero"},
+		{"x = p + 1", "p is an i16"},
+		{"y = p + q", "y is an i16"},
+		{"y += 1", "y is an i16"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody(fmt.Sprintf(`
+section data
+banked:
+  a i8
+  x i8
+  p i16
+  q i16
+  y i16
+section program
+fn main() begin
+  %s
+end
+`, tt.body))
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.body, tt.msg, err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// Constants come in two kinds. Value constants (numbers declared in the
+// constants section, enum members) can only be used as literals, while
+// registers (SFRs, variables) can only be used as file operands.
+// &x turns a register into the literal value of its address, and #k
+// marks a literal explicitly.
+
+type operandKind int
+
+const (
+	literalOperand operandKind = iota
+	registerOperand
+	wOperand
+)
+
+// operand is something a single instruction can use directly:
+// a literal, a file register or W.
+type operand struct {
+	kind operandKind
+	k    int    // value of a literal
+	f    string // address of a register
+}
+
+// operand classifies e. ok is false if e is not a simple operand, such as
+// a compound expression; err reports a constant of the wrong kind.
+func (c *asmGen) operand(e Expr) (operand, bool, error) {
+	if k, ok, err := c.unitConst(e); err != nil || ok {
+		return operand{kind: literalOperand, k: k}, ok, err
+	}
+	switch e := e.(type) {
+	case NumExpr:
+		return operand{kind: literalOperand, k: e.Value}, true, nil
+	case IdentExpr:
+		if isW(e.Name) {
+			return operand{kind: wOperand}, true, nil
+		}
+		if val, ok := c.valueConst(e.Name); ok {
+			return operand{kind: literalOperand, k: val}, true, nil
+		}
+		if v, ok := c.prog.Variables[e.Name]; ok && v.Type == "i16" {
+			return operand{}, false, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("%s is an i16, which can only be assigned, multiplied, divided or taken modulo", e.Name),
+				Range:   e.Range,
+			}
+		}
+		f, err := c.register(e.Name, e.Range)
+		if err != nil {
+			return operand{}, false, err
+		}
+		return operand{kind: registerOperand, f: f}, true, nil
+	case UnaryExpr:
+		switch e.Op {
+		case HASH:
+			val, err := c.valueOf(e.Expr)
+			if err != nil {
+				return operand{}, false, err
+			}
+			return operand{kind: literalOperand, k: val}, true, nil
+		case AMP:
+			addr, err := c.addressOf(e.Expr)
+			if err != nil {
+				return operand{}, false, err
+			}
+			return operand{kind: literalOperand, k: addr}, true, nil
+		}
+	case BinaryExpr:
+		// Constant expressions fold to a literal.
+		if !isArith(e.Op) {
+			break
+		}
+		a, ok, err := c.operand(e.Lhs)
+		if err != nil || !ok || a.kind != literalOperand {
+			return operand{}, false, err
+		}
+		b, ok, err := c.operand(e.Rhs)
+		if err != nil || !ok || b.kind != literalOperand {
+			return operand{}, false, err
+		}
+		if val, ok := foldOp(e.Op, a.k, b.k); ok {
+			return operand{kind: literalOperand, k: val}, true, nil
+		}
+	}
+	return operand{}, false, nil
+}
+
+// literal returns the value of e if it is a literal operand.
+func (c *asmGen) literal(e Expr) (int, bool) {
+	op, ok, err := c.operand(e)
+	if err != nil || !ok || op.kind != literalOperand {
+		return 0, false
+	}
+	return op.k, true
+}
+
+// valueConst looks up a value constant: a number from the constants
+// section or an enum member.
+func (c *asmGen) valueConst(name string) (int, bool) {
+	if val, ok := c.prog.Consts[name]; ok {
+		return val, true
+	}
+	if m, ok := c.prog.EnumMembers[name]; ok {
+		return m.Value, true
+	}
+	return 0, false
+}
+
+// register resolves name as a file register, rejecting value constants.
+func (c *asmGen) register(name string, rng Range) (string, error) {
+	if _, ok := c.valueConst(name); ok {
+		return "", Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s is a value, not a register", name),
+			Range:   rng,
+		}
+	}
+	if _, ok := c.prog.Rom[name]; ok {
+		return "", Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s is rom data in program memory, not a register", name),
+			Range:   rng,
+		}
+	}
+	if r, ok := c.coreRegister(name); ok && r.Width == 2 {
+		return "", Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s is 16 bits; use %sl or %sh for one byte", name, name, name),
+			Range:   rng,
+		}
+	}
+	return c.resolveAddr(name)
+}
+
+// valueOf evaluates #e, which must be a number or a value constant.
+func (c *asmGen) valueOf(e Expr) (int, error) {
+	if k, ok, err := c.unitConst(e); err != nil || ok {
+		return k, err
+	}
+	switch e := e.(type) {
+	case NumExpr:
+		return e.Value, nil
+	case IdentExpr:
+		if val, ok := c.valueConst(e.Name); ok {
+			return val, nil
+		}
+		return 0, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s is a register, not a value; use &%s for its address", e.Name, e.Name),
+			Range:   e.Range,
+		}
+	}
+	return 0, Diagnostic{
+		Code:    ErrType,
+		Message: fmt.Sprintf("# needs a number or a constant, got %v", e),
+		Range:   e.Position(),
+	}
+}
+
+// addressOf evaluates &e, which must name a variable or an SFR.
+func (c *asmGen) addressOf(e Expr) (int, error) {
+	id, ok := e.(IdentExpr)
+	if !ok {
+		return 0, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("& needs a register, got %v", e),
+			Range:   e.Position(),
+		}
+	}
+	if v, ok := c.prog.Variables[id.Name]; ok {
+		return v.Address, nil
+	}
+	if sfr, ok := c.prog.SFRs[id.Name]; ok {
+		return sfr.Address, nil
+	}
+	if r, ok := c.coreRegister(id.Name); ok && !isW(id.Name) {
+		return r.Address, nil
+	}
+	if _, ok := c.prog.Rom[id.Name]; ok {
+		return 0, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s is rom data, whose address isn't known until assembly; point an FSR at it with fsr0 = %s", id.Name, id.Name),
+			Range:   id.Range,
+		}
+	}
+	if _, ok := c.valueConst(id.Name); ok {
+		return 0, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s is a value and has no address", id.Name),
+			Range:   id.Range,
+		}
+	}
+	return 0, Diagnostic{
+		Code:    ErrUndefinedSymbol,
+		Message: fmt.Sprintf("unknown register %s", id.Name),
+		Range:   id.Range,
+	}
+}
+
+// checkByte reports literals that don't fit in an 8-bit operand.
+func checkByte(k int, e Expr) error {
+	if k < -128 || k > 0xFF {
+		return Diagnostic{
+			Code:    ErrInvalidNumber,
+			Message: fmt.Sprintf("%v = %d does not fit in 8 bits", e, k),
+			Range:   e.Position(),
+		}
+	}
+	return nil
+}
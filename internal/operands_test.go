@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestCompileOperands(t *testing.T) {
+	input := `
+section constants
+limit: 10
+porta: $0C []
+section data
+banked:
+  buf i8
+common:
+  x i8
+section program
+fn main() begin
+  w = limit
+  x = #limit
+  w = &buf
+  x = &porta
+  w = porta
+  if x == limit then
+    return
+end
+`
+	ops, _, err := compileBody(input)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	expected := []string{
+		"main:",
+		"MOVLW 10",
+		"MOVLW 10",
+		"MOVWF 0x70",
+		"MOVLW 32",
+		"MOVLW 12",
+		"MOVWF 0x70",
+		"MOVF 0xC,0",
+		"MOVF 0x70,0",
+		"XORLW 10",
+		"BTFSC 0x3,2",
+		"RETURN",
+	}
+
+	if len(ops) != len(expected) {
+		t.Fatalf("Expected %d ops, got %d", len(expected), len(ops))
+	}
+	for i, op := range ops {
+		if op.Assembly() != expected[i] {
+			t.Errorf("Op %d: expected %q, got %q", i, expected[i], op.Assembly())
+		}
+	}
+}
+
+func TestOperandKindMismatch(t *testing.T) {
+	header := `
+section constants
+limit: 10
+porta: $0C [ ra0: 0 ]
+section data
+common:
+  x i8
+section program
+fn main() begin
+`
+	bad := []string{
+		"limit = w",
+		"limit += 1",
+		"w = &limit",
+		"w = #porta",
+		"w = #x",
+		"if limit[0] then return",
+		"w = 300",
+	}
+	for _, stmt := range bad {
+		if _, _, err := compileBody(header + stmt + "\nend"); err == nil {
+			t.Errorf("%q: expected an error", stmt)
+		}
+	}
+}
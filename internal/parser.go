@@ -2,6 +2,9 @@ package internal
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -44,10 +47,22 @@ func (r ReturnStmt) String() string {
 	return "return"
 }
 
+func (s YieldStmt) String() string {
+	return "yield"
+}
+
+func (s WaitStmt) String() string {
+	return "wait until " + s.Cond.String()
+}
+
 func (i IdentExpr) String() string {
 	return i.Name
 }
 
+func (e StringExpr) String() string {
+	return strconv.Quote(e.Value)
+}
+
 func (n NumExpr) String() string {
 	return n.Val
 }
@@ -61,6 +76,12 @@ func (e IndexExpr) String() string {
 }
 
 func (e UnaryExpr) String() string {
+	switch e.Op {
+	case AMP:
+		return "&" + e.Expr.String()
+	case HASH:
+		return "#" + e.Expr.String()
+	}
 	return fmt.Sprintf("%s %s", e.Op.String(), e.Expr.String())
 }
 
@@ -72,10 +93,68 @@ func (e PostfixExpr) String() string {
 	return fmt.Sprintf("%s%s", e.Expr.String(), e.Op.String())
 }
 
+func (b BlockStmt) String() string {
+	var sb strings.Builder
+	sb.WriteString("begin\n")
+	for _, stmt := range b.Body {
+		sb.WriteString(stmt.String())
+		sb.WriteRune('\n')
+	}
+	sb.WriteString("end")
+	return sb.String()
+}
+
+func (s AtomicStmt) String() string {
+	return "atomic " + BlockStmt{Body: s.Body}.String()
+}
+
+func (s TimedStmt) String() string {
+	amount := s.Amount.String()
+	if s.Unit != "" {
+		amount += " " + s.Unit
+	}
+	return fmt.Sprintf("%s %s %s", s.kind(), amount, BlockStmt{Body: s.Body}.String())
+}
+
+// kind returns the keyword that starts s.
+func (s TimedStmt) kind() string {
+	if s.Exact {
+		return "exactly"
+	}
+	return "within"
+}
+
+func (s CaseStmt) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "case %s of\n", s.Subject.String())
+	for _, arm := range s.Arms {
+		for i, v := range arm.Values {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(v.String())
+		}
+		fmt.Fprintf(&sb, ": %s\n", arm.Body.String())
+	}
+	if s.Else != nil {
+		sb.WriteString("else\n")
+		for _, stmt := range s.Else {
+			sb.WriteString(stmt.String())
+			sb.WriteRune('\n')
+		}
+	}
+	sb.WriteString("end")
+	return sb.String()
+}
+
 func (l LabelStmt) String() string {
 	return l.Name + ":"
 }
 
+func (d DelayStmt) String() string {
+	return fmt.Sprintf("delay %s %s", d.Amount.String(), d.Unit)
+}
+
 type Stmt interface {
 	String() string
 	isStmt()
@@ -90,21 +169,109 @@ type Expr interface {
 
 type Program struct {
 	Functions     []Function
+	Tasks         []Task
 	AtBlocks      []AtBlock
 	Consts        map[string]int
+	Units         map[string]Unit // of the constants that have one
 	Configuration map[string]int
 	SFRs          map[string]SFR
 	Variables     map[string]Variable
+	Aliases       map[string]Alias
+	Enums         map[string]Enum
+	EnumMembers   map[string]EnumMember
+	Tables        map[string]FuncTable
+	Rom           map[string]RomArray
+	Overlays      []Overlay
+	Asserts       []Assert
+	Budgets       map[string]Budget
+	Fosc          int // Oscillator frequency in Hz; 0 if undeclared
+}
+
+// Assert is a constant condition that must hold for the program to
+// build, declared in any section as e.g. assert tick < 1ms, "too slow".
+type Assert struct {
+	Cond    Expr
+	Message string
+	Range   Range
+}
+
+// Budget is a limit on a resource the program uses, declared in the
+// configuration section as e.g. budget words: 3840.
+type Budget struct {
+	Limit int
+	Range Range
+}
+
+// Enum is a set of named, automatically numbered constants.
+type Enum struct {
+	Name    string
+	Members []string // in declaration order
+	Range   Range
+}
+
+type EnumMember struct {
+	Enum  string
+	Value int
+}
+
+// Overlay is a group of variables that share storage. Each member is a
+// run of variables laid out one after another, and every member starts
+// at the same address.
+type Overlay struct {
+	Members [][]string
+	Banked  bool
+	Pinned  bool // Address was given with at
+	Address int
+	Range   Range
+}
+
+// FuncTable is a table of functions called by index, declared in the
+// program section as e.g. table handlers [ start stop ].
+type FuncTable struct {
+	Name    string
+	Entries []string
+	Range   Range
+}
+
+// RomArray is data kept in program memory, declared in the rom part of
+// the data section as e.g. digits i8 [ $3F $06 "ab" ]. Strings stand for
+// their characters. Each byte takes a word unless the array is packed,
+// in which case each word holds two 7-bit characters.
+type RomArray struct {
+	Name   string
+	Type   string // "i8" or "i16"
+	Packed bool
+	Items  []Expr // constants and StringExprs
+	Range  Range
+}
+
+// Alias is another name for a register, a register bit or a variable,
+// declared in the constants section as e.g. led: latc[3].
+type Alias struct {
+	Target Expr // IdentExpr or IndexExpr
+	Range  Range
 }
 
 type Variable struct {
 	Name    string
-	Type    string // "i8" for now
+	Type    string // "i8" or "i16"
+	Enum    string // enum the variable holds members of, if any
 	Banked  bool   // true if banked, false if common
 	Address int    // Assigned address
+	Pinned  bool   // Address was given with at
+	Init    Expr   // Initial value set by the startup code, or nil
 	Range   Range
 }
 
+// Size returns the number of bytes v occupies. An i16 is stored low
+// byte first.
+func (v Variable) Size() int {
+	if v.Type == "i16" {
+		return 2
+	}
+	return 1
+}
+
 type AtBlock struct {
 	Address int
 	Body    []Stmt
@@ -114,17 +281,40 @@ type AtBlock struct {
 type SFR struct {
 	Address int
 	Bits    map[string]int
+	Fields  map[string]BitField
 	Range   Range
 }
 
+// BitField is a run of bits within an SFR, e.g. ps: 0..2
+type BitField struct {
+	Lo   int
+	Hi   int
+	Enum string // enum the field holds members of, if any
+}
+
+// Mask returns the bits of the field in place.
+func (f BitField) Mask() int {
+	return ((1 << (f.Hi - f.Lo + 1)) - 1) << f.Lo
+}
+
 type Function struct {
 	Name  string
 	Body  []Stmt
 	Range Range
 }
 
+// Task is a cooperative task, run a step at a time by the scheduler.
+type Task struct {
+	Name  string
+	Body  []Stmt
+	Range Range
+}
+
+// CallStmt calls the function Name, or entry Index of the function
+// table Name if Index is set.
 type CallStmt struct {
 	Name  string
+	Index Expr
 	Range Range
 }
 
@@ -132,6 +322,9 @@ func (CallStmt) isStmt()           {}
 func (s CallStmt) Position() Range { return s.Range }
 
 func (c CallStmt) String() string {
+	if c.Index != nil {
+		return fmt.Sprintf("call %s[%s]", c.Name, c.Index.String())
+	}
 	return fmt.Sprintf("call %s", c.Name)
 }
 
@@ -154,10 +347,76 @@ type IfStmt struct {
 func (IfStmt) isStmt()           {}
 func (s IfStmt) Position() Range { return s.Range }
 
+// BlockStmt groups statements where one is expected, as in
+// if ... then begin ... end
+type BlockStmt struct {
+	Body  []Stmt
+	Range Range
+}
+
+func (BlockStmt) isStmt()           {}
+func (s BlockStmt) Position() Range { return s.Range }
+
+// CaseStmt runs the arm listing the value of Subject, or Else if no arm
+// does. Else is nil if there is no else part.
+type CaseStmt struct {
+	Subject Expr
+	Arms    []CaseArm
+	Else    []Stmt
+	Range   Range
+}
+
+type CaseArm struct {
+	Values []Expr
+	Body   Stmt
+}
+
+func (CaseStmt) isStmt()           {}
+func (s CaseStmt) Position() Range { return s.Range }
+
+// AtomicStmt runs Body with interrupts disabled.
+type AtomicStmt struct {
+	Body  []Stmt
+	Range Range
+}
+
+func (AtomicStmt) isStmt()           {}
+func (s AtomicStmt) Position() Range { return s.Range }
+
 type ReturnStmt struct {
 	Range Range
 }
 
+// YieldStmt ends a step of a task; the next step resumes after it.
+type YieldStmt struct {
+	Range Range
+}
+
+func (YieldStmt) isStmt()           {}
+func (s YieldStmt) Position() Range { return s.Range }
+
+// WaitStmt ends steps of a task until Cond holds.
+type WaitStmt struct {
+	Cond  Expr
+	Range Range
+}
+
+func (WaitStmt) isStmt()           {}
+func (s WaitStmt) Position() Range { return s.Range }
+
+// TimedStmt runs Body, which must take exactly Amount if Exact is set,
+// or at most Amount otherwise. Unit is as in DelayStmt.
+type TimedStmt struct {
+	Exact  bool
+	Amount Expr
+	Unit   string
+	Body   []Stmt
+	Range  Range
+}
+
+func (TimedStmt) isStmt()           {}
+func (s TimedStmt) Position() Range { return s.Range }
+
 func (ReturnStmt) isStmt()           {}
 func (s ReturnStmt) Position() Range { return s.Range }
 
@@ -169,6 +428,17 @@ type LabelStmt struct {
 func (LabelStmt) isStmt()           {}
 func (s LabelStmt) Position() Range { return s.Range }
 
+// DelayStmt busy-waits for Amount, measured in Unit.
+// Unit is "cycles" or one of the time units in delayUnits.
+type DelayStmt struct {
+	Amount Expr
+	Unit   string // empty if Amount has a unit of its own
+	Range  Range
+}
+
+func (DelayStmt) isStmt()           {}
+func (s DelayStmt) Position() Range { return s.Range }
+
 type IdentExpr struct {
 	Name  string
 	Range Range
@@ -186,10 +456,20 @@ type IndexExpr struct {
 func (IndexExpr) isExpr()           {}
 func (e IndexExpr) Position() Range { return e.Range }
 
+// StringExpr is a string literal, which only appears in rom data.
+type StringExpr struct {
+	Value string
+	Range Range
+}
+
+func (StringExpr) isExpr()           {}
+func (e StringExpr) Position() Range { return e.Range }
+
 type NumExpr struct {
 	Val   string
-	Value int
+	Value int // in the base of Unit: ns, Hz or baud
 	Ty    TTy
+	Unit  Unit
 	Range Range
 }
 
@@ -225,18 +505,59 @@ func (PostfixExpr) isExpr()           {}
 func (e PostfixExpr) Position() Range { return e.Range }
 
 func Parse(tokens []Tok) (Program, error) {
+	return ParseWithDefines(tokens, nil)
+}
+
+// ParseWithDefines is like Parse, but first sets the constants in
+// defines, which override declarations of the same name in the source.
+// A define whose name appears nowhere in the source is an error, as it
+// is most likely misspelled.
+func ParseWithDefines(tokens []Tok, defines map[string]int) (Program, error) {
 	p := newParser(tokens)
+	p.defines = defines
 	prog := p.parseProgram()
+	for _, name := range slices.Sorted(maps.Keys(defines)) {
+		if !slices.ContainsFunc(tokens, func(tk Tok) bool { return tk.ty == IDENT && tk.val == name }) {
+			p.diagnostics = append(p.diagnostics, Diagnostic{
+				Code:    ErrUndefinedSymbol,
+				Message: fmt.Sprintf("-D %s: no constant or when block uses %s", name, name),
+			})
+		}
+	}
 	if len(p.diagnostics) > 0 {
 		return prog, p.diagnostics
 	}
 	return prog, nil
 }
 
+// ParseDefine parses a -D option, name=value or just name, which
+// defines name as 1.
+func ParseDefine(s string) (string, int, error) {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		value = "1"
+	}
+	toks, err := Lex(name + " " + value)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(toks) != 3 || toks[0].ty != IDENT || toks[2].ty != EOF {
+		return "", 0, fmt.Errorf("expected name=number, got %s", s)
+	}
+	num, ok := newParser(toks[1:]).parsePrimaryExpr()
+	if n, isNum := num.(NumExpr); ok && isNum && n.Unit == NoUnit {
+		return toks[0].val, n.Value, nil
+	}
+	return "", 0, fmt.Errorf("expected name=number, got %s", s)
+}
+
 type parser struct {
 	toks        []Tok
 	pos         int
 	diagnostics DiagnosticList
+	prog        *Program
+	defines     map[string]int
+	whens       []TTy // what closes each when block being parsed
 }
 
 func newParser(toks []Tok) *parser {
@@ -265,6 +586,14 @@ func (p *parser) peekNext() Tok {
 	return p.toks[p.pos+1]
 }
 
+// previous returns the token before the current one.
+func (p *parser) previous() Tok {
+	if p.pos == 0 || p.pos > len(p.toks) {
+		return Tok{ty: EOF}
+	}
+	return p.toks[p.pos-1]
+}
+
 func (p *parser) advance() {
 	p.pos++
 }
@@ -279,6 +608,50 @@ func (p *parser) expect(ty TTy, msg string) (Tok, bool) {
 	return tok, true
 }
 
+// sectionDone reports whether the items of the current section have
+// ended, either at the next section or at the end of a when block.
+func (p *parser) sectionDone() bool {
+	ty := p.current().ty
+	return ty == EOF || ty == SECTION || (len(p.whens) > 0 && ty == p.whens[len(p.whens)-1])
+}
+
+// atBody reports whether a block starts here: BEGIN, or an indented
+// block in a file that uses indentation.
+func (p *parser) atBody() bool {
+	return p.current().ty == BEGIN || p.current().ty == INDENT
+}
+
+// parseBody parses BEGIN Stmt* END or INDENT Stmt* DEDENT, returning the
+// statements and where the block ends.
+func (p *parser) parseBody(endMsg string) ([]Stmt, Position, bool) {
+	closer := END
+	if p.current().ty == INDENT {
+		closer = DEDENT
+	}
+	p.advance() // BEGIN or INDENT
+	stmts := []Stmt{}
+	for p.current().ty != closer && p.current().ty != EOF {
+		stmt, ok := p.parseStmt()
+		if !ok {
+			p.advance()
+			continue
+		}
+		stmts = append(stmts, stmt)
+	}
+
+	// A DEDENT sits at the start of the next line, so an indented block
+	// ends with its last statement.
+	end := p.previous().Range.End
+	endTok, ok := p.expect(closer, endMsg)
+	if !ok {
+		return nil, Position{}, false
+	}
+	if closer == END {
+		end = endTok.Range.End
+	}
+	return stmts, end, true
+}
+
 func (p *parser) synchronize() {
 	for p.current().ty != EOF && p.current().ty != SECTION {
 		p.advance()
@@ -290,9 +663,20 @@ func (p *parser) parseProgram() Program {
 		Functions:     []Function{},
 		AtBlocks:      []AtBlock{},
 		Consts:        make(map[string]int),
+		Units:         make(map[string]Unit),
 		Configuration: make(map[string]int),
 		SFRs:          make(map[string]SFR),
 		Variables:     make(map[string]Variable),
+		Aliases:       make(map[string]Alias),
+		Enums:         make(map[string]Enum),
+		EnumMembers:   make(map[string]EnumMember),
+		Tables:        make(map[string]FuncTable),
+		Rom:           make(map[string]RomArray),
+		Budgets:       make(map[string]Budget),
+	}
+	p.prog = &result
+	for name, val := range p.defines {
+		result.Consts[name] = val
 	}
 
 	for p.current().ty != EOF {
@@ -307,7 +691,7 @@ func (p *parser) parseProgram() Program {
 				p.parseConfiguration(&result)
 			case DATA:
 				p.advance()
-				p.parseData(&result)
+				p.parseData(&result, COMMON)
 			case PROGRAM:
 				p.advance()
 				p.parseFunctions(&result)
@@ -324,8 +708,12 @@ func (p *parser) parseProgram() Program {
 	return result
 }
 
+// foscKey is the configuration item that declares the oscillator
+// frequency in Hz. It is not a configuration word.
+const foscKey = "fosc"
+
 func (p *parser) parseConfiguration(prog *Program) {
-	for p.current().ty != EOF && p.current().ty != SECTION {
+	for !p.sectionDone() {
 		if p.current().ty == IDENT {
 			name := p.current().val
 			p.advance()
@@ -342,7 +730,28 @@ func (p *parser) parseConfiguration(prog *Program) {
 				p.error(fmt.Sprintf("expected number value for configuration %s", name))
 				continue
 			}
+			if name == foscKey {
+				if val.Unit != NoUnit && val.Unit != FreqUnit {
+					p.error(fmt.Sprintf("%s is a frequency, not a %s", foscKey, val.Unit))
+					continue
+				}
+				prog.Fosc = val.Value
+				continue
+			}
+			if val.Unit != NoUnit {
+				p.error(fmt.Sprintf("configuration %s can't have a unit", name))
+				continue
+			}
 			prog.Configuration[name] = val.Value
+		} else if p.current().ty == BUDGET {
+			p.parseBudget(prog)
+		} else if p.current().ty == ASSERT {
+			p.parseAssert(prog)
+		} else if p.current().ty == WHEN {
+			if p.parseWhen() {
+				p.parseConfiguration(prog)
+				p.endWhen()
+			}
 		} else {
 			p.error(fmt.Sprintf("unexpected token in configuration section: %s", p.current().String()))
 			p.advance()
@@ -351,9 +760,18 @@ func (p *parser) parseConfiguration(prog *Program) {
 }
 
 func (p *parser) parseConstants(prog *Program) {
-	for p.current().ty != EOF && p.current().ty != SECTION {
+	for !p.sectionDone() {
 		if p.current().ty == IDENT {
 			p.parseConstant(prog)
+		} else if p.current().ty == ENUM {
+			p.parseEnum(prog)
+		} else if p.current().ty == ASSERT {
+			p.parseAssert(prog)
+		} else if p.current().ty == WHEN {
+			if p.parseWhen() {
+				p.parseConstants(prog)
+				p.endWhen()
+			}
 		} else {
 			p.error(fmt.Sprintf("unexpected token in constants section: %s", p.current().String()))
 			p.advance()
@@ -361,121 +779,390 @@ func (p *parser) parseConstants(prog *Program) {
 	}
 }
 
-func (p *parser) parseData(prog *Program) {
-	banked := false // Default to common
-	for p.current().ty != EOF && p.current().ty != SECTION {
-		if p.current().ty == COMMON {
-			p.advance()
-			if _, ok := p.expect(COLON, "expected : after common"); !ok {
-				continue
-			}
-			banked = false
-		} else if p.current().ty == BANKED {
-			p.advance()
-			if _, ok := p.expect(COLON, "expected : after banked"); !ok {
-				continue
-			}
-			banked = true
-		} else if p.current().ty == IDENT {
-			nameTok := p.current()
-			name := nameTok.val
-			p.advance()
+// Budgets that can be declared. words limits the size of the program,
+// for instance to leave room for a bootloader, and stack the depth of
+// calls.
+const (
+	budgetWords = "words"
+	budgetStack = "stack"
+)
 
-			if p.current().ty == I8 {
-				p.advance()
-				prog.Variables[name] = Variable{
-					Name:   name,
-					Type:   "i8",
-					Banked: banked,
-					Range:  nameTok.Range,
-				}
-			} else {
-				p.error(fmt.Sprintf("expected type for variable %s, got %s", name, p.current().String()))
-				p.advance()
-			}
-		} else {
-			p.error(fmt.Sprintf("unexpected token in data section: %s", p.current().String()))
-			p.advance()
-		}
+func (p *parser) parseBudget(prog *Program) {
+	// BUDGET IDENT COLON NUM
+	start := p.current().Range.Start
+	p.advance()
+	nameTok, ok := p.expect(IDENT, fmt.Sprintf("expected %s or %s after budget", budgetWords, budgetStack))
+	if !ok {
+		return
+	}
+	if _, ok := p.expect(COLON, fmt.Sprintf("expected : after budget %s", nameTok.val)); !ok {
+		return
+	}
+	valExpr, ok := p.parseExpr()
+	if !ok {
+		return
+	}
+	val, ok := valExpr.(NumExpr)
+	if !ok || val.Unit != NoUnit {
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("budget %s needs a plain number, got %v", nameTok.val, valExpr),
+			Range:   valExpr.Position(),
+		})
+		return
+	}
+	rng := Range{Start: start, End: val.Range.End}
+	switch {
+	case nameTok.val != budgetWords && nameTok.val != budgetStack:
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Code:    ErrUndefinedSymbol,
+			Message: fmt.Sprintf("unknown budget %s; expected %s or %s", nameTok.val, budgetWords, budgetStack),
+			Range:   nameTok.Range,
+		})
+	case prog.Budgets[nameTok.val] != (Budget{}):
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("budget %s is already declared", nameTok.val),
+			Range:   rng,
+		})
+	default:
+		prog.Budgets[nameTok.val] = Budget{Limit: val.Value, Range: rng}
 	}
 }
 
-func (p *parser) parseFunctions(prog *Program) {
-	for p.current().ty != EOF && p.current().ty != SECTION {
-		if p.current().ty == FN {
-			fn, ok := p.parseFunction()
-			if !ok {
-				// Skip to next function or section
-				for p.current().ty != EOF && p.current().ty != SECTION && p.current().ty != FN && p.current().ty != AT {
-					p.advance()
-				}
+func (p *parser) parseAssert(prog *Program) {
+	// ASSERT Expr COMMA STRING
+	start := p.current().Range.Start
+	p.advance()
+	cond, ok := p.parseExpr()
+	if !ok {
+		return
+	}
+	if _, ok := p.expect(COMMA, "expected , and a message after assert condition"); !ok {
+		return
+	}
+	msgTok, ok := p.expect(STRING, "expected a message string after assert condition")
+	if !ok {
+		return
+	}
+	prog.Asserts = append(prog.Asserts, Assert{
+		Cond:    cond,
+		Message: msgTok.val,
+		Range:   Range{Start: start, End: msgTok.Range.End},
+	})
+}
+
+// parseData parses data section items into region, which is COMMON,
+// BANKED or ROM until a region label says otherwise.
+func (p *parser) parseData(prog *Program, region TTy) {
+	for !p.sectionDone() {
+		switch ty := p.current().ty; {
+		case ty == COMMON || ty == BANKED || ty == ROM:
+			p.advance()
+			if _, ok := p.expect(COLON, fmt.Sprintf("expected : after %s", strings.ToLower(ty.String()))); !ok {
 				continue
 			}
-			prog.Functions = append(prog.Functions, fn)
-		} else if p.current().ty == AT {
-			blk, ok := p.parseAtBlock()
-			if !ok {
-				// Skip to next function or section
-				for p.current().ty != EOF && p.current().ty != SECTION && p.current().ty != FN && p.current().ty != AT {
-					p.advance()
+			region = ty
+		case ty == IDENT && region == ROM:
+			if a, ok := p.parseRom(); ok {
+				if _, ok := prog.Rom[a.Name]; ok {
+					p.diagnostics = append(p.diagnostics, Diagnostic{
+						Code:    ErrType,
+						Message: fmt.Sprintf("rom data %s is already declared", a.Name),
+						Range:   a.Range,
+					})
 				}
-				continue
+				prog.Rom[a.Name] = a
 			}
-			prog.AtBlocks = append(prog.AtBlocks, blk)
-		} else {
-			p.error("unexpected token in program section")
+		case ty == IDENT:
+			if v, ok := p.parseVariable(region == BANKED); ok {
+				prog.Variables[v.Name] = v
+			}
+		case ty == OVERLAY && region != ROM:
+			p.parseOverlay(prog, region == BANKED)
+		case ty == ASSERT:
+			p.parseAssert(prog)
+		case ty == WHEN:
+			if p.parseWhen() {
+				p.parseData(prog, region)
+				p.endWhen()
+			}
+		default:
+			p.error(fmt.Sprintf("unexpected token in data section: %s", p.current().String()))
 			p.advance()
 		}
 	}
 }
 
-func (p *parser) parseAtBlock() (AtBlock, bool) {
-	start := p.current().Range.Start
-	p.advance() // eat AT
-	addrExpr, ok := p.parseExpr()
-	if !ok {
-		return AtBlock{}, false
+func (p *parser) parseRom() (RomArray, bool) {
+	// IDENT[name] (I8 | I16) PACKED? LBRACK (Expr | STRING)* RBRACK
+	nameTok := p.current()
+	p.advance()
+	a := RomArray{Name: nameTok.val, Range: nameTok.Range}
+	switch p.current().ty {
+	case I8, I16:
+		a.Type = strings.ToLower(p.current().ty.String())
+	default:
+		p.error(fmt.Sprintf("expected i8 or i16 for rom data %s, got %s", a.Name, p.current().String()))
+		p.advance()
+		return RomArray{}, false
 	}
-	addr, ok := addrExpr.(NumExpr)
-	if !ok {
-		p.error("expected number address for at block")
-		return AtBlock{}, false
+	p.advance()
+	if p.current().ty == PACKED {
+		if a.Type != "i8" {
+			p.error(fmt.Sprintf("only i8 rom data can be packed, and %s is an %s", a.Name, a.Type))
+		}
+		a.Packed = true
+		p.advance()
 	}
-
-	if _, ok := p.expect(BEGIN, "expected begin after at address"); !ok {
-		return AtBlock{}, false
+	if _, ok := p.expect(LBRACK, fmt.Sprintf("expected [ after rom data %s", a.Name)); !ok {
+		return RomArray{}, false
 	}
-
-	stmts := []Stmt{}
-	for p.current().ty != END && p.current().ty != EOF {
-		stmt, ok := p.parseStmt()
-		if !ok {
+	for p.current().ty != RBRACK {
+		if p.current().ty == EOF {
+			p.error(fmt.Sprintf("expected ] after rom data %s", a.Name))
+			return RomArray{}, false
+		}
+		if tok := p.current(); tok.ty == STRING {
 			p.advance()
+			a.Items = append(a.Items, StringExpr{Value: tok.val, Range: tok.Range})
 			continue
 		}
-		stmts = append(stmts, stmt)
-	}
-
-	endTok, ok := p.expect(END, "expected end after at block")
-	if !ok {
-		return AtBlock{}, false
+		e, ok := p.parseExpr()
+		if !ok {
+			return RomArray{}, false
+		}
+		a.Items = append(a.Items, e)
 	}
-
-	return AtBlock{Address: addr.Value, Body: stmts, Range: Range{Start: start, End: endTok.Range.End}}, true
+	p.advance() // ]
+	return a, true
 }
 
-func (p *parser) parseConstant(prog *Program) bool {
-	// Declaration: ident: value [ ... ]
-	name := p.current().val
+func (p *parser) parseVariable(banked bool) (Variable, bool) {
+	// IDENT[name] (I8 | I16 | IDENT[enum]) (AT Number)? (EQL Expr)?
+	nameTok := p.current()
+	name := nameTok.val
 	p.advance()
-	if _, ok := p.expect(COLON, fmt.Sprintf("expected : after identifier %s", name)); !ok {
-		return false
-	}
+
+	v := Variable{Name: name, Type: "i8", Banked: banked, Range: nameTok.Range}
+	switch p.current().ty {
+	case I8, I16:
+		v.Type = strings.ToLower(p.current().ty.String())
+	case IDENT:
+		// Enum-typed variable; the enum is checked by the compiler
+		// since it may be declared in a later section.
+		v.Enum = p.current().val
+	default:
+		p.error(fmt.Sprintf("expected type for variable %s, got %s", name, p.current().String()))
+		p.advance()
+		return Variable{}, false
+	}
+	p.advance()
+
+	if p.current().ty == AT {
+		addr, ok := p.parseAddress()
+		if !ok {
+			return Variable{}, false
+		}
+		v.Address, v.Pinned = addr, true
+	}
+	if p.current().ty == EQL {
+		p.advance()
+		init, ok := p.parseExpr()
+		if !ok {
+			return Variable{}, false
+		}
+		v.Init = init
+	}
+	return v, true
+}
+
+// parseAddress parses AT Number, as in a placement.
+func (p *parser) parseAddress() (int, bool) {
+	p.advance() // AT
+	addrExpr, ok := p.parseExpr()
+	if !ok {
+		return 0, false
+	}
+	addr, ok := addrExpr.(NumExpr)
+	if !ok {
+		p.error(fmt.Sprintf("expected number address after at, got %v", addrExpr))
+		return 0, false
+	}
+	return addr.Value, true
+}
+
+func (p *parser) parseOverlay(prog *Program, banked bool) {
+	// OVERLAY (AT Number)? BEGIN (VariableDecl | BEGIN VariableDecl* END)* END
+	start := p.current().Range.Start
+	p.advance() // OVERLAY
+	o := Overlay{Banked: banked}
+	if p.current().ty == AT {
+		addr, ok := p.parseAddress()
+		if !ok {
+			return
+		}
+		o.Address, o.Pinned = addr, true
+	}
+	if _, ok := p.expect(BEGIN, fmt.Sprintf("expected begin after overlay, got %s", p.current().String())); !ok {
+		return
+	}
+
+	// member parses one variable into the current member, which must
+	// not be pinned itself.
+	member := func(names []string) []string {
+		v, ok := p.parseVariable(banked)
+		if !ok {
+			return names
+		}
+		if v.Pinned {
+			p.diagnostics = append(p.diagnostics, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("%s is in an overlay, so place the overlay instead", v.Name),
+				Range:   v.Range,
+			})
+		}
+		if v.Init != nil {
+			p.diagnostics = append(p.diagnostics, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("%s is in an overlay, so it can't have an initial value", v.Name),
+				Range:   v.Range,
+			})
+		}
+		prog.Variables[v.Name] = v
+		return append(names, v.Name)
+	}
+	for p.current().ty != END && p.current().ty != EOF {
+		switch p.current().ty {
+		case IDENT:
+			if names := member(nil); names != nil {
+				o.Members = append(o.Members, names)
+			}
+		case BEGIN:
+			p.advance()
+			var names []string
+			for p.current().ty == IDENT {
+				names = member(names)
+			}
+			if _, ok := p.expect(END, fmt.Sprintf("expected end after overlay member, got %s", p.current().String())); !ok {
+				return
+			}
+			o.Members = append(o.Members, names)
+		default:
+			p.error(fmt.Sprintf("unexpected token in overlay: %s", p.current().String()))
+			p.advance()
+		}
+	}
+	endTok, ok := p.expect(END, "expected end after overlay")
+	if !ok {
+		return
+	}
+	o.Range = Range{Start: start, End: endTok.Range.End}
+	prog.Overlays = append(prog.Overlays, o)
+}
+
+func (p *parser) parseFunctions(prog *Program) {
+	for !p.sectionDone() {
+		if p.current().ty == FN {
+			fn, ok := p.parseFunction()
+			if !ok {
+				// Skip to next function or section
+				for p.current().ty != EOF && p.current().ty != SECTION && p.current().ty != FN && p.current().ty != AT && p.current().ty != TABLE && p.current().ty != TASK && p.current().ty != ASSERT {
+					p.advance()
+				}
+				continue
+			}
+			prog.Functions = append(prog.Functions, fn)
+		} else if p.current().ty == AT {
+			blk, ok := p.parseAtBlock()
+			if !ok {
+				// Skip to next function or section
+				for p.current().ty != EOF && p.current().ty != SECTION && p.current().ty != FN && p.current().ty != AT && p.current().ty != TABLE && p.current().ty != TASK && p.current().ty != ASSERT {
+					p.advance()
+				}
+				continue
+			}
+			prog.AtBlocks = append(prog.AtBlocks, blk)
+		} else if p.current().ty == TASK {
+			task, ok := p.parseTask()
+			if !ok {
+				for p.current().ty != EOF && p.current().ty != SECTION && p.current().ty != FN && p.current().ty != AT && p.current().ty != TABLE && p.current().ty != TASK && p.current().ty != ASSERT {
+					p.advance()
+				}
+				continue
+			}
+			prog.Tasks = append(prog.Tasks, task)
+		} else if p.current().ty == TABLE {
+			if !p.parseTable(prog) {
+				for p.current().ty != EOF && p.current().ty != SECTION && p.current().ty != FN && p.current().ty != AT && p.current().ty != TABLE && p.current().ty != TASK && p.current().ty != ASSERT {
+					p.advance()
+				}
+			}
+		} else if p.current().ty == ASSERT {
+			p.parseAssert(prog)
+		} else if p.current().ty == WHEN {
+			if p.parseWhen() {
+				p.parseFunctions(prog)
+				p.endWhen()
+			}
+		} else if p.current().ty == INDENT && len(p.whens) > 0 {
+			// The functions of a when ... begin, indented.
+			p.advance()
+			p.whens = append(p.whens, DEDENT)
+			p.parseFunctions(prog)
+			p.endWhen()
+		} else {
+			p.error("unexpected token in program section")
+			p.advance()
+		}
+	}
+}
+
+func (p *parser) parseAtBlock() (AtBlock, bool) {
+	start := p.current().Range.Start
+	p.advance() // eat AT
+	addrExpr, ok := p.parseExpr()
+	if !ok {
+		return AtBlock{}, false
+	}
+	addr, ok := addrExpr.(NumExpr)
+	if !ok {
+		p.error("expected number address for at block")
+		return AtBlock{}, false
+	}
+
+	if !p.atBody() {
+		p.error("expected begin after at address")
+		return AtBlock{}, false
+	}
+
+	stmts, end, ok := p.parseBody("expected end after at block")
+	if !ok {
+		return AtBlock{}, false
+	}
+
+	return AtBlock{Address: addr.Value, Body: stmts, Range: Range{Start: start, End: end}}, true
+}
+
+func (p *parser) parseConstant(prog *Program) bool {
+	// Declaration: ident: value [ ... ]
+	// or alias:     ident: register, ident: register[bit]
+	nameTok := p.current()
+	name := nameTok.val
+	p.advance()
+	if _, ok := p.expect(COLON, fmt.Sprintf("expected : after identifier %s", name)); !ok {
+		return false
+	}
 
 	valExpr, ok := p.parseExpr()
 	if !ok {
 		return false
 	}
+	switch valExpr.(type) {
+	case IdentExpr, IndexExpr:
+		prog.Aliases[name] = Alias{Target: valExpr, Range: Range{Start: nameTok.Range.Start, End: valExpr.Position().End}}
+		return true
+	}
 	val, ok := valExpr.(NumExpr)
 	if !ok {
 		p.error(fmt.Sprintf("expected number value for constant %s", name))
@@ -486,6 +1173,7 @@ func (p *parser) parseConstant(prog *Program) bool {
 		// SFR definition
 		p.advance()
 		bits := make(map[string]int)
+		fields := make(map[string]BitField)
 		for p.current().ty != RBRACK {
 			bitName, ok := p.expect(IDENT, "expected bit name")
 			if !ok {
@@ -503,19 +1191,159 @@ func (p *parser) parseConstant(prog *Program) bool {
 				p.error(fmt.Sprintf("expected number value for bit %s", bitName.val))
 				return false
 			}
-			bits[bitName.val] = bitVal.Value
+			if p.current().ty != DOTDOT {
+				bits[bitName.val] = bitVal.Value
+				continue
+			}
+
+			// Field: lo..hi
+			p.advance()
+			hiExpr, ok := p.parseExpr()
+			if !ok {
+				return false
+			}
+			hiVal, ok := hiExpr.(NumExpr)
+			if !ok {
+				p.error(fmt.Sprintf("expected number value for end of field %s", bitName.val))
+				return false
+			}
+			lo, hi := min(bitVal.Value, hiVal.Value), max(bitVal.Value, hiVal.Value)
+			// An enum the field holds members of, unless the name
+			// starts the next bit.
+			enum := ""
+			if p.current().ty == IDENT && p.peekNext().ty != COLON {
+				enum = p.current().val
+				p.advance()
+			}
+			if lo < 0 || hi > 7 {
+				p.diagnostics = append(p.diagnostics, Diagnostic{
+					Code:    ErrInvalidNumber,
+					Message: fmt.Sprintf("field %s must lie within bits 0..7", bitName.val),
+					Range:   Range{Start: bitName.Range.Start, End: hiExpr.Position().End},
+				})
+				continue
+			}
+			fields[bitName.val] = BitField{Lo: lo, Hi: hi, Enum: enum}
 		}
+		end := p.current().Range.End
 		p.advance() // ]
-		prog.SFRs[name] = SFR{Address: val.Value, Bits: bits}
-	} else {
-		// Simple constant
+		prog.SFRs[name] = SFR{Address: val.Value, Bits: bits, Fields: fields, Range: Range{Start: nameTok.Range.Start, End: end}}
+	} else if _, ok := p.defines[name]; !ok {
+		// Simple constant, unless overridden with -D
 		prog.Consts[name] = val.Value
+		if val.Unit != NoUnit {
+			prog.Units[name] = val.Unit
+		}
 	}
 	return true
 }
 
+func (p *parser) parseEnum(prog *Program) bool {
+	// ENUM IDENT[name] LBRACK (IDENT[member] (COLON Expr)?)* RBRACK
+	start := p.current().Range.Start
+	p.advance() // ENUM
+	nameTok, ok := p.expect(IDENT, fmt.Sprintf("expected enum name, got %s", p.current().String()))
+	if !ok {
+		return false
+	}
+	if _, ok := p.expect(LBRACK, fmt.Sprintf("expected [ after enum %s", nameTok.val)); !ok {
+		return false
+	}
+
+	enum := Enum{Name: nameTok.val}
+	next := 0
+	for p.current().ty != RBRACK {
+		member, ok := p.expect(IDENT, fmt.Sprintf("expected enum member, got %s", p.current().String()))
+		if !ok {
+			return false
+		}
+		if p.current().ty == COLON {
+			p.advance()
+			valExpr, ok := p.parseExpr()
+			if !ok {
+				return false
+			}
+			val, ok := valExpr.(NumExpr)
+			if !ok {
+				p.error(fmt.Sprintf("expected number value for enum member %s", member.val))
+				return false
+			}
+			next = val.Value
+		}
+		if next < 0 || next > 0xFF {
+			p.diagnostics = append(p.diagnostics, Diagnostic{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("enum member %s = %d does not fit in i8", member.val, next),
+				Range:   member.Range,
+			})
+		}
+		if prev, ok := prog.EnumMembers[member.val]; ok {
+			p.diagnostics = append(p.diagnostics, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("%s is already a member of enum %s", member.val, prev.Enum),
+				Range:   member.Range,
+			})
+			continue
+		}
+		prog.EnumMembers[member.val] = EnumMember{Enum: enum.Name, Value: next}
+		enum.Members = append(enum.Members, member.val)
+		next++
+	}
+	enum.Range = Range{Start: start, End: p.current().Range.End}
+	p.advance() // ]
+	prog.Enums[enum.Name] = enum
+	return true
+}
+
+func (p *parser) parseTable(prog *Program) bool {
+	// TABLE IDENT[name] LBRACK IDENT[function]* RBRACK
+	start := p.current().Range.Start
+	p.advance() // TABLE
+	nameTok, ok := p.expect(IDENT, fmt.Sprintf("expected table name, got %s", p.current().String()))
+	if !ok {
+		return false
+	}
+	if _, ok := p.expect(LBRACK, fmt.Sprintf("expected [ after table %s", nameTok.val)); !ok {
+		return false
+	}
+
+	table := FuncTable{Name: nameTok.val}
+	for p.current().ty != RBRACK {
+		entry, ok := p.expect(IDENT, fmt.Sprintf("expected function name, got %s", p.current().String()))
+		if !ok {
+			return false
+		}
+		table.Entries = append(table.Entries, entry.val)
+	}
+	table.Range = Range{Start: start, End: p.current().Range.End}
+	p.advance() // ]
+	if len(table.Entries) == 0 {
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("table %s has no entries", table.Name),
+			Range:   table.Range,
+		})
+	}
+	if len(table.Entries) > 256 {
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("table %s has %d entries, more than an i8 can index", table.Name, len(table.Entries)),
+			Range:   table.Range,
+		})
+	}
+	if _, ok := prog.Tables[table.Name]; ok {
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("table %s is already declared", table.Name),
+			Range:   nameTok.Range,
+		})
+	}
+	prog.Tables[table.Name] = table
+	return true
+}
+
 func (p *parser) parseFunction() (Function, bool) {
-	// FN IDENT[name] LPAREN RPAREN BEGIN Stmt* END
+	// FN IDENT[name] LPAREN RPAREN (BEGIN Stmt* END | INDENT Stmt* DEDENT)
 	// TODO: should probably require functions to have at least one stmt
 	result := Function{
 		Body: []Stmt{},
@@ -538,32 +1366,37 @@ func (p *parser) parseFunction() (Function, bool) {
 		return result, false
 	}
 
-	if _, ok := p.expect(BEGIN, fmt.Sprintf("who starts a function with '%v'!? I just sat down!", p.current().String())); !ok {
+	if !p.atBody() {
+		p.error(fmt.Sprintf("who starts a function with '%v'!? I just sat down!", p.current().String()))
 		return result, false
 	}
 
-	for {
-		switch p.current().ty {
-		case EOF:
-			p.error("alas, functions must come to an END")
-			return result, false
-		case END:
-			result.Range = Range{Start: start, End: p.current().Range.End}
-			p.advance()
-			return result, true
-		default:
-			stmt, ok := p.parseStmt()
-			if !ok {
-				// Skip to next statement or end
-				// Simple recovery: skip until semicolon (if we had them) or keyword
-				// For now, maybe just skip one token? Or skip until a statement start?
-				// Let's just skip one token for now to avoid infinite loops if we don't advance
-				p.advance()
-				continue
-			}
-			result.Body = append(result.Body, stmt)
-		}
+	body, end, ok := p.parseBody("alas, functions must come to an END")
+	if !ok {
+		return result, false
+	}
+	result.Body = body
+	result.Range = Range{Start: start, End: end}
+	return result, true
+}
+
+func (p *parser) parseTask() (Task, bool) {
+	// TASK IDENT[name] (BEGIN Stmt* END | INDENT Stmt* DEDENT)
+	start := p.current().Range.Start
+	p.advance() // TASK
+	name, ok := p.expect(IDENT, fmt.Sprintf("expected task name, got %s", p.current().String()))
+	if !ok {
+		return Task{}, false
+	}
+	if !p.atBody() {
+		p.error(fmt.Sprintf("expected begin after task %s, got %s", name.val, p.current().String()))
+		return Task{}, false
 	}
+	body, end, ok := p.parseBody(fmt.Sprintf("expected end after task %s", name.val))
+	if !ok {
+		return Task{}, false
+	}
+	return Task{Name: name.val, Body: body, Range: Range{Start: start, End: end}}, true
 }
 
 func (p *parser) parseStmt() (Stmt, bool) {
@@ -585,6 +1418,24 @@ func (p *parser) parseStmt() (Stmt, bool) {
 		return p.parseReturnStmt()
 	case IF:
 		return p.parseIfStmt()
+	case DELAY:
+		return p.parseDelayStmt()
+	case BEGIN, INDENT:
+		return p.parseBlock()
+	case CASE:
+		return p.parseCaseStmt()
+	case WHEN:
+		return p.parseWhenStmt()
+	case ATOMIC:
+		return p.parseAtomicStmt()
+	case YIELD:
+		tok := p.current()
+		p.advance()
+		return YieldStmt{Range: tok.Range}, true
+	case WAIT:
+		return p.parseWaitStmt()
+	case WITHIN, EXACTLY:
+		return p.parseTimedStmt()
 	default:
 		p.error(fmt.Sprintf("unexpected token %s in statement", p.current().String()))
 		return nil, false
@@ -611,6 +1462,323 @@ func (p *parser) parseIfStmt() (Stmt, bool) {
 	return IfStmt{Cond: cond, Then: stmt, Range: Range{Start: start, End: stmt.Position().End}}, true
 }
 
+func (p *parser) parseBlock() (Stmt, bool) {
+	// BEGIN Stmt* END | INDENT Stmt* DEDENT
+	start := p.current().Range.Start
+	body, end, ok := p.parseBody("expected end after block")
+	if !ok {
+		return nil, false
+	}
+	return BlockStmt{Body: body, Range: Range{Start: start, End: end}}, true
+}
+
+// parseWhen parses WHEN Expr BEGIN, or WHEN Expr INDENT, and reports whether the condition
+// holds. If it does, the caller parses the body as usual and then calls
+// endWhen; if not, the body has been skipped without being parsed.
+func (p *parser) parseWhen() bool {
+	p.advance() // WHEN
+	cond, ok := p.parseExpr()
+	if !ok {
+		return false
+	}
+	if !p.atBody() {
+		p.error(fmt.Sprintf("expected begin after when condition, got %s", p.current().String()))
+		return false
+	}
+	closer := END
+	if p.current().ty == INDENT {
+		closer = DEDENT
+	}
+	p.advance()
+	if val, ok := p.constValue(cond); !ok || val == 0 {
+		p.skipBlock(closer)
+		return false
+	}
+	p.whens = append(p.whens, closer)
+	return true
+}
+
+func (p *parser) endWhen() {
+	closer := p.whens[len(p.whens)-1]
+	p.whens = p.whens[:len(p.whens)-1]
+	p.expect(closer, fmt.Sprintf("expected end after when block, got %s", p.current().String()))
+}
+
+// skipBlock skips past the closer matching a BEGIN or INDENT that has
+// already been consumed. Case statements are the one construct closed by
+// END without a BEGIN of their own.
+func (p *parser) skipBlock(closer TTy) {
+	open, close := BEGIN, END
+	if closer == DEDENT {
+		open, close = INDENT, DEDENT
+	}
+	depth := 1
+	for ; p.current().ty != EOF; p.advance() {
+		switch ty := p.current().ty; {
+		case ty == open, ty == CASE && closer == END:
+			depth++
+		case ty == close:
+			depth--
+			if depth == 0 {
+				p.advance()
+				return
+			}
+		}
+	}
+}
+
+// constValue evaluates the condition of a when block. Only numbers,
+// enum members and constants declared before the when can be used,
+// combined with arithmetic, comparisons, not, and, and or.
+func (p *parser) constValue(e Expr) (int, bool) {
+	truth := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	name, _ := getIdent(e)
+	if n, ok := e.(NumExpr); ok && n.Unit != NoUnit || p.prog.Units[name] != NoUnit {
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("when can't use %v, which has a unit", e),
+			Range:   e.Position(),
+		})
+		return 0, false
+	}
+	switch e := e.(type) {
+	case NumExpr:
+		return e.Value, true
+	case IdentExpr:
+		if val, ok := p.prog.Consts[e.Name]; ok {
+			return val, true
+		}
+		if m, ok := p.prog.EnumMembers[e.Name]; ok {
+			return m.Value, true
+		}
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Code:    ErrUndefinedSymbol,
+			Message: fmt.Sprintf("%s is not a constant declared before this when", e.Name),
+			Range:   e.Range,
+		})
+		return 0, false
+	case UnaryExpr:
+		switch e.Op {
+		case NOT:
+			val, ok := p.constValue(e.Expr)
+			return truth(val == 0), ok
+		case HASH:
+			return p.constValue(e.Expr)
+		}
+	case BinaryExpr:
+		a, ok := p.constValue(e.Lhs)
+		if !ok {
+			return 0, false
+		}
+		b, ok := p.constValue(e.Rhs)
+		if !ok {
+			return 0, false
+		}
+		switch e.Op {
+		case AND:
+			return truth(a != 0 && b != 0), true
+		case OR:
+			return truth(a != 0 || b != 0), true
+		case EQEQ:
+			return truth(a == b), true
+		case NEQ:
+			return truth(a != b), true
+		case LT, GT, LE, GE:
+			return truth(compareOp(e.Op, a, b)), true
+		}
+		if val, ok := foldOp(e.Op, a, b); ok && isArith(e.Op) {
+			return val, true
+		}
+	}
+	p.diagnostics = append(p.diagnostics, Diagnostic{
+		Code:    ErrType,
+		Message: fmt.Sprintf("when needs a constant condition, got %v", e),
+		Range:   e.Position(),
+	})
+	return 0, false
+}
+
+func (p *parser) parseWhenStmt() (Stmt, bool) {
+	// WHEN Expr BEGIN Stmt* END
+	start := p.current().Range.Start
+	block := BlockStmt{Body: []Stmt{}}
+	if p.parseWhen() {
+		for !p.sectionDone() {
+			stmt, ok := p.parseStmt()
+			if !ok {
+				p.advance()
+				continue
+			}
+			block.Body = append(block.Body, stmt)
+		}
+		p.endWhen()
+	}
+	block.Range = Range{Start: start, End: p.previous().Range.End}
+	return block, true
+}
+
+func (p *parser) parseWaitStmt() (Stmt, bool) {
+	// WAIT UNTIL Expr
+	start := p.current().Range.Start
+	p.advance() // WAIT
+	if _, ok := p.expect(UNTIL, fmt.Sprintf("expected until after wait, got %s", p.current().String())); !ok {
+		return nil, false
+	}
+	cond, ok := p.parseExpr()
+	if !ok {
+		return nil, false
+	}
+	return WaitStmt{Cond: cond, Range: Range{Start: start, End: cond.Position().End}}, true
+}
+
+func (p *parser) parseAtomicStmt() (Stmt, bool) {
+	// ATOMIC BEGIN Stmt* END
+	start := p.current().Range.Start
+	p.advance() // ATOMIC
+	if !p.atBody() {
+		p.error(fmt.Sprintf("expected begin after atomic, got %s", p.current().String()))
+		return nil, false
+	}
+	block, ok := p.parseBlock()
+	if !ok {
+		return nil, false
+	}
+	return AtomicStmt{Body: block.(BlockStmt).Body, Range: Range{Start: start, End: block.Position().End}}, true
+}
+
+func (p *parser) parseTimedStmt() (Stmt, bool) {
+	// (WITHIN | EXACTLY) Expr IDENT[unit]? BEGIN Stmt* END
+	start := p.current().Range.Start
+	s := TimedStmt{Exact: p.current().ty == EXACTLY}
+	p.advance()
+	amount, ok := p.parseExpr()
+	if !ok {
+		return nil, false
+	}
+	s.Amount = amount
+	if unit := p.current(); unit.ty == IDENT && (unit.val == "cycles" || delayUnits[unit.val] != 0) {
+		s.Unit = unit.val
+		p.advance()
+	}
+	if !p.atBody() {
+		p.error(fmt.Sprintf("expected begin after %s %v, got %s", s.kind(), amount, p.current().String()))
+		return nil, false
+	}
+	block, ok := p.parseBlock()
+	if !ok {
+		return nil, false
+	}
+	s.Body = block.(BlockStmt).Body
+	s.Range = Range{Start: start, End: block.Position().End}
+	return s, true
+}
+
+func (p *parser) parseCaseStmt() (Stmt, bool) {
+	// CASE Expr OF (Expr (COMMA Expr)* COLON Stmt)* (ELSE Stmt*)? END
+	// The arms may be indented, with or without the else.
+	start := p.current().Range.Start
+	p.advance() // CASE
+	subject, ok := p.parseExpr()
+	if !ok {
+		return nil, false
+	}
+	if _, ok := p.expect(OF, fmt.Sprintf("expected of, got %s", p.current().String())); !ok {
+		return nil, false
+	}
+
+	indented := p.current().ty == INDENT
+	if indented {
+		p.advance()
+	}
+
+	s := CaseStmt{Subject: subject}
+	for p.current().ty != ELSE && p.current().ty != END && p.current().ty != DEDENT && p.current().ty != EOF {
+		var arm CaseArm
+		for {
+			v, ok := p.parseExpr()
+			if !ok {
+				return nil, false
+			}
+			arm.Values = append(arm.Values, v)
+			if p.current().ty != COMMA {
+				break
+			}
+			p.advance()
+		}
+		if _, ok := p.expect(COLON, fmt.Sprintf("expected : after case value, got %s", p.current().String())); !ok {
+			return nil, false
+		}
+		body, ok := p.parseStmt()
+		if !ok {
+			return nil, false
+		}
+		arm.Body = body
+		s.Arms = append(s.Arms, arm)
+	}
+
+	if indented && p.current().ty == DEDENT {
+		p.advance()
+		indented = false
+	}
+	if p.current().ty == ELSE {
+		p.advance()
+		s.Else = []Stmt{}
+		for p.current().ty != END && p.current().ty != DEDENT && p.current().ty != EOF {
+			stmt, ok := p.parseStmt()
+			if !ok {
+				p.advance()
+				continue
+			}
+			s.Else = append(s.Else, stmt)
+		}
+	}
+
+	if indented {
+		if _, ok := p.expect(DEDENT, fmt.Sprintf("expected end after case, got %s", p.current().String())); !ok {
+			return nil, false
+		}
+	}
+	endTok, ok := p.expect(END, "expected end after case")
+	if !ok {
+		return nil, false
+	}
+	s.Range = Range{Start: start, End: endTok.Range.End}
+	return s, true
+}
+
+// delayUnits maps the units accepted by delay to their fraction of a second.
+// "cycles" is handled separately since it doesn't depend on the clock.
+var delayUnits = map[string]int64{
+	"s":  1,
+	"ms": 1_000,
+	"us": 1_000_000,
+	"ns": 1_000_000_000,
+}
+
+func (p *parser) parseDelayStmt() (Stmt, bool) {
+	// DELAY Expr IDENT[unit]?
+	// The unit can be left out if the amount has one, as in delay 1ms.
+	start := p.current().Range.Start
+	p.advance() // DELAY
+	amount, ok := p.parseExpr()
+	if !ok {
+		return nil, false
+	}
+
+	unit := p.current()
+	if _, ok := delayUnits[unit.val]; unit.ty != IDENT || (!ok && unit.val != "cycles") {
+		return DelayStmt{Amount: amount, Range: Range{Start: start, End: amount.Position().End}}, true
+	}
+	p.advance()
+
+	return DelayStmt{Amount: amount, Unit: unit.val, Range: Range{Start: start, End: unit.Range.End}}, true
+}
+
 func (p *parser) parseAssignStmt() (Stmt, bool) {
 	// IDENT = Expr
 	name, ok := p.expect(IDENT, fmt.Sprintf("expected identifier, got %s", p.current().String()))
@@ -633,6 +1801,16 @@ func (p *parser) parseAssignStmt() (Stmt, bool) {
 		lhs = IndexExpr{Name: name.val, Index: idx, Range: Range{Start: name.Range.Start, End: endTok.Range.End}}
 	}
 
+	// name[i]() calls through a function table.
+	if idx, ok := lhs.(IndexExpr); ok && p.current().ty == LPAREN {
+		p.advance()
+		endTok, ok := p.expect(RPAREN, "expected ) after call arguments")
+		if !ok {
+			return nil, false
+		}
+		return CallStmt{Name: idx.Name, Index: idx.Index, Range: Range{Start: idx.Range.Start, End: endTok.Range.End}}, true
+	}
+
 	op := p.current()
 	switch op.ty {
 	case EQL, ADDEQL, SUBEQL, ANDEQL, OREQL, XOREQL:
@@ -679,27 +1857,58 @@ func (p *parser) parseExpr() (Expr, bool) {
 	return p.parseBinaryExpr()
 }
 
+// binaryPrec gives the precedence of each binary operator.
+// Higher binds tighter.
+var binaryPrec = map[TTy]int{
+	OR:      1,
+	AND:     2,
+	EQEQ:    3,
+	NEQ:     3,
+	LT:      3,
+	GT:      3,
+	LE:      3,
+	GE:      3,
+	PIPE:    4,
+	CARET:   5,
+	AMP:     6,
+	SHL:     7,
+	SHR:     7,
+	PLUS:    8,
+	MINUS:   8,
+	STAR:    9,
+	SLASH:   9,
+	PERCENT: 9,
+}
+
 func (p *parser) parseBinaryExpr() (Expr, bool) {
+	return p.parseBinaryPrec(1)
+}
+
+// parseBinaryPrec parses a chain of left-associative binary operators
+// binding at least as tightly as minPrec.
+func (p *parser) parseBinaryPrec(minPrec int) (Expr, bool) {
 	lhs, ok := p.parseUnaryExpr()
 	if !ok {
 		return nil, false
 	}
 
-	for p.current().ty == NEQ {
+	for {
 		opTok := p.current()
-		op := opTok.ty
+		prec, ok := binaryPrec[opTok.ty]
+		if !ok || prec < minPrec {
+			return lhs, true
+		}
 		p.advance()
-		rhs, ok := p.parseUnaryExpr()
+		rhs, ok := p.parseBinaryPrec(prec + 1)
 		if !ok {
 			return nil, false
 		}
-		lhs = BinaryExpr{Lhs: lhs, Op: op, Rhs: rhs, Range: Range{Start: lhs.Position().Start, End: rhs.Position().End}}
+		lhs = BinaryExpr{Lhs: lhs, Op: opTok.ty, Rhs: rhs, Range: Range{Start: lhs.Position().Start, End: rhs.Position().End}}
 	}
-	return lhs, true
 }
 
 func (p *parser) parseUnaryExpr() (Expr, bool) {
-	if p.current().ty == NOT {
+	if ty := p.current().ty; ty == NOT || ty == AMP || ty == HASH {
 		opTok := p.current()
 		op := opTok.ty
 		p.advance()
@@ -763,7 +1972,12 @@ func (p *parser) parsePrimaryExpr() (Expr, bool) {
 			return nil, false
 		}
 		p.advance()
-		return NumExpr{Val: tok.val, Value: val, Ty: tok.ty, Range: tok.Range}, true
+		n := NumExpr{Val: tok.val, Value: val, Ty: tok.ty, Range: tok.Range}
+		if tok.ty == NUMUNIT {
+			_, suffix := splitUnit(tok.val)
+			n.Unit = unitSuffixes[suffix].unit
+		}
+		return n, true
 	}
 	switch tok.ty {
 	case IDENT:
@@ -798,7 +2012,7 @@ func getIdent(e Expr) (string, bool) {
 }
 
 func getNum(e Expr) (int, bool) {
-	if num, ok := e.(NumExpr); ok {
+	if num, ok := e.(NumExpr); ok && num.Unit == NoUnit {
 		return num.Value, true
 	}
 	return 0, false
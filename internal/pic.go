@@ -29,6 +29,39 @@ const (
 	DestF = 1
 )
 
+// Core registers are mapped into every bank at the same offsets.
+const (
+	regINDF0  = 0x00
+	regINDF1  = 0x01
+	regPCL    = 0x02
+	regSTATUS = 0x03
+	regFSR0L  = 0x04
+	regFSR0H  = 0x05
+	regFSR1L  = 0x06
+	regFSR1H  = 0x07
+	regBSR    = 0x08
+	regWREG   = 0x09
+	regPCLATH = 0x0A
+	regINTCON = 0x0B
+)
+
+// STATUS bits
+const (
+	statusC  = 0
+	statusDC = 1
+	statusZ  = 2
+)
+
+// INTCON bits
+const (
+	intconGIE = 7
+)
+
+// hexAddr formats a register address the way generated code refers to it.
+func hexAddr(addr int) string {
+	return fmt.Sprintf("0x%X", addr)
+}
+
 // LabelOp is a pseudo-op for labels
 type LabelOp struct {
 	Name string
@@ -42,8 +75,6 @@ func (op LabelOp) Encode(ctx *AssemblerContext) error {
 	// Record label address (current PC)
 	// PC is len(ctx.Words)
 	ctx.Symbols.SetAddress(op.Name, len(ctx.Words))
-	// Reset bank state because we don't know where we came from
-	ctx.CurrentBank = -1
 	return nil
 }
 
@@ -69,6 +100,33 @@ func (op OrgOp) Encode(ctx *AssemblerContext) error {
 	return nil
 }
 
+// CommentOp is a pseudo-op that annotates the listing and emits no code
+type CommentOp struct {
+	Text string
+}
+
+func (op CommentOp) Assembly() string {
+	return "; " + op.Text
+}
+
+func (op CommentOp) Encode(ctx *AssemblerContext) error {
+	return nil
+}
+
+// DataWord is a pseudo-op that places a 14-bit word of data
+type DataWord struct {
+	K int
+}
+
+func (op DataWord) Assembly() string {
+	return fmt.Sprintf(" DW 0x%X", op.K)
+}
+
+func (op DataWord) Encode(ctx *AssemblerContext) error {
+	ctx.Emit(uint16(op.K) & 0x3FFF)
+	return nil
+}
+
 // CallOp calls a subroutine
 type CallOp struct {
 	Label string
@@ -82,11 +140,39 @@ func (op CallOp) Encode(ctx *AssemblerContext) error {
 	// CALL is 10 0kkk kkkk kkkk
 	ctx.AddFixup(op.Label, 0x07FF)
 	ctx.Emit(0x2000)
-	// Reset bank state after call?
-	// Usually CALL preserves bank or callee handles it.
-	// But when we return, we might be in a different bank if callee changed it and didn't restore.
-	// Safe assumption: bank is unknown after CALL.
-	ctx.CurrentBank = -1
+	return nil
+}
+
+// ADDLW k
+// Add literal and W
+type Addlw struct {
+	K int
+}
+
+func (op Addlw) Assembly() string {
+	return fmt.Sprintf("ADDLW %d", op.K)
+}
+
+func (op Addlw) Encode(ctx *AssemblerContext) error {
+	// 11 1110 kkkk kkkk
+	ctx.Emit(0x3E00 | (uint16(op.K) & 0xFF))
+	return nil
+}
+
+// ADDLW LOW label
+// Add the low byte of a label's address to W
+type AddlwLow struct {
+	Label string
+}
+
+func (op AddlwLow) Assembly() string {
+	return fmt.Sprintf("ADDLW LOW %s", op.Label)
+}
+
+func (op AddlwLow) Encode(ctx *AssemblerContext) error {
+	// 11 1110 kkkk kkkk
+	ctx.AddShiftedFixup(op.Label, 0, 0xFF)
+	ctx.Emit(0x3E00)
 	return nil
 }
 
@@ -112,6 +198,28 @@ func (op Addwf) Encode(ctx *AssemblerContext) error {
 	return nil
 }
 
+// ADDWFC f,d
+// Add W and Carry to F
+type Addwfc struct {
+	F string
+	D int
+}
+
+func (op Addwfc) Assembly() string {
+	return fmt.Sprintf("ADDWFC %s,%d", op.F, op.D)
+}
+
+func (op Addwfc) Encode(ctx *AssemblerContext) error {
+	// 11 1101 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x3D00 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
 // ADDFSR fsrn, k
 // Add literal k to FSRn
 type Addfsr struct {
@@ -191,6 +299,20 @@ func (op Bcf) Encode(ctx *AssemblerContext) error {
 	return nil
 }
 
+// BRW
+// Relative Branch with W
+type Brw struct{}
+
+func (op Brw) Assembly() string {
+	return "BRW"
+}
+
+func (op Brw) Encode(ctx *AssemblerContext) error {
+	// 00 0000 0000 1011
+	ctx.Emit(0x000B)
+	return nil
+}
+
 // BSF f,b
 // Bit Set F
 type Bsf struct {
@@ -257,6 +379,63 @@ func (op Btfss) Encode(ctx *AssemblerContext) error {
 	return nil
 }
 
+// CALLW
+// Call Subroutine with W
+type Callw struct{}
+
+func (op Callw) Assembly() string {
+	return "CALLW"
+}
+
+func (op Callw) Encode(ctx *AssemblerContext) error {
+	// 00 0000 0000 1010
+	ctx.Emit(0x000A)
+	return nil
+}
+
+// CLRF f
+// Clear F
+type Clrf struct {
+	F string
+}
+
+func (op Clrf) Assembly() string {
+	return fmt.Sprintf("CLRF %s", op.F)
+}
+
+func (op Clrf) Encode(ctx *AssemblerContext) error {
+	// 00 0001 1fff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x0180 | (uint16(f) & 0x7F))
+	return nil
+}
+
+// DECF f,d
+// Decrement F
+type Decf struct {
+	F string
+	D int
+}
+
+func (op Decf) Assembly() string {
+	return fmt.Sprintf("DECF %s,%d", op.F, op.D)
+}
+
+func (op Decf) Encode(ctx *AssemblerContext) error {
+	// 00 0011 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x0300 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
 // DECFSZ f,d
 // Decrement F, Skip if Zero
 type Decfsz struct {
@@ -279,6 +458,28 @@ func (op Decfsz) Encode(ctx *AssemblerContext) error {
 	return nil
 }
 
+// INCF f,d
+// Increment F
+type Incf struct {
+	F string
+	D int
+}
+
+func (op Incf) Assembly() string {
+	return fmt.Sprintf("INCF %s,%d", op.F, op.D)
+}
+
+func (op Incf) Encode(ctx *AssemblerContext) error {
+	// 00 1010 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x0A00 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
 // INCFSZ f,d
 // Increment F, Skip if Zero
 type Incfsz struct {
@@ -301,6 +502,148 @@ func (op Incfsz) Encode(ctx *AssemblerContext) error {
 	return nil
 }
 
+// IORLW k
+// Inclusive OR literal with W
+type Iorlw struct {
+	K int
+}
+
+func (op Iorlw) Assembly() string {
+	return fmt.Sprintf("IORLW %d", op.K)
+}
+
+func (op Iorlw) Encode(ctx *AssemblerContext) error {
+	// 11 1000 kkkk kkkk
+	ctx.Emit(0x3800 | (uint16(op.K) & 0xFF))
+	return nil
+}
+
+// IORWF f,d
+// Inclusive OR W with F
+type Iorwf struct {
+	F string
+	D int
+}
+
+func (op Iorwf) Assembly() string {
+	return fmt.Sprintf("IORWF %s,%d", op.F, op.D)
+}
+
+func (op Iorwf) Encode(ctx *AssemblerContext) error {
+	// 00 0100 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x0400 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
+// LSLF f,d
+// Logical Left Shift F
+type Lslf struct {
+	F string
+	D int
+}
+
+func (op Lslf) Assembly() string {
+	return fmt.Sprintf("LSLF %s,%d", op.F, op.D)
+}
+
+func (op Lslf) Encode(ctx *AssemblerContext) error {
+	// 11 0101 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x3500 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
+// LSRF f,d
+// Logical Right Shift F
+type Lsrf struct {
+	F string
+	D int
+}
+
+func (op Lsrf) Assembly() string {
+	return fmt.Sprintf("LSRF %s,%d", op.F, op.D)
+}
+
+func (op Lsrf) Encode(ctx *AssemblerContext) error {
+	// 11 0110 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x3600 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
+// RLF f,d
+// Rotate Left F through Carry
+type Rlf struct {
+	F string
+	D int
+}
+
+func (op Rlf) Assembly() string {
+	return fmt.Sprintf("RLF %s,%d", op.F, op.D)
+}
+
+func (op Rlf) Encode(ctx *AssemblerContext) error {
+	// 00 1101 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x0D00 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
+// RRF f,d
+// Rotate Right F through Carry
+type Rrf struct {
+	F string
+	D int
+}
+
+func (op Rrf) Assembly() string {
+	return fmt.Sprintf("RRF %s,%d", op.F, op.D)
+}
+
+func (op Rrf) Encode(ctx *AssemblerContext) error {
+	// 00 1100 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x0C00 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
+// RETLW k
+// Return with literal in W
+type Retlw struct {
+	K int
+}
+
+func (op Retlw) Assembly() string {
+	return fmt.Sprintf("RETLW %d", op.K)
+}
+
+func (op Retlw) Encode(ctx *AssemblerContext) error {
+	// 11 0100 kkkk kkkk
+	ctx.Emit(0x3400 | (uint16(op.K) & 0xFF))
+	return nil
+}
+
 // RETURN
 // Return from Subroutine
 type Return struct{}
@@ -312,16 +655,53 @@ func (op Return) Assembly() string {
 func (op Return) Encode(ctx *AssemblerContext) error {
 	// 00 0000 0000 1000
 	ctx.Emit(0x0008)
-	// Bank unknown after return?
-	// No, return pops PC, doesn't change bank.
-	// But we are returning to caller.
-	// The caller's bank state is what matters.
-	// Since we are in a linear flow here, we don't know where we return to.
-	// But this instruction itself doesn't change bank.
-	// However, execution stops here (or goes to caller).
-	// So subsequent instructions (if any, unreachable?) start with unknown bank?
-	// Let's say yes.
-	ctx.CurrentBank = -1
+	return nil
+}
+
+// RETFIE
+// Return from Interrupt
+type Retfie struct{}
+
+func (op Retfie) Assembly() string {
+	return "RETFIE"
+}
+
+func (op Retfie) Encode(ctx *AssemblerContext) error {
+	// 00 0000 0000 1001
+	ctx.Emit(0x0009)
+	return nil
+}
+
+// MOVLP k
+// Move literal to PCLATH
+type Movlp struct {
+	K int
+}
+
+func (op Movlp) Assembly() string {
+	return fmt.Sprintf("MOVLP 0x%X", op.K)
+}
+
+func (op Movlp) Encode(ctx *AssemblerContext) error {
+	// 11 0001 1kkk kkkk
+	ctx.Emit(0x3180 | (uint16(op.K) & 0x7F))
+	return nil
+}
+
+// MOVLP HIGH label
+// Move the high bits of a label's address to PCLATH
+type MovlpHigh struct {
+	Label string
+}
+
+func (op MovlpHigh) Assembly() string {
+	return fmt.Sprintf("MOVLP HIGH %s", op.Label)
+}
+
+func (op MovlpHigh) Encode(ctx *AssemblerContext) error {
+	// 11 0001 1kkk kkkk
+	ctx.AddShiftedFixup(op.Label, 8, 0x7F)
+	ctx.Emit(0x3180)
 	return nil
 }
 
@@ -342,6 +722,40 @@ func (op Movlw) Encode(ctx *AssemblerContext) error {
 	return nil
 }
 
+// MOVLW LOW label
+// Move the low byte of a label's address to W
+type MovlwLow struct {
+	Label string
+}
+
+func (op MovlwLow) Assembly() string {
+	return fmt.Sprintf("MOVLW LOW %s", op.Label)
+}
+
+func (op MovlwLow) Encode(ctx *AssemblerContext) error {
+	// 11 0000 kkkk kkkk
+	ctx.AddShiftedFixup(op.Label, 0, 0xFF)
+	ctx.Emit(0x3000)
+	return nil
+}
+
+// MOVLW HIGH label
+// Move the high byte of a label's address to W
+type MovlwHigh struct {
+	Label string
+}
+
+func (op MovlwHigh) Assembly() string {
+	return fmt.Sprintf("MOVLW HIGH %s", op.Label)
+}
+
+func (op MovlwHigh) Encode(ctx *AssemblerContext) error {
+	// 11 0000 kkkk kkkk
+	ctx.AddShiftedFixup(op.Label, 8, 0xFF)
+	ctx.Emit(0x3000)
+	return nil
+}
+
 // MOVF f,d
 // Move F
 type Movf struct {
@@ -385,6 +799,156 @@ func (op Movwf) Encode(ctx *AssemblerContext) error {
 	return nil
 }
 
+// Addressing modes of MOVIW and MOVWI.
+const (
+	PreInc  = 0 // ++FSRn
+	PreDec  = 1 // --FSRn
+	PostInc = 2 // FSRn++
+	PostDec = 3 // FSRn--
+)
+
+func fsrMode(fsr, mode int) string {
+	switch mode {
+	case PreInc:
+		return fmt.Sprintf("++FSR%d", fsr)
+	case PreDec:
+		return fmt.Sprintf("--FSR%d", fsr)
+	case PostInc:
+		return fmt.Sprintf("FSR%d++", fsr)
+	}
+	return fmt.Sprintf("FSR%d--", fsr)
+}
+
+// MOVIW FSRn++ (and the other modes)
+// Move INDFn to W, adjusting FSRn
+type Moviw struct {
+	FSR  int
+	Mode int
+}
+
+func (op Moviw) Assembly() string {
+	return "MOVIW " + fsrMode(op.FSR, op.Mode)
+}
+
+func (op Moviw) Encode(ctx *AssemblerContext) error {
+	// 00 0000 0001 0nmm
+	ctx.Emit(0x0010 | uint16(op.FSR&1)<<2 | uint16(op.Mode&3))
+	return nil
+}
+
+// MOVWI FSRn++ (and the other modes)
+// Move W to INDFn, adjusting FSRn
+type Movwi struct {
+	FSR  int
+	Mode int
+}
+
+func (op Movwi) Assembly() string {
+	return "MOVWI " + fsrMode(op.FSR, op.Mode)
+}
+
+func (op Movwi) Encode(ctx *AssemblerContext) error {
+	// 00 0000 0001 1nmm
+	ctx.Emit(0x0018 | uint16(op.FSR&1)<<2 | uint16(op.Mode&3))
+	return nil
+}
+
+// SUBLW k
+// Subtract W from literal
+type Sublw struct {
+	K int
+}
+
+func (op Sublw) Assembly() string {
+	return fmt.Sprintf("SUBLW %d", op.K)
+}
+
+func (op Sublw) Encode(ctx *AssemblerContext) error {
+	// 11 1100 kkkk kkkk
+	ctx.Emit(0x3C00 | (uint16(op.K) & 0xFF))
+	return nil
+}
+
+// SUBWF f,d
+// Subtract W from F
+type Subwf struct {
+	F string
+	D int
+}
+
+func (op Subwf) Assembly() string {
+	return fmt.Sprintf("SUBWF %s,%d", op.F, op.D)
+}
+
+func (op Subwf) Encode(ctx *AssemblerContext) error {
+	// 00 0010 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x0200 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
+// SUBWFB f,d
+// Subtract W from F with Borrow
+type Subwfb struct {
+	F string
+	D int
+}
+
+func (op Subwfb) Assembly() string {
+	return fmt.Sprintf("SUBWFB %s,%d", op.F, op.D)
+}
+
+func (op Subwfb) Encode(ctx *AssemblerContext) error {
+	// 11 1011 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x3B00 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
+// SWAPF f,d
+// Swap nibbles in F
+type Swapf struct {
+	F string
+	D int
+}
+
+func (op Swapf) Assembly() string {
+	return fmt.Sprintf("SWAPF %s,%d", op.F, op.D)
+}
+
+func (op Swapf) Encode(ctx *AssemblerContext) error {
+	// 00 1110 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x0E00 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
+	return nil
+}
+
+// NOP
+// No Operation
+type Nop struct{}
+
+func (op Nop) Assembly() string {
+	return "NOP"
+}
+
+func (op Nop) Encode(ctx *AssemblerContext) error {
+	// 00 0000 0000 0000
+	ctx.Emit(0x0000)
+	return nil
+}
+
 // GOTO k
 // Go to address
 type Goto struct {
@@ -399,6 +963,43 @@ func (op Goto) Encode(ctx *AssemblerContext) error {
 	// 10 1kkk kkkk kkkk
 	ctx.AddFixup(op.Label, 0x07FF)
 	ctx.Emit(0x2800)
-	ctx.CurrentBank = -1
+	return nil
+}
+
+// XORLW k
+// Exclusive OR literal with W
+type Xorlw struct {
+	K int
+}
+
+func (op Xorlw) Assembly() string {
+	return fmt.Sprintf("XORLW %d", op.K)
+}
+
+func (op Xorlw) Encode(ctx *AssemblerContext) error {
+	// 11 1010 kkkk kkkk
+	ctx.Emit(0x3A00 | (uint16(op.K) & 0xFF))
+	return nil
+}
+
+// XORWF f,d
+// Exclusive OR W with F
+type Xorwf struct {
+	F string
+	D int
+}
+
+func (op Xorwf) Assembly() string {
+	return fmt.Sprintf("XORWF %s,%d", op.F, op.D)
+}
+
+func (op Xorwf) Encode(ctx *AssemblerContext) error {
+	// 00 0110 dfff ffff
+	f, err := resolveAddr(ctx, op.F)
+	if err != nil {
+		return err
+	}
+	ctx.EnsureBank(f)
+	ctx.Emit(0x0600 | (uint16(op.D&1) << 7) | (uint16(f) & 0x7F))
 	return nil
 }
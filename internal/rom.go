@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Rom data is placed after the program, one word per byte with an i16
+// taking two, low byte first. FSR0 reads the low byte of a word of
+// program memory at $8000 plus its address, so name[i] points FSR0 at
+// the entry and reads it with MOVIW. A packed array holds two 7-bit
+// characters per word, the first in the high bits as with pic-as's DA.
+// FSR0 can't see the high bits, so name[i] reads a packed word through
+// the NVM registers instead, which are where PIC16F1xxx parts have them.
+
+const (
+	regPMADRL = 0x191
+	regPMADRH = 0x192
+	regPMDATL = 0x193
+	regPMDATH = 0x194
+	regPMCON1 = 0x195
+)
+
+// PMCON1 bits
+const (
+	pmcon1RD   = 0
+	pmcon1CFGS = 6
+)
+
+// romValues evaluates the entries of a, expanding strings into their
+// characters.
+func (c *asmGen) romValues(a RomArray) ([]int, error) {
+	var vals []int
+	for _, item := range a.Items {
+		if str, ok := item.(StringExpr); ok {
+			if a.Type != "i8" {
+				return nil, Diagnostic{
+					Code:    ErrType,
+					Message: fmt.Sprintf("%s is i16 rom data, which can't hold strings", a.Name),
+					Range:   str.Range,
+				}
+			}
+			for _, r := range str.Value {
+				if r > 0xFF || a.Packed && r > 0x7F {
+					return nil, Diagnostic{
+						Code:    ErrInvalidNumber,
+						Message: fmt.Sprintf("%q in %v does not fit in %s", r, str, a.entryKind()),
+						Range:   str.Range,
+					}
+				}
+				vals = append(vals, int(r))
+			}
+			continue
+		}
+		k, ok := c.literal(item)
+		if !ok {
+			return nil, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("rom data %s must be constant, got %v", a.Name, item),
+				Range:   item.Position(),
+			}
+		}
+		var err error
+		switch {
+		case a.Type == "i16" && (k < -0x8000 || k > 0xFFFF):
+			err = Diagnostic{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("%v = %d does not fit in 16 bits", item, k),
+				Range:   item.Position(),
+			}
+		case a.Packed && (k < 0 || k > 0x7F):
+			err = Diagnostic{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("%v = %d does not fit in %s", item, k, a.entryKind()),
+				Range:   item.Position(),
+			}
+		case a.Type == "i8":
+			err = checkByte(k, item)
+		}
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, k)
+	}
+
+	// The index is a byte, and an i16 entry takes two of them.
+	limit := 256
+	if a.Type == "i16" {
+		limit = 128
+	}
+	if len(vals) > limit {
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("rom data %s has %d entries, more than the %d an i8 can index", a.Name, len(vals), limit),
+			Range:   a.Range,
+		}
+	}
+	return vals, nil
+}
+
+func (a RomArray) entryKind() string {
+	if a.Packed {
+		return "7 bits"
+	}
+	return "8 bits"
+}
+
+func romLabel(name string) string {
+	return "_rom_" + name
+}
+
+// romOps returns the rom data of the program.
+func (c *asmGen) romOps() ([]PicOp, DiagnosticList) {
+	var names []string
+	for name := range c.prog.Rom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ops []PicOp
+	var diagnostics DiagnosticList
+	for _, name := range names {
+		a := c.prog.Rom[name]
+		vals, err := c.romValues(a)
+		if err != nil {
+			diagnostics = append(diagnostics, asDiagnostic(err, a.Range))
+			continue
+		}
+		ops = append(ops, LabelOp{Name: romLabel(name)})
+		switch {
+		case a.Packed:
+			for i := 0; i < len(vals); i += 2 {
+				w := vals[i] << 7
+				if i+1 < len(vals) {
+					w |= vals[i+1]
+				}
+				ops = append(ops, DataWord{K: w})
+			}
+		case a.Type == "i16":
+			for _, v := range vals {
+				ops = append(ops, DataWord{K: v & 0xFF}, DataWord{K: v >> 8 & 0xFF})
+			}
+		default:
+			for _, v := range vals {
+				ops = append(ops, DataWord{K: v & 0xFF})
+			}
+		}
+	}
+	return ops, diagnostics
+}
+
+// romIndex returns code that evaluates the index of e, an entry of a,
+// and points FSR0 at it, or for packed data, PMADR at its word.
+func (c *asmGen) romIndex(a RomArray, e IndexExpr, depth int) ([]PicOp, error) {
+	vals, err := c.romValues(a)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := c.literal(e.Index); ok && (k < 0 || k >= len(vals)) {
+		return nil, Diagnostic{
+			Code:    ErrInvalidNumber,
+			Message: fmt.Sprintf("index %d is out of range for rom data %s, which has %d entries", k, a.Name, len(vals)),
+			Range:   e.Index.Position(),
+		}
+	}
+	ops, err := c.evalW(e.Index, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	lo, hi := hexAddr(regFSR0L), hexAddr(regFSR0H)
+	if a.Packed {
+		lo, hi = hexAddr(regPMADRL), hexAddr(regPMADRH)
+	}
+	if a.Packed || a.Type == "i16" {
+		// Two entries to a word, or two words to an entry.
+		i := c.temp("romi")
+		ops = append(ops, Movwf{F: i})
+		if a.Packed {
+			ops = append(ops, Lsrf{F: i, D: DestW})
+		} else {
+			ops = append(ops, Lslf{F: i, D: DestW})
+		}
+	}
+	ops = append(ops,
+		AddlwLow{Label: romLabel(a.Name)},
+		Movwf{F: lo},
+		MovlwHigh{Label: romLabel(a.Name)},
+		Btfsc{F: hexAddr(regSTATUS), B: statusC},
+		Addlw{K: 1},
+		Movwf{F: hi},
+	)
+	if !a.Packed {
+		ops = append(ops, Bsf{F: hi, B: 7})
+	}
+	return ops, nil
+}
+
+// romRead returns code reading e, an entry of the i8 rom data a, into W.
+func (c *asmGen) romRead(a RomArray, e IndexExpr, depth int) ([]PicOp, error) {
+	if a.Type != "i8" {
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s holds i16s, so %v can only be assigned to an i16", a.Name, e),
+			Range:   e.Range,
+		}
+	}
+	ops, err := c.romIndex(a, e, depth)
+	if err != nil {
+		return nil, err
+	}
+	if a.Packed {
+		return append(ops, c.callHelper("_unpack")...), nil
+	}
+	return append(ops, Moviw{FSR: 0, Mode: PostInc}), nil
+}
+
+// romReadWord returns code copying e, an entry of the rom data a, into
+// the register pair lo, hi.
+func (c *asmGen) romReadWord(a RomArray, e IndexExpr, lo, hi string) ([]PicOp, error) {
+	if a.Type == "i8" {
+		ops, err := c.romRead(a, e, 0)
+		if err != nil {
+			return nil, err
+		}
+		return append(ops, Movwf{F: lo}, Clrf{F: hi}), nil
+	}
+	ops, err := c.romIndex(a, e, 0)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops,
+		Moviw{FSR: 0, Mode: PostInc},
+		Movwf{F: lo},
+		Moviw{FSR: 0, Mode: PostInc},
+		Movwf{F: hi},
+	), nil
+}
+
+// unpackOps reads the word at PMADR and returns the character of it
+// that _romi selects: the high one if _romi is even.
+func (c *asmGen) unpackOps() []PicOp {
+	i := c.temp("romi")
+	odd := c.newLabel("unpack_odd")
+	pmcon1 := hexAddr(regPMCON1)
+	return []PicOp{
+		Bcf{F: pmcon1, B: pmcon1CFGS},
+		Bsf{F: pmcon1, B: pmcon1RD},
+		Nop{}, // ignored while the read completes
+		Nop{},
+		Btfsc{F: i, B: 0},
+		Goto{Label: odd},
+		Lslf{F: hexAddr(regPMDATL), D: DestW},
+		Rlf{F: hexAddr(regPMDATH), D: DestW},
+		Return{},
+		LabelOp{Name: odd},
+		Movf{F: hexAddr(regPMDATL), D: DestW},
+		Andlw{K: 0x7F},
+		Return{},
+	}
+}
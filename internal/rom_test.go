@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const romData = `
+section constants
+seven: 7
+section data
+common:
+  i i8
+  x i8
+  wide i16
+rom:
+  digits i8 [ $3F $06 "AB\n" seven + 1 255 ]
+  scale i16 [ 1000 $ABCD ]
+  text i8 packed [ "Hello" ]
+section program
+`
+
+func TestParseRom(t *testing.T) {
+	toks, err := Lex(romData)
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	prog, err := Parse(toks)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(prog.Rom) != 3 || len(prog.Variables) != 3 {
+		t.Fatalf("expected 3 rom arrays and 3 variables, got %v and %v", prog.Rom, prog.Variables)
+	}
+	digits := prog.Rom["digits"]
+	if digits.Type != "i8" || digits.Packed || len(digits.Items) != 5 {
+		t.Errorf("unexpected digits: %+v", digits)
+	}
+	if s, ok := digits.Items[2].(StringExpr); !ok || s.Value != "AB\n" {
+		t.Errorf("expected the string AB\\n, got %v", digits.Items[2])
+	}
+	if a := prog.Rom["text"]; !a.Packed {
+		t.Errorf("expected text to be packed")
+	}
+
+	for _, tt := range []struct {
+		input string
+		msg   string
+	}{
+		{"section data\nrom:\n  a i16 packed [ 1 ]\n", "only i8 rom data can be packed"},
+		{"section data\nrom:\n  a state [ 1 ]\n", "expected i8 or i16 for rom data a"},
+		{"section data\nrom:\n  a i8 [ 1\n", "expected ] after rom data a"},
+		{"section data\nrom:\n  a i8 [ 1 ]\n  a i8 [ 2 ]\n", "rom data a is already declared"},
+		{"section data\nrom:\n  overlay begin a i8 end\n", "unexpected token in data section"},
+	} {
+		toks, err := Lex(tt.input)
+		if err != nil {
+			t.Fatalf("Lex failed: %v", err)
+		}
+		_, err = Parse(toks)
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.msg, err)
+		}
+	}
+}
+
+func TestLexString(t *testing.T) {
+	toks, err := Lex(`"a\"b\\c\t\0"`)
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	if toks[0].ty != STRING || toks[0].val != "a\"b\\c\t\x00" {
+		t.Errorf("unexpected token %v", toks[0])
+	}
+	for _, input := range []string{`"abc`, "\"ab\nc\"", `"\q"`} {
+		if _, err := Lex(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestCompileRom(t *testing.T) {
+	ops, _, err := compileBody(romData+`
+fn main() begin
+  x = digits[i]
+  fsr1 = scale
+  return
+end
+`, withStartup)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	var got []string
+	for _, op := range ops {
+		got = append(got, op.Assembly())
+	}
+	want := []string{
+		"main:",
+		"MOVF 0x70,0",
+		"ADDLW LOW _rom_digits",
+		"MOVWF 0x4",
+		"MOVLW HIGH _rom_digits",
+		"BTFSC 0x3,0",
+		"ADDLW 1",
+		"MOVWF 0x5",
+		"BSF 0x5,7",
+		"MOVIW FSR0++",
+		"MOVWF 0x73",
+		"MOVLW LOW _rom_scale",
+		"MOVWF 0x6",
+		"MOVLW HIGH _rom_scale",
+		"MOVWF 0x7",
+		"BSF 0x7,7",
+		"RETURN",
+	}
+	listing := strings.Join(got, "\n")
+	if !strings.Contains(listing, strings.Join(want, "\n")) {
+		t.Errorf("expected\n%s\nin\n%s", strings.Join(want, "\n"), listing)
+	}
+	data := " DW 0x3F\n DW 0x6\n DW 0x41\n DW 0x42\n DW 0xA\n DW 0x8\n DW 0xFF\n" +
+		"_rom_scale:\n DW 0xE8\n DW 0x3\n DW 0xCD\n DW 0xAB\n" +
+		"_rom_text:\n DW 0x2465\n DW 0x366C\n DW 0x3780"
+	if !strings.HasSuffix(listing, "_rom_digits:\n"+data) {
+		t.Errorf("expected the listing to end with the rom data, got\n%s", listing)
+	}
+}
+
+// TestRomSim reads every entry of every array back through the
+// generated code.
+func TestRomSim(t *testing.T) {
+	ops, syms, err := compileBody(romData+`
+fn main() begin
+  return
+end
+fn readdigit() begin
+  x = digits[i]
+  return
+end
+fn readscale() begin
+  wide = scale[i]
+  return
+end
+fn readtext() begin
+  x = text[i] + 1
+  return
+end
+fn widedigit() begin
+  wide = digits[i]
+  return
+end
+`, withStartup)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	rom, _, err := Assemble(ops, syms)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	addr := func(name string) string {
+		a, _ := syms.GetAddress(name)
+		return hexAddr(a)
+	}
+	wideAddr, _ := syms.GetAddress("wide")
+	read := func(fn string, i int) (x, wide int) {
+		regs := map[string]int{addr("i"): i, hexAddr(wideAddr + 1): 0xAA}
+		m := newCPU(t, ops, regs)
+		m.syms, m.rom = syms, rom
+		m.run(m.labels[fn])
+		return m.regs[addr("x")], m.regs[hexAddr(wideAddr)] | m.regs[hexAddr(wideAddr+1)]<<8
+	}
+	for i, want := range []int{0x3F, 0x06, 'A', 'B', '\n', 8, 0xFF} {
+		if got, _ := read("readdigit", i); got != want {
+			t.Errorf("digits[%d]: expected %d, got %d", i, want, got)
+		}
+		if _, got := read("widedigit", i); got != want {
+			t.Errorf("wide = digits[%d]: expected %d, got %d", i, want, got)
+		}
+	}
+	for i, want := range []int{1000, 0xABCD} {
+		if _, got := read("readscale", i); got != want {
+			t.Errorf("scale[%d]: expected %d, got %d", i, want, got)
+		}
+	}
+	for i, want := range "Hello" {
+		if got, _ := read("readtext", i); got != int(want)+1 {
+			t.Errorf("text[%d] + 1: expected %d, got %d", i, want+1, got)
+		}
+	}
+
+	worst := 0
+	for i := range 2 {
+		m := newCPU(t, ops, map[string]int{"_romi": i})
+		m.syms, m.rom = syms, rom
+		worst = max(worst, m.call("_unpack"))
+	}
+	if worst != helpers["_unpack"].cycles {
+		t.Errorf("_unpack: declared %d cycles, worst case is %d", helpers["_unpack"].cycles, worst)
+	}
+}
+
+func TestRomHex(t *testing.T) {
+	ops, syms, err := compileBody(romData+"fn main() begin\n  return\nend\n", withStartup)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	words, config, err := Assemble(ops, syms)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	text, _ := syms.GetAddress("_rom_text")
+	if words[text] != 'H'<<7|'e' || words[text+2] != 'o'<<7 {
+		t.Errorf("expected packed text at 0x%X, got 0x%X 0x%X", text, words[text], words[text+2])
+	}
+	var buf bytes.Buffer
+	if err := WriteHex(&buf, words, config); err != nil {
+		t.Fatalf("WriteHex failed: %v", err)
+	}
+	// Each word is two bytes, low byte first.
+	digits, _ := syms.GetAddress("_rom_digits")
+	var record string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		var n, a int
+		if _, err := fmt.Sscanf(line, ":%02X%04X00", &n, &a); err == nil && a <= digits*2 && digits*2 < a+n {
+			record = line[9+(digits*2-a)*2:]
+		}
+	}
+	if !strings.HasPrefix(record, "3F000600") {
+		t.Errorf("expected digits at byte 0x%X of the hex file, got %q\n%s", digits*2, record, buf.String())
+	}
+}
+
+// TestRomNamedLikeFunction checks that rom data keeps out of the way of
+// a function with the same name.
+func TestRomNamedLikeFunction(t *testing.T) {
+	ops, syms, err := compileBody("section data\nrom:\n  show i8 [ 1 2 ]\nsection program\n"+
+		"fn show() begin\n  return\nend\nfn main() begin\n  show()\nend\n", withStartup)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	words, _, err := Assemble(ops, syms)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	show, _ := syms.GetAddress("show")
+	if words[show] != 0x0008 {
+		t.Errorf("expected show to start with RETURN, got 0x%04X", words[show])
+	}
+	data, _ := syms.GetAddress("_rom_show")
+	if words[data] != 1 || words[data+1] != 2 {
+		t.Errorf("expected the rom data at 0x%X, got 0x%X 0x%X", data, words[data], words[data+1])
+	}
+}
+
+func TestRomErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		msg   string
+	}{
+		{"rom:\n  a i8 [ 256 ]", "does not fit in 8 bits"},
+		{"rom:\n  a i16 [ $10000 ]", "does not fit in 16 bits"},
+		{"rom:\n  a i16 [ \"ab\" ]", "a is i16 rom data, which can't hold strings"},
+		{"rom:\n  a i8 packed [ \"caf\xc3\xa9\" ]", "does not fit in 7 bits"},
+		{"rom:\n  a i8 packed [ 128 ]", "does not fit in 7 bits"},
+		{"common:\n  x i8\nrom:\n  a i8 [ x ]", "rom data a must be constant, got x"},
+		{"rom:\n  a i8 [ " + strings.Repeat("0 ", 257) + "]", "rom data a has 257 entries, more than the 256 an i8 can index"},
+		{"rom:\n  a i16 [ " + strings.Repeat("0 ", 129) + "]", "more than the 128 an i8 can index"},
+		{"common:\n  x i8\nrom:\n  a i8 [ 1 2 ]\nsection program\nfn main() begin\n  x = a[2]\nend", "index 2 is out of range for rom data a, which has 2 entries"},
+		{"common:\n  x i8\nrom:\n  a i16 [ 1 ]\nsection program\nfn main() begin\n  x = a[0]\nend", "a holds i16s, so a[0] can only be assigned to an i16"},
+		{"rom:\n  a i8 [ 1 ]\nsection program\nfn main() begin\n  a[0] = 1\nend", "a is rom data in program memory, not a register"},
+		{"common:\n  x i8\nrom:\n  a i8 [ 1 ]\nsection program\nfn main() begin\n  x = &a\nend", "point an FSR at it with fsr0 = a"},
+		{"rom:\n  a i8 packed [ 1 ]\nsection program\nfn main() begin\n  fsr0 = a\nend", "a is packed, and an FSR only reads the low byte of each word"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody("section data\n" + tt.input + "\n")
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.msg, err)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package internal
+
+import (
+	"testing"
+)
+
+// cpu runs generated code op by op for tests. It tracks the carry and
+// zero flags and counts instruction cycles. Code that refers to label
+// addresses or reads program memory needs syms and rom from assembling
+// ops.
+type cpu struct {
+	t      *testing.T
+	ops    []PicOp
+	labels map[string]int
+	regs   map[string]int
+	w      int
+	cycles int
+	syms   SymbolTable
+	rom    []uint16
+}
+
+func newCPU(t *testing.T, ops []PicOp, regs map[string]int) *cpu {
+	t.Helper()
+	m := &cpu{t: t, ops: ops, labels: map[string]int{}, regs: regs}
+	for i, op := range ops {
+		if l, ok := op.(LabelOp); ok {
+			m.labels[l.Name] = i
+		}
+	}
+	return m
+}
+
+func (m *cpu) flag(b int) bool { return m.regs["0x3"]&(1<<b) != 0 }
+
+func (m *cpu) setFlag(b int, v bool) {
+	if v {
+		m.regs["0x3"] |= 1 << b
+	} else {
+		m.regs["0x3"] &^= 1 << b
+	}
+}
+
+func (m *cpu) carry() int {
+	if m.flag(statusC) {
+		return 1
+	}
+	return 0
+}
+
+// store writes v to W or f and sets Z.
+func (m *cpu) store(f string, d, v int) {
+	v &= 0xFF
+	m.setFlag(statusZ, v == 0)
+	if d == DestW {
+		m.w = v
+	} else {
+		m.regs[f] = v
+	}
+}
+
+// indirect returns the register FSRn points at, or for program memory
+// the low byte of the word there, and then applies mode to FSRn.
+func (m *cpu) indirect(fsr, mode int) (reg string, rom int) {
+	lo, hi := hexAddr(regFSR0L+2*fsr), hexAddr(regFSR0H+2*fsr)
+	addr := m.regs[hi]<<8 | m.regs[lo]
+	switch mode {
+	case PreInc:
+		addr++
+	case PreDec:
+		addr--
+	}
+	switch {
+	case addr >= 0x8000:
+		rom = int(m.rom[addr-0x8000] & 0xFF)
+	case addr >= 0x2000:
+		lin := addr - 0x2000
+		reg = hexAddr(lin/80<<7 + 0x20 + lin%80)
+	case addr&0x7F >= 0x70:
+		reg = hexAddr(0x70 | addr&0xF)
+	default:
+		reg = hexAddr(addr)
+	}
+	switch mode {
+	case PostInc:
+		addr++
+	case PostDec:
+		addr--
+	}
+	m.regs[lo], m.regs[hi] = addr&0xFF, addr>>8&0xFF
+	return reg, rom
+}
+
+func (m *cpu) label(name string) int {
+	addr, ok := m.syms.GetAddress(name)
+	if !ok {
+		m.t.Fatalf("label %s has no address", name)
+	}
+	return addr
+}
+
+// at returns the index of the op at program address addr.
+func (m *cpu) at(addr int) int {
+	ctx := NewAssemblerContext(NewSymbolTable())
+	for _, name := range m.syms.Names() {
+		a, _ := m.syms.GetAddress(name)
+		ctx.Symbols.SetAddress(name, a)
+	}
+	words, err := ctx.encode(m.ops)
+	if err != nil {
+		m.t.Fatalf("encode failed: %v", err)
+	}
+	pc := 0
+	for i, n := range words {
+		pc += n
+		if n > 0 && pc-1 == addr {
+			return i
+		}
+	}
+	m.t.Fatalf("no instruction at 0x%X", addr)
+	return 0
+}
+
+// run executes from pc until the top-level code returns, ends, or runs
+// into the first helper.
+func (m *cpu) run(pc int) {
+	m.t.Helper()
+	var stack []int
+	skip := false
+	for ; pc < len(m.ops); pc++ {
+		if m.cycles > 100000 {
+			m.t.Fatal("ops don't terminate")
+		}
+		op := m.ops[pc]
+		if l, ok := op.(LabelOp); ok {
+			if _, ok := helpers[l.Name]; ok && len(stack) == 0 {
+				return
+			}
+			continue
+		}
+		switch op.(type) {
+		case CommentOp, OrgOp:
+			continue
+		}
+		m.cycles++
+		if skip {
+			skip = false
+			continue
+		}
+		jump := func(label string) {
+			target, ok := m.labels[label]
+			if !ok {
+				m.t.Fatalf("jump to undefined label %s", label)
+			}
+			pc = target
+			m.cycles++
+		}
+		switch op := op.(type) {
+		case CallOp:
+			stack = append(stack, pc)
+			jump(op.Label)
+		case Return:
+			if len(stack) == 0 {
+				m.cycles++
+				return
+			}
+			pc = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			m.cycles++
+		case Callw:
+			stack = append(stack, pc)
+			pc = m.at(m.regs[hexAddr(regPCLATH)]<<8|m.w) - 1
+			m.cycles++
+		case Goto:
+			jump(op.Label)
+		case Brw:
+			pc += m.w
+			m.cycles++
+		case Btfsc:
+			skip = m.regs[op.F]&(1<<op.B) == 0
+		case Btfss:
+			skip = m.regs[op.F]&(1<<op.B) != 0
+		case Decfsz:
+			v := (m.regs[op.F] - 1) & 0xFF
+			m.store(op.F, op.D, v)
+			skip = v == 0
+		case Bsf:
+			m.regs[op.F] |= 1 << op.B
+			if op.F == hexAddr(regPMCON1) && op.B == pmcon1RD {
+				// Read the word at PMADR.
+				w := m.rom[m.regs[hexAddr(regPMADRH)]<<8|m.regs[hexAddr(regPMADRL)]]
+				m.regs[hexAddr(regPMDATL)], m.regs[hexAddr(regPMDATH)] = int(w&0xFF), int(w>>8)
+			}
+		case Nop:
+		case Bcf:
+			m.regs[op.F] &^= 1 << op.B
+		case Clrf:
+			m.store(op.F, DestF, 0)
+		case Movlw:
+			m.w = op.K & 0xFF
+		case Movlp:
+			m.regs[hexAddr(regPCLATH)] = op.K & 0x7F
+		case MovlpHigh:
+			m.regs[hexAddr(regPCLATH)] = m.label(op.Label) >> 8
+		case MovlwLow:
+			m.w = m.label(op.Label) & 0xFF
+		case MovlwHigh:
+			m.w = m.label(op.Label) >> 8 & 0xFF
+		case Moviw:
+			reg, rom := m.indirect(op.FSR, op.Mode)
+			if reg != "" {
+				rom = m.regs[reg]
+			}
+			m.store("", DestW, rom)
+		case Movwi:
+			reg, _ := m.indirect(op.FSR, op.Mode)
+			if reg == "" {
+				m.t.Fatal("MOVWI into program memory")
+			}
+			m.regs[reg] = m.w
+		case Movwf:
+			m.regs[op.F] = m.w
+		case Movf:
+			m.store(op.F, op.D, m.regs[op.F])
+		case Addlw:
+			v := m.w + op.K&0xFF
+			m.setFlag(statusC, v > 0xFF)
+			m.store("", DestW, v)
+		case AddlwLow:
+			v := m.w + m.label(op.Label)&0xFF
+			m.setFlag(statusC, v > 0xFF)
+			m.store("", DestW, v)
+		case Sublw:
+			v := op.K&0xFF - m.w
+			m.setFlag(statusC, v >= 0)
+			m.store("", DestW, v)
+		case Andlw:
+			m.store("", DestW, m.w&op.K)
+		case Xorlw:
+			m.store("", DestW, m.w^op.K)
+		case Incf:
+			m.store(op.F, op.D, m.regs[op.F]+1)
+		case Andwf:
+			m.store(op.F, op.D, m.regs[op.F]&m.w)
+		case Xorwf:
+			m.store(op.F, op.D, m.regs[op.F]^m.w)
+		case Addwf:
+			v := m.regs[op.F] + m.w
+			m.setFlag(statusC, v > 0xFF)
+			m.store(op.F, op.D, v)
+		case Addwfc:
+			v := m.regs[op.F] + m.w + m.carry()
+			m.setFlag(statusC, v > 0xFF)
+			m.store(op.F, op.D, v)
+		case Subwf:
+			v := m.regs[op.F] - m.w
+			m.setFlag(statusC, v >= 0)
+			m.store(op.F, op.D, v)
+		case Subwfb:
+			v := m.regs[op.F] - m.w - (1 - m.carry())
+			m.setFlag(statusC, v >= 0)
+			m.store(op.F, op.D, v)
+		case Lslf:
+			v := m.regs[op.F]
+			m.setFlag(statusC, v&0x80 != 0)
+			m.store(op.F, op.D, v<<1)
+		case Lsrf:
+			v := m.regs[op.F]
+			m.setFlag(statusC, v&1 != 0)
+			m.store(op.F, op.D, v>>1)
+		case Rlf:
+			v := m.regs[op.F]<<1 | m.carry()
+			m.setFlag(statusC, v > 0xFF)
+			if op.D == DestW {
+				m.w = v & 0xFF
+			} else {
+				m.regs[op.F] = v & 0xFF
+			}
+		case Rrf:
+			v := m.regs[op.F] >> 1
+			if m.flag(statusC) {
+				v |= 0x80
+			}
+			m.setFlag(statusC, m.regs[op.F]&1 != 0)
+			if op.D == DestW {
+				m.w = v
+			} else {
+				m.regs[op.F] = v
+			}
+		case Swapf:
+			v := m.regs[op.F]
+			if op.D == DestW {
+				m.w = (v>>4 | v<<4) & 0xFF
+			} else {
+				m.regs[op.F] = (v>>4 | v<<4) & 0xFF
+			}
+		default:
+			m.t.Fatalf("unexpected op: %s", op.Assembly())
+		}
+	}
+}
+
+// call runs the named helper as if called from elsewhere and returns the
+// cycles it took, including the CALL.
+func (m *cpu) call(name string) int {
+	m.t.Helper()
+	m.cycles = 2
+	m.run(m.labels[name] + 1)
+	return m.cycles
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// A skip instruction skips exactly one word, so the instruction after a
+// skip must assemble to one word. The assembler puts a MOVLB before an
+// instruction whose register is in a bank other than the selected one,
+// and a skip would then skip just the MOVLB. safeSkips finds the skips
+// whose next instruction will get a MOVLB and branches around that
+// instruction instead, flagging the rewrite in the listing:
+//
+//	BTFSC f,b; op   -> BTFSS f,b; GOTO end; op; end:
+//	DECFSZ f,1; op  -> DECFSZ f,1; GOTO run; GOTO end; run: op; end:
+//
+// The skip then skips the GOTO, and op runs with its MOVLB or not at all.
+// Which instructions get a MOVLB comes from bankStates, as it does in the
+// assembler.
+
+// isSkip reports whether op can skip the next instruction.
+func isSkip(op PicOp) bool {
+	switch op.(type) {
+	case Btfsc, Btfss, Decfsz, Incfsz:
+		return true
+	}
+	return false
+}
+
+// fileOperand returns the file register op reads or writes, if any.
+func fileOperand(op PicOp) (string, bool) {
+	switch op := op.(type) {
+	case Addwf:
+		return op.F, true
+	case Addwfc:
+		return op.F, true
+	case Andwf:
+		return op.F, true
+	case Bcf:
+		return op.F, true
+	case Bsf:
+		return op.F, true
+	case Btfsc:
+		return op.F, true
+	case Btfss:
+		return op.F, true
+	case Clrf:
+		return op.F, true
+	case Decf:
+		return op.F, true
+	case Decfsz:
+		return op.F, true
+	case Incf:
+		return op.F, true
+	case Incfsz:
+		return op.F, true
+	case Iorwf:
+		return op.F, true
+	case Lslf:
+		return op.F, true
+	case Lsrf:
+		return op.F, true
+	case Rlf:
+		return op.F, true
+	case Rrf:
+		return op.F, true
+	case Movf:
+		return op.F, true
+	case Movwf:
+		return op.F, true
+	case Subwf:
+		return op.F, true
+	case Subwfb:
+		return op.F, true
+	case Swapf:
+		return op.F, true
+	case Xorwf:
+		return op.F, true
+	}
+	return "", false
+}
+
+// needsBank reports whether op needs a bank other than bank selected.
+func needsBank(op PicOp, bank int) bool {
+	f, ok := fileOperand(op)
+	if !ok {
+		return false
+	}
+	addr, ok := fileAddr(f)
+	if !ok || unbanked(addr) {
+		return false
+	}
+	return (addr>>7)&0x1F != bank
+}
+
+// safeSkips returns ops with every skip whose next instruction needs a
+// bank switch rewritten to branch around it. The instruction may itself
+// be a skip needing the same, so it is looked at in turn.
+func (c *asmGen) safeSkips(ops []PicOp) []PicOp {
+	var out []PicOp
+	banks := bankStates(ops, fileAddr)
+	end := "" // label to put after the op being looked at, if a skip was rewritten around it
+	for i := 0; i < len(ops); i++ {
+		op := ops[i]
+
+		// Find the instruction a skip skips, past any labels. A name
+		// only the assembler can resolve is left to the assembler, which
+		// checks that it doesn't end up skipping a MOVLB.
+		j := i + 1
+		for j < len(ops) && codeWords(ops[j:j+1]) == 0 {
+			j++
+		}
+		if !isSkip(op) || j == len(ops) || !needsBank(ops[j], banks[j]) {
+			out = append(out, op)
+			if end != "" {
+				out = append(out, LabelOp{Name: end})
+				end = ""
+			}
+			continue
+		}
+
+		skipped := c.newLabel("skipped")
+		out = append(out, CommentOp{Text: fmt.Sprintf("branch around %s, which needs a bank switch", ops[j].Assembly())})
+		switch op := op.(type) {
+		case Btfsc:
+			out = append(out, Btfss(op), Goto{Label: skipped})
+		case Btfss:
+			out = append(out, Btfsc(op), Goto{Label: skipped})
+		default:
+			run := c.newLabel("run")
+			out = append(out, op, Goto{Label: run}, Goto{Label: skipped}, LabelOp{Name: run})
+		}
+		if end != "" {
+			out = append(out, LabelOp{Name: end})
+		}
+		end = skipped
+		out = append(out, ops[i+1:j]...)
+		i = j - 1
+	}
+	return out
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+// The startup code clears y last, so main starts in y's bank and
+// writing z needs a bank switch.
+const skipsHeader = `
+section data
+common:
+  x i8
+  n i8
+banked:
+  z i8 at $A0
+  y i8 at $120
+section program
+`
+
+func TestSafeSkips(t *testing.T) {
+	tests := []struct {
+		body string
+		want string // the code from the skip on, or the skip if it stays
+	}{
+		{"  if x[0] then z = w", "; branch around MOVWF 0xA0, which needs a bank switch\nBTFSS 0x71,0\n GOTO _skipped_2\nMOVWF 0xA0\n_skipped_2:"},
+		{"  if not x[0] then z = w", "BTFSC 0x71,0\n GOTO _skipped_2\nMOVWF 0xA0\n_skipped_2:"},
+		{"  if (n--) != 0 then z = w", "DECFSZ 0x70,1\n GOTO _run_3\n GOTO _skipped_2\n_run_3:\nMOVWF 0xA0\n_skipped_2:"},
+		{"  if x[0] or x[1] then z = w", "BTFSS 0x71,1\n GOTO _skipped_3\n_then_2:\nMOVWF 0xA0\n_skipped_3:"},
+		// z's bank is already selected.
+		{"  z = 5\n  if x[0] then z = w", "BTFSC 0x71,0\nMOVWF 0xA0"},
+		{"  if x[0] then n = w", "BTFSC 0x71,0\nMOVWF 0x70"},
+	}
+	for _, tt := range tests {
+		ops, _, err := compileBody(skipsHeader+inMain(tt.body+"\n  return"), assembled)
+		if err != nil {
+			t.Errorf("%q: %v", tt.body, err)
+			continue
+		}
+		var lines []string
+		for _, op := range ops {
+			lines = append(lines, op.Assembly())
+		}
+		if listing := strings.Join(lines, "\n"); !strings.Contains(listing, tt.want) {
+			t.Errorf("%q: expected\n%s\nin\n%s", tt.body, tt.want, listing)
+		}
+	}
+}
+
+func TestSafeSkipsSim(t *testing.T) {
+	ops, syms, err := compileBody(skipsHeader + inMain("  w = 0\n  if x[0] then z = w\n  w = 9\n  if (n--) != 0 then z = w\n  return"))
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	addr := func(name string) string {
+		a, _ := syms.GetAddress(name)
+		return hexAddr(a)
+	}
+	for _, tt := range []struct {
+		x, n, z int
+	}{{0, 1, 7}, {1, 1, 0}, {0, 2, 9}, {3, 5, 9}} {
+		m := newCPU(t, ops, map[string]int{addr("x"): tt.x, addr("n"): tt.n, addr("z"): 7})
+		m.call("main")
+		if got := m.regs[addr("z")]; got != tt.z {
+			t.Errorf("x = %d, n = %d: expected z = %d, got %d", tt.x, tt.n, tt.z, got)
+		}
+	}
+}
+
+func TestAssembleSkipsMovlb(t *testing.T) {
+	_, _, err := Assemble([]PicOp{Btfsc{F: "0x3", B: statusZ}, Clrf{F: "0x120"}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "the skip at 0x0 would only skip the bank switch before CLRF 0x120") {
+		t.Errorf("expected a skipped MOVLB error, got %v", err)
+	}
+}
+
+// TestSafeSkipsChained checks skips whose instruction is another skip
+// that needs a bank switch. The rewritten code must assemble and do what
+// the original would without any MOVLBs.
+func TestSafeSkipsChained(t *testing.T) {
+	tests := [][]PicOp{
+		{Btfsc{F: "0x70", B: 0}, Btfsc{F: "0x120", B: 1}, Clrf{F: "0x121"}},
+		{Btfss{F: "0x70", B: 0}, Btfss{F: "0x120", B: 1}, Clrf{F: "0xA0"}},
+		{Btfsc{F: "0x70", B: 0}, Decfsz{F: "0x120", D: DestF}, Clrf{F: "0x121"}},
+		{Decfsz{F: "0x71", D: DestF}, Btfsc{F: "0x120", B: 1}, Clrf{F: "0x121"}},
+		{Btfsc{F: "0x70", B: 0}, Btfss{F: "0x120", B: 1}, Btfsc{F: "0xA0", B: 2}, Clrf{F: "0xA1"}},
+	}
+	for _, chain := range tests {
+		ops := append([]PicOp{LabelOp{Name: "main"}}, chain...)
+		ops = append(ops, Return{})
+		var lines []string
+		for _, op := range chain {
+			lines = append(lines, op.Assembly())
+		}
+		name := strings.Join(lines, "; ")
+
+		safe := (&asmGen{}).safeSkips(ops)
+		if _, _, err := Assemble(safe, nil); err != nil {
+			t.Errorf("%s: Assemble failed: %v", name, err)
+			continue
+		}
+		for in := range 32 {
+			regs := func() map[string]int {
+				return map[string]int{
+					"0x70": in & 1, "0x71": in >> 1 & 1,
+					"0x120": in >> 2 & 3, "0xA0": in >> 4 & 1 << 2,
+					"0x121": 7, "0xA1": 7,
+				}
+			}
+			want, got := newCPU(t, ops, regs()), newCPU(t, safe, regs())
+			want.call("main")
+			got.call("main")
+			if !maps.Equal(got.regs, want.regs) {
+				t.Errorf("%s with input %05b: expected %v, got %v", name, in, want.regs, got.regs)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A program starts by calling _startup from its reset vector, which
+// clears every variable without an initial value and copies in the
+// rest. Variables placed with at are left alone unless they have an
+// initial value, as they may hold state handed over by a bootloader.
+// Each run of adjacent bytes is done either one instruction or
+// two per byte, or with a loop through the FSRs, whichever is shorter.
+// Looping works because banked RAM also appears in a linear block from
+// $2000 with no gaps between the banks, and because FSR0 reads the low
+// byte of program memory from $8000, where the initial values are kept
+// as a table of RETLWs.
+
+const startupLabel = "_startup"
+
+const (
+	clearLoopWords = 10 // FSR1, count and W set up, then the loop
+	copyLoopWords  = 15 // FSR0 too, and a loop twice as long
+)
+
+// startupCall returns the call to _startup made from the reset vector.
+// PCLATH is 0 after a reset, so it is set for the call.
+func startupCall() []PicOp {
+	return []PicOp{MovlpHigh{Label: startupLabel}, CallOp{Label: startupLabel}}
+}
+
+// resetOps returns the reset vector of a program without an at $0
+// block. PCLATH is set before each jump, and everything fits in the
+// four words before the interrupt vector at $4. Unless the program has
+// an at $4 block, the interrupt vector holds a RETFIE, so a stray
+// interrupt returns rather than running whatever comes next.
+func resetOps(startup, isr bool) []PicOp {
+	ops := []PicOp{OrgOp{Address: 0}}
+	if startup {
+		ops = append(ops, startupCall()...)
+	}
+	ops = append(ops, MovlpHigh{Label: "main"}, Goto{Label: "main"})
+	if !isr {
+		ops = append(ops, OrgOp{Address: 4}, Retfie{})
+	}
+	return ops
+}
+
+// ramByte is one byte of a variable as the startup code sets it.
+type ramByte struct {
+	addr int
+	val  int
+	init bool
+}
+
+// linear returns addr in an address space where adjacent bytes of
+// general purpose RAM are consecutive: the linear mapping for banked RAM
+// and the address itself for common RAM.
+func linear(addr int) int {
+	if addr >= 0x70 && addr <= 0x7F {
+		return addr
+	}
+	return 0x2000 + (addr>>7)*80 + addr&0x7F - 0x20
+}
+
+// initialValue evaluates the initial value of v.
+func (c *asmGen) initialValue(v Variable) (int, error) {
+	op, ok, err := c.operand(v.Init)
+	if err != nil {
+		return 0, err
+	}
+	if !ok || op.kind != literalOperand {
+		return 0, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("initial value of %s must be a constant, got %v", v.Name, v.Init),
+			Range:   v.Init.Position(),
+		}
+	}
+	if err := c.checkEnums(IdentExpr{Name: v.Name}, v.Init, v.Init.Position()); err != nil {
+		return 0, err
+	}
+	if v.Type == "i16" {
+		if op.k < -0x8000 || op.k > 0xFFFF {
+			return 0, Diagnostic{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("%v = %d does not fit in 16 bits", v.Init, op.k),
+				Range:   v.Init.Position(),
+			}
+		}
+	} else if err := checkByte(op.k, v.Init); err != nil {
+		return 0, err
+	}
+	return op.k, nil
+}
+
+// startupBytes returns every byte of every variable in linear order.
+func (c *asmGen) startupBytes() ([]ramByte, DiagnosticList) {
+	var diagnostics DiagnosticList
+	seen := map[int]bool{} // overlays share bytes
+	pinned := map[string]bool{}
+	for _, o := range c.prog.Overlays {
+		for _, member := range o.Members {
+			for _, name := range member {
+				pinned[name] = o.Pinned
+			}
+		}
+	}
+	var bytes []ramByte
+	for _, v := range c.prog.Variables {
+		val, init := 0, v.Init != nil
+		if !init && (v.Pinned || pinned[v.Name]) {
+			continue
+		}
+		if init {
+			var err error
+			if val, err = c.initialValue(v); err != nil {
+				diagnostics = append(diagnostics, asDiagnostic(err, v.Range))
+				continue
+			}
+		}
+		for i := range v.Size() {
+			if !seen[v.Address+i] {
+				seen[v.Address+i] = true
+				bytes = append(bytes, ramByte{addr: v.Address + i, val: val >> (8 * i) & 0xFF, init: init})
+			}
+		}
+	}
+	sort.Slice(bytes, func(i, j int) bool { return linear(bytes[i].addr) < linear(bytes[j].addr) })
+	return bytes, diagnostics
+}
+
+// startupRuns splits bytes into runs of adjacent bytes that are all
+// cleared or all copied. A run is at most 255 bytes long so that the
+// loop count fits in a byte.
+func startupRuns(bytes []ramByte) [][]ramByte {
+	var runs [][]ramByte
+	for i, b := range bytes {
+		if i > 0 {
+			prev, run := bytes[i-1], runs[len(runs)-1]
+			if linear(b.addr) == linear(prev.addr)+1 && b.init == prev.init && len(run) < 255 {
+				runs[len(runs)-1] = append(run, b)
+				continue
+			}
+		}
+		runs = append(runs, []ramByte{b})
+	}
+	return runs
+}
+
+// bankSwitches counts the MOVLBs the assembler inserts for run when it
+// is done one byte at a time.
+func bankSwitches(run []ramByte) int {
+	n, bank := 0, -1
+	for _, b := range run {
+		if b.addr >= 0x70 && b.addr <= 0x7F {
+			continue
+		}
+		if b.addr>>7 != bank {
+			n++
+			bank = b.addr >> 7
+		}
+	}
+	return n
+}
+
+// startupOps returns the _startup routine followed by its tables.
+func (c *asmGen) startupOps(bytes []ramByte) []PicOp {
+	ops := []PicOp{LabelOp{Name: startupLabel}}
+	var tables []PicOp
+	for _, run := range startupRuns(bytes) {
+		var unrolled []PicOp
+		w := -1
+		for _, b := range run {
+			f := hexAddr(b.addr)
+			switch {
+			case b.val == 0:
+				unrolled = append(unrolled, Clrf{F: f})
+			case b.val == w:
+				unrolled = append(unrolled, Movwf{F: f})
+			default:
+				unrolled = append(unrolled, Movlw{K: b.val}, Movwf{F: f})
+				w = b.val
+			}
+		}
+		loopWords := clearLoopWords
+		if run[0].init {
+			loopWords = copyLoopWords + len(run)
+		}
+		if codeWords(unrolled)+bankSwitches(run) <= loopWords {
+			ops = append(ops, unrolled...)
+			continue
+		}
+
+		count := c.temp("count")
+		dest := linear(run[0].addr)
+		var loop []PicOp
+		if run[0].init {
+			table := c.newLabel("inittab")
+			ops = append(ops,
+				MovlwLow{Label: table},
+				Movwf{F: hexAddr(regFSR0L)},
+				MovlwHigh{Label: table},
+				Movwf{F: hexAddr(regFSR0H)},
+				Bsf{F: hexAddr(regFSR0H), B: 7},
+			)
+			loop = []PicOp{Moviw{FSR: 0, Mode: PostInc}}
+			tables = append(tables, LabelOp{Name: table})
+			for _, b := range run {
+				tables = append(tables, Retlw{K: b.val})
+			}
+		}
+		ops = append(ops,
+			Movlw{K: dest & 0xFF},
+			Movwf{F: hexAddr(regFSR1L)},
+			Movlw{K: dest >> 8},
+			Movwf{F: hexAddr(regFSR1H)},
+			Movlw{K: len(run)},
+			Movwf{F: count},
+		)
+		if !run[0].init {
+			ops = append(ops, Movlw{K: 0})
+		}
+		label := c.newLabel("init")
+		ops = append(ops, LabelOp{Name: label})
+		ops = append(ops, loop...)
+		ops = append(ops,
+			Movwi{FSR: 1, Mode: PostInc},
+			Decfsz{F: count, D: DestF},
+			Goto{Label: label},
+		)
+	}
+	ops = append(ops, Return{})
+	return append(ops, tables...)
+}
@@ -0,0 +1,333 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestStartup runs the startup code over RAM full of junk and checks
+// what every variable holds afterwards.
+func TestStartup(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString(`
+section constants
+limit: 200
+enum state [ idle running ]
+section data
+common:
+  count i8 = 5
+  flags i8
+  mode state = running
+  wide i16 = $FFFF - 1
+  top i8 = limit - 1
+  ptr i8 = &count
+banked:
+  boot i8 at $A5 = 7
+  overlay begin
+    begin rx i8 rxsum i16 end
+    tx i8
+  end
+`)
+	want := map[string]int{"count": 5, "flags": 0, "mode": 1, "wide": 0xFFFE, "top": 199, "boot": 7, "rx": 0, "rxsum": 0, "tx": 0}
+	// Enough of each to be worth a loop, and enough zeros to run from
+	// bank 0 into bank 1.
+	for i := range 20 {
+		name := fmt.Sprintf("init%d", i)
+		fmt.Fprintf(&sb, "  %s i8 = %d\n", name, i*3+1)
+		want[name] = i*3 + 1
+	}
+	for i := range 100 {
+		name := fmt.Sprintf("zero%d", i)
+		fmt.Fprintf(&sb, "  %s i8\n", name)
+		want[name] = 0
+	}
+	sb.WriteString(`
+section program
+at $0 begin
+  main()
+end
+fn main() begin
+  return
+end
+`)
+	ops, syms, err := compileBody(sb.String(), withStartup)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	rom, _, err := Assemble(ops, syms)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	var loops []string
+	for _, op := range ops {
+		if _, ok := op.(Moviw); ok {
+			loops = append(loops, "copy")
+		}
+		if g, ok := op.(Goto); ok && strings.HasPrefix(g.Label, "_init_") {
+			loops = append(loops, "loop")
+		}
+	}
+	// boot splits the zeros in two.
+	if strings.Join(loops, " ") != "copy loop loop loop" {
+		t.Errorf("expected a copy loop and two clearing loops, got %v", loops)
+	}
+
+	regs := map[string]int{}
+	for name := range want {
+		addr, _ := syms.GetAddress(name)
+		regs[hexAddr(addr)], regs[hexAddr(addr+1)] = 0xAA, 0xAA
+	}
+	want["ptr"], _ = syms.GetAddress("count")
+	m := newCPU(t, ops, regs)
+	m.syms, m.rom = syms, rom
+	m.run(0)
+	for name, val := range want {
+		addr, _ := syms.GetAddress(name)
+		got := m.regs[hexAddr(addr)]
+		if val > 0xFF || name == "rxsum" {
+			got |= m.regs[hexAddr(addr+1)] << 8
+		}
+		if got != val {
+			t.Errorf("%s at $%X: expected %d, got %d", name, addr, val, got)
+		}
+	}
+}
+
+// TestStartupKeepsPinned checks that variables placed with at keep what
+// they held before reset unless they have an initial value.
+func TestStartupKeepsPinned(t *testing.T) {
+	ops, syms, err := compileBody(`
+section data
+common:
+  count i8
+banked:
+  handoff i8 at $A0
+  boot i8 at $A1 = 7
+  overlay at $A2 begin
+    rx i8
+    tx i8
+  end
+section program
+fn main() begin
+  return
+end
+`, withStartup, assembled)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	regs := map[string]int{"0x70": 0x5A, "0xA0": 0x5A, "0xA1": 0x5A, "0xA2": 0x5A}
+	m := newCPU(t, ops, regs)
+	m.syms = syms
+	m.call(startupLabel)
+	for addr, want := range map[string]int{"0x70": 0, "0xA0": 0x5A, "0xA1": 7, "0xA2": 0x5A} {
+		if got := m.regs[addr]; got != want {
+			t.Errorf("%s: expected %d, got %d", addr, want, got)
+		}
+	}
+}
+
+func TestStartupShape(t *testing.T) {
+	ops, _, err := compileBody(`
+section data
+common:
+  a i8 = 5
+  b i8 = 5
+  c i8 = 0
+  d i8
+banked:
+  e i8 = 1
+section program
+at $0 begin
+  main()
+end
+fn main() begin
+  return
+end
+`, withStartup)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	expected := []string{
+		" ORG 0x0",
+		"MOVLP HIGH _startup",
+		" CALL _startup",
+		"MOVLP 0x0",
+		" CALL main",
+		"main:",
+		"RETURN",
+		"_startup:",
+		"MOVLW 5",
+		"MOVWF 0x70",
+		"MOVWF 0x71",
+		"CLRF 0x72",
+		"CLRF 0x73",
+		"MOVLW 1",
+		"MOVWF 0x20",
+		"RETURN",
+	}
+	var got []string
+	for _, op := range ops {
+		got = append(got, op.Assembly())
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestStartupErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		msg  string
+	}{
+		{"common:\n  a i8\n  b i8 = a", "initial value of b must be a constant"},
+		{"common:\n  a i8 = 256", "does not fit in 8 bits"},
+		{"common:\n  a i16 = $10000", "does not fit in 16 bits"},
+		{"common:\n  a state = 3\n  b other = idle", "cannot mix b (enum other) with idle (enum state)"},
+		{"banked:\n  overlay begin a i8 = 1 end", "a is in an overlay, so it can't have an initial value"},
+	}
+	for _, tt := range tests {
+		input := "section constants\nenum state [ idle ]\nenum other [ first ]\nsection data\n" + tt.data +
+			"\nsection program\nat $0 begin\nend\n"
+		_, _, err := compileBody(input)
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.data, tt.msg, err)
+		}
+	}
+
+	_, _, err := compileBody("section data\ncommon:\n  a i8 = 1\nsection program\nfn other() begin\nend\n")
+	if err == nil || !strings.Contains(err.Error(), "needs fn main or an at $0 block") {
+		t.Errorf("expected an error about the missing entry point, got %v", err)
+	}
+}
+
+func TestWriteSymbols(t *testing.T) {
+	ops, syms, err := compileBody(`
+section data
+common:
+  a i8 = 1
+banked:
+  b i8
+section program
+at $0 begin
+  main()
+end
+fn main() begin
+  return
+end
+`, withStartup, assembled)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSymbols(&buf, ops, syms); err != nil {
+		t.Fatalf("WriteSymbols failed: %v", err)
+	}
+	expected := "_startup 5 0 CODE 0\na 70 0 COMMON 1\nb 20 0 RAM 1\nmain 4 0 CODE 0\n"
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestResetVector(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{
+			"main only",
+			"section program\nfn main() begin\n  return\nend\n",
+			[]string{" ORG 0x0", "MOVLP HIGH main", " GOTO main", " ORG 0x4", "RETFIE", "main:", "RETURN"},
+		},
+		{
+			"startup first",
+			"section data\ncommon:\n  a i8\nsection program\nfn main() begin\n  return\nend\n",
+			[]string{
+				" ORG 0x0", "MOVLP HIGH _startup", " CALL _startup", "MOVLP HIGH main", " GOTO main", " ORG 0x4", "RETFIE",
+				"main:", "RETURN",
+				"_startup:", "CLRF 0x70", "RETURN",
+			},
+		},
+		{
+			"interrupt vector",
+			"section program\nat $4 begin\n  return\nend\nfn main() begin\n  return\nend\n",
+			[]string{" ORG 0x0", "MOVLP HIGH main", " GOTO main", " ORG 0x4", "RETURN", "main:", "RETURN"},
+		},
+		{
+			"explicit at $0",
+			"section program\nat $0 begin\n  main()\nend\nfn main() begin\n  return\nend\n",
+			[]string{" ORG 0x0", " CALL main", "main:", "RETURN"},
+		},
+		{
+			"at $0 with startup",
+			"section data\ncommon:\n  a i8\nsection program\nat $0 begin\n  main()\nend\nfn main() begin\n  return\nend\n",
+			[]string{
+				" ORG 0x0", "MOVLP HIGH _startup", " CALL _startup", "MOVLP 0x0", " CALL main",
+				"main:", "RETURN",
+				"_startup:", "CLRF 0x70", "RETURN",
+			},
+		},
+	}
+	for _, tt := range tests {
+		ops, _, err := compileBody(tt.input, withStartup)
+		if err != nil {
+			t.Fatalf("%s: Compile failed: %v", tt.name, err)
+		}
+		var got []string
+		for _, op := range ops {
+			got = append(got, op.Assembly())
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tt.name, strings.Join(tt.expected, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
+
+// TestResetVectorPage checks that the reset vector reaches a main
+// beyond the first 2K page.
+func TestResetVectorPage(t *testing.T) {
+	input := "section data\ncommon:\n  x i8\nsection program\nfn pad() begin\n" +
+		strings.Repeat("  x = 1\n", 1030) + "end\nfn main() begin\n  return\nend\n"
+	ops, syms, err := compileBody(input, withStartup)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	words, _, err := Assemble(ops, syms)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	main, _ := syms.GetAddress("main")
+	startup, _ := syms.GetAddress(startupLabel)
+	if main < 0x800 {
+		t.Fatalf("expected main beyond 0x800, it is at 0x%X", main)
+	}
+	expected := []uint16{
+		0x3180 | uint16(startup>>8), 0x2000 | uint16(startup&0x7FF),
+		0x3180 | uint16(main>>8), 0x2800 | uint16(main&0x7FF),
+	}
+	for i, w := range expected {
+		if words[i] != w {
+			t.Errorf("word %d: expected 0x%04X, got 0x%04X", i, w, words[i])
+		}
+	}
+}
+
+func TestNoEntryPoint(t *testing.T) {
+	toks, err := Lex("section program\nfn other() begin\n  return\nend\n")
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	prog, err := Parse(toks)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	_, _, warnings, err := CompileWithWarnings(prog)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "nothing runs at reset") {
+		t.Errorf("expected a warning about the reset vector, got %v", warnings)
+	}
+}
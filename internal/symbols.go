@@ -1,9 +1,16 @@
 package internal
 
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
 // SymbolTable represents a mapping of names to addresses.
 type SymbolTable interface {
 	GetAddress(name string) (int, bool)
 	SetAddress(name string, addr int)
+	Names() []string
 }
 
 // BasicSymbolTable is a simple implementation of SymbolTable.
@@ -28,3 +35,40 @@ func (st *BasicSymbolTable) GetAddress(name string) (int, bool) {
 func (st *BasicSymbolTable) SetAddress(name string, addr int) {
 	st.symbols[name] = addr
 }
+
+// Names returns the names of all symbols in sorted order.
+func (st *BasicSymbolTable) Names() []string {
+	names := make([]string, 0, len(st.symbols))
+	for name := range st.symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteSymbols writes the symbols of an assembled program in the format
+// of a pic-as .sym file: name, address, class and address space, which
+// is 0 for program memory and 1 for data memory. Labels are CODE, and
+// variables and compiler temporaries are COMMON or RAM (banked).
+func WriteSymbols(w io.Writer, ops []PicOp, syms SymbolTable) error {
+	labels := map[string]bool{}
+	for _, op := range ops {
+		if l, ok := op.(LabelOp); ok {
+			labels[l.Name] = true
+		}
+	}
+	for _, name := range syms.Names() {
+		addr, _ := syms.GetAddress(name)
+		class, space := "CODE", 0
+		if !labels[name] {
+			class, space = "RAM", 1
+			if addr >= 0x70 && addr <= 0x7F {
+				class = "COMMON"
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s %X 0 %s %d\n", name, addr, class, space); err != nil {
+			return err
+		}
+	}
+	return nil
+}
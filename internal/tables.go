@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+)
+
+// A function table is emitted as a run of GOTOs, one per entry, after
+// the program's functions. Calling entry W adds W to the table's
+// address in PCLATH:W, carrying into PCLATH if the table crosses a
+// 256-word boundary, and issues CALLW. The entry's GOTO leaves the
+// return address alone, so the function returns straight to the caller.
+// An index past the end of the table is checked for, as case does, and
+// calls nothing.
+
+func (c *asmGen) compileTableCall(s CallStmt) ([]PicOp, error) {
+	table, ok := c.prog.Tables[s.Name]
+	if !ok {
+		return nil, Diagnostic{
+			Code:    ErrUndefinedSymbol,
+			Message: fmt.Sprintf("unknown function table %s", s.Name),
+			Range:   s.Range,
+		}
+	}
+	if len(table.Entries) == 0 {
+		// Nothing to call, and no index is in range.
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("table %s has no entries", table.Name),
+			Range:   table.Range,
+		}
+	}
+	for _, entry := range table.Entries {
+		if !slices.ContainsFunc(c.prog.Functions, func(fn Function) bool { return fn.Name == entry }) {
+			return nil, Diagnostic{
+				Code:    ErrUndefinedSymbol,
+				Message: fmt.Sprintf("table %s lists %s, which is not a function", table.Name, entry),
+				Range:   table.Range,
+			}
+		}
+	}
+
+	// A constant index is an ordinary call.
+	if k, ok := c.literal(s.Index); ok {
+		if k < 0 || k >= len(table.Entries) {
+			return nil, Diagnostic{
+				Code:    ErrInvalidNumber,
+				Message: fmt.Sprintf("index %d is out of range for table %s, which has %d entries", k, table.Name, len(table.Entries)),
+				Range:   s.Index.Position(),
+			}
+		}
+		return []PicOp{CallOp{Label: table.Entries[k]}}, nil
+	}
+
+	ops, err := c.evalExpr(s.Index)
+	if err != nil {
+		return nil, err
+	}
+	label := tableLabel(table.Name)
+	if !slices.Contains(c.tables, table.Name) {
+		c.tables = append(c.tables, table.Name)
+	}
+	n := len(table.Entries)
+	skip := ""
+	if n < 256 {
+		// Adding 256 - n carries if W >= n. n is at least 1, so the
+		// literal fits in a byte.
+		skip = c.newLabel("nocall")
+		ops = append(ops,
+			Addlw{K: 256 - n},
+			Btfsc{F: hexAddr(regSTATUS), B: statusC},
+			Goto{Label: skip},
+			Addlw{K: n},
+		)
+	}
+	ops = append(ops,
+		AddlwLow{Label: label},
+		MovlpHigh{Label: label},
+		Btfsc{F: hexAddr(regSTATUS), B: statusC},
+		Incf{F: hexAddr(regPCLATH), D: DestF},
+		Callw{},
+	)
+	if skip != "" {
+		ops = append(ops, LabelOp{Name: skip})
+	}
+	return ops, nil
+}
+
+func tableLabel(name string) string {
+	return "_table_" + name
+}
+
+// tableOps returns the code of every function table the program calls
+// through CALLW.
+func (c *asmGen) tableOps() []PicOp {
+	var ops []PicOp
+	for _, name := range c.tables {
+		ops = append(ops, LabelOp{Name: tableLabel(name)})
+		for _, entry := range c.prog.Tables[name].Entries {
+			ops = append(ops, Goto{Label: entry})
+		}
+	}
+	return ops
+}
@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompileTableCall(t *testing.T) {
+	ops, _, err := compileBody(`
+section data
+common:
+  cmd i8
+section program
+table handlers [ start stop start ]
+fn main() begin
+  handlers[w]()
+  handlers[cmd]()
+  handlers[1]()
+end
+fn start() begin
+  return
+end
+fn stop() begin
+  return
+end
+`)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	expected := []string{
+		"main:",
+		"ADDLW 253",
+		"BTFSC 0x3,0",
+		" GOTO _nocall_1",
+		"ADDLW 3",
+		"ADDLW LOW _table_handlers",
+		"MOVLP HIGH _table_handlers",
+		"BTFSC 0x3,0",
+		"INCF 0xA,1",
+		"CALLW",
+		"_nocall_1:",
+		"MOVF 0x70,0",
+		"ADDLW 253",
+		"BTFSC 0x3,0",
+		" GOTO _nocall_2",
+		"ADDLW 3",
+		"ADDLW LOW _table_handlers",
+		"MOVLP HIGH _table_handlers",
+		"BTFSC 0x3,0",
+		"INCF 0xA,1",
+		"CALLW",
+		"_nocall_2:",
+		" CALL stop",
+		"start:",
+		"RETURN",
+		"stop:",
+		"RETURN",
+		"_table_handlers:",
+		" GOTO start",
+		" GOTO stop",
+		" GOTO start",
+	}
+	var got []string
+	for _, op := range ops {
+		got = append(got, op.Assembly())
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// TestTableAcrossPage works out where CALLW lands for each index when
+// the table straddles a 256-word boundary.
+func TestTableAcrossPage(t *testing.T) {
+	input := `
+section data
+common:
+  cmd i8
+section program
+table handlers [ f0 f1 f2 f3 f4 f5 ]
+fn main() begin
+  handlers[cmd]()
+` + strings.Repeat("  cmd = 1\n", 118) + `
+end
+`
+	for i := range 6 {
+		input += fmt.Sprintf("fn f%d() begin\n  return\nend\n", i)
+	}
+	ops, syms, err := compileBody(input)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	words, _, err := Assemble(ops, syms)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+
+	table, _ := syms.GetAddress("_table_handlers")
+	if table>>8 == (table+5)>>8 {
+		t.Fatalf("expected the table to cross a 256-word boundary, it is at 0x%X", table)
+	}
+	// MOVF cmd,0; the range check; ADDLW LOW; MOVLP HIGH; BTFSC STATUS,C;
+	// INCF PCLATH,1; CALLW
+	low := int(words[5] & 0xFF)
+	high := int(words[6] & 0x7F)
+	if words[9] != 0x000A {
+		t.Fatalf("expected CALLW, got 0x%04X", words[9])
+	}
+	for i := range 6 {
+		w := i + low
+		pclath := high
+		if w > 0xFF {
+			pclath++
+		}
+		target := pclath<<8 | w&0xFF
+		addr, _ := syms.GetAddress(fmt.Sprintf("f%d", i))
+		if got := words[target]; got != 0x2800|uint16(addr) {
+			t.Errorf("index %d lands on 0x%04X at 0x%X, expected GOTO f%d (0x%X)", i, got, target, i, addr)
+		}
+	}
+}
+
+// TestTableIndexRange calls through a table with indexes in and out of
+// range. Those out of range call nothing.
+func TestTableIndexRange(t *testing.T) {
+	ops, syms, err := compileBody(`
+section data
+common:
+  cmd i8
+  x i8
+section program
+table handlers [ a b c ]
+fn main() begin
+  handlers[cmd]()
+  return
+end
+fn a() begin
+  x = 1
+  return
+end
+fn b() begin
+  x = 2
+  return
+end
+fn c() begin
+  x = 3
+  return
+end
+`)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	if _, _, err := Assemble(ops, syms); err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	for _, cmd := range []int{0, 1, 2, 3, 4, 128, 253, 255} {
+		m := newCPU(t, ops, map[string]int{"0x70": cmd, "0x71": 0})
+		m.syms = syms
+		m.call("main")
+		want := 0
+		if cmd < 3 {
+			want = cmd + 1
+		}
+		if got := m.regs["0x71"]; got != want {
+			t.Errorf("cmd = %d: expected x = %d, got %d", cmd, want, got)
+		}
+	}
+}
+
+func TestStackDepth(t *testing.T) {
+	// chain returns functions c1..cn, each calling the next.
+	chain := func(n int, last string) string {
+		var sb strings.Builder
+		for i := 1; i <= n; i++ {
+			body := fmt.Sprintf("c%d()", i+1)
+			if i == n {
+				body = last
+			}
+			fmt.Fprintf(&sb, "fn c%d() begin\n  %s\nend\n", i, body)
+		}
+		return sb.String()
+	}
+	tests := []struct {
+		name string
+		prog string
+		msg  string
+	}{
+		{
+			"sixteen levels fit",
+			"fn main() begin\n  c1()\nend\n" + chain(16, "return"),
+			"",
+		},
+		{
+			"seventeen levels don't",
+			"fn main() begin\n  c1()\nend\n" + chain(17, "return"),
+			"calls nest 17 deep, but the stack only has 16 levels: at $0 -> main -> c1 -> c2",
+		},
+		{
+			"helpers count",
+			"fn main() begin\n  c1()\nend\n" + chain(16, "x = x * y"),
+			"calls nest 17 deep, but the stack only has 16 levels: at $0 -> main -> c1 -> c2 -> c3 -> c4 -> c5 -> c6 -> c7 -> c8 -> c9 -> c10 -> c11 -> c12 -> c13 -> c14 -> c15 -> c16 -> _mul8",
+		},
+		{
+			"every table entry counts",
+			"table t [ leaf c1 ]\nfn main() begin\n  t[x]()\nend\nfn leaf() begin\n  return\nend\n" + chain(17, "return"),
+			"calls nest 17 deep, but the stack only has 16 levels: at $0 -> main -> table t -> c1",
+		},
+		{
+			"an interrupt fits on top",
+			"at $4 begin\n  leaf()\nend\nfn leaf() begin\n  return\nend\nfn main() begin\n  c1()\nend\n" + chain(14, "return"),
+			"",
+		},
+		{
+			"an interrupt counts",
+			"at $4 begin\n  leaf()\nend\nfn leaf() begin\n  return\nend\nfn main() begin\n  c1()\nend\n" + chain(15, "return"),
+			"calls nest 17 deep, but the stack only has 16 levels: at $0 -> main -> c1 -> c2 -> c3 -> c4 -> c5 -> c6 -> c7 -> c8 -> c9 -> c10 -> c11 -> c12 -> c13 -> c14 -> c15, interrupted by at $4 -> leaf",
+		},
+		{
+			"recursion",
+			"fn main() begin\n  c1()\nend\n" + chain(3, "c1()"),
+			"recursive call c1 -> c2 -> c3 -> c1",
+		},
+		{
+			"recursion through a table",
+			"table t [ main ]\nfn main() begin\n  t[x]()\nend\n",
+			"recursive call main -> table t -> main",
+		},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody("section data\ncommon:\n  x i8\n  y i8\nsection program\n" + tt.prog)
+		if tt.msg == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.msg, err)
+		}
+	}
+}
+
+func TestTableErrors(t *testing.T) {
+	tests := []struct {
+		prog string
+		msg  string
+	}{
+		{"fn main() begin\n  t[x]()\nend", "unknown function table t"},
+		{"table t [ main nope ]\nfn main() begin\n  t[x]()\nend", "table t lists nope, which is not a function"},
+		{"table t [ main ]\nfn main() begin\n  t[1]()\nend", "index 1 is out of range for table t, which has 1 entries"},
+		{"table t [ main ]\ntable t [ main ]\nfn main() begin\nend", "table t is already declared"},
+		{"table t [ ]\nfn main() begin\n  t[x]()\nend", "table t has no entries"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody("section data\ncommon:\n  x i8\nsection program\n" + tt.prog)
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.prog, tt.msg, err)
+		}
+	}
+
+	// An empty table must not reach code generation, where its range
+	// check would add 256.
+	c := &asmGen{prog: Program{Tables: map[string]FuncTable{"t": {Name: "t"}}}}
+	if _, err := c.compileTableCall(CallStmt{Name: "t", Index: IdentExpr{Name: "x"}}); err == nil || !strings.Contains(err.Error(), "table t has no entries") {
+		t.Errorf("expected an error for calling through an empty table, got %v", err)
+	}
+}
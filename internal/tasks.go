@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// Each task is compiled to a routine that runs one step of it: from
+// where the previous step stopped up to the next yield, or to a wait
+// whose condition is false. The point to resume from is kept in a
+// saved-state byte, and the routine starts with a BRW into a table of
+// GOTOs, one per resume point. Reaching the end of the body, or a
+// return, starts the task over on its next step. The generated
+// scheduler calls the step of each task in turn, forever.
+//
+// Only a task's own body can yield. A function it calls has its return
+// address on the hardware stack, which can't be saved and restored.
+
+const schedulerLabel = "scheduler"
+
+// taskState returns the name of the saved-state byte of the task name.
+// Piccolo identifiers can't contain underscores, so it can't collide
+// with a user variable.
+func taskState(name string) string {
+	return "_task_" + name
+}
+
+// taskGen is the task being compiled.
+type taskGen struct {
+	state   string   // register holding the resume point
+	resume  []string // labels of the resume points, the start first
+	suspend string   // label of a RETURN that ends the step
+}
+
+// declareTaskStates declares the saved-state byte of every task that
+// can suspend, so that it is allocated and cleared with the variables.
+func declareTaskStates(prog Program) {
+	for _, t := range prog.Tasks {
+		if suspends(t.Body...) {
+			name := taskState(t.Name)
+			prog.Variables[name] = Variable{Name: name, Type: "i8", Banked: true, Range: t.Range}
+		}
+	}
+}
+
+// suspends reports whether any of stmts yields or waits.
+func suspends(stmts ...Stmt) bool {
+	for _, stmt := range stmts {
+		var found bool
+		switch s := stmt.(type) {
+		case YieldStmt, WaitStmt:
+			found = true
+		case BlockStmt:
+			found = suspends(s.Body...)
+		case AtomicStmt:
+			found = suspends(s.Body...)
+		case TimedStmt:
+			found = suspends(s.Body...)
+		case IfStmt:
+			found = suspends(s.Then)
+		case CaseStmt:
+			found = suspends(s.Else...)
+			for _, arm := range s.Arms {
+				found = found || suspends(arm.Body)
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTasks reports tasks whose names are already taken.
+func (c *asmGen) checkTasks() DiagnosticList {
+	var diagnostics DiagnosticList
+	seen := map[string]bool{}
+	for _, fn := range c.prog.Functions {
+		seen[fn.Name] = true
+		if fn.Name == schedulerLabel && len(c.prog.Tasks) > 0 {
+			diagnostics = append(diagnostics, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("fn %s clashes with the scheduler generated for the tasks", schedulerLabel),
+				Range:   fn.Range,
+			})
+		}
+	}
+	for _, t := range c.prog.Tasks {
+		if seen[t.Name] || t.Name == schedulerLabel {
+			diagnostics = append(diagnostics, Diagnostic{
+				Code:    ErrType,
+				Message: fmt.Sprintf("task %s has the same name as another function or task", t.Name),
+				Range:   t.Range,
+			})
+		}
+		seen[t.Name] = true
+	}
+	return diagnostics
+}
+
+// compileTask returns the step routine of t.
+func (c *asmGen) compileTask(t Task) ([]PicOp, DiagnosticList) {
+	tg := &taskGen{}
+	if v, ok := c.prog.Variables[taskState(t.Name)]; ok {
+		tg.state = hexAddr(v.Address)
+		tg.resume = []string{c.newLabel("start")}
+		tg.suspend = c.newLabel("suspend")
+	}
+	c.task = tg
+	defer func() { c.task = nil }()
+
+	var diagnostics DiagnosticList
+	var body []PicOp
+	for _, stmt := range t.Body {
+		compiled, err := c.compileStmt(stmt)
+		if err != nil {
+			diagnostics = append(diagnostics, asDiagnostic(err, stmt.Position()))
+			continue
+		}
+		body = append(body, compiled...)
+	}
+
+	ops := []PicOp{LabelOp{Name: t.Name}}
+	if tg.state == "" {
+		return append(append(ops, body...), Return{}), diagnostics
+	}
+	if len(tg.resume) > 256 {
+		diagnostics = append(diagnostics, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("task %s has %d resume points, more than its state byte can count", t.Name, len(tg.resume)),
+			Range:   t.Range,
+		})
+	}
+	ops = append(ops, Movf{F: tg.state, D: DestW}, Brw{})
+	for _, label := range tg.resume {
+		ops = append(ops, Goto{Label: label})
+	}
+	ops = append(ops, LabelOp{Name: tg.resume[0]})
+	ops = append(ops, body...)
+	ops = append(ops, Clrf{F: tg.state}, Return{})
+	if jumpsTo(ops, tg.suspend) {
+		ops = append(ops, LabelOp{Name: tg.suspend}, Return{})
+	}
+	return ops, diagnostics
+}
+
+// compileSuspend compiles a yield or a wait of the task being compiled.
+//
+//	yield         -> state = k; RETURN; resume k:
+//	wait until c  -> state = k; resume k: if not c, RETURN
+func (c *asmGen) compileSuspend(stmt Stmt) ([]PicOp, error) {
+	what := "yield"
+	if _, ok := stmt.(WaitStmt); ok {
+		what = "wait"
+	}
+	switch {
+	case c.task == nil:
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s can only be used in the body of a task", what),
+			Range:   stmt.Position(),
+		}
+	case c.gie != nil:
+		return nil, Diagnostic{
+			Code:    ErrType,
+			Message: fmt.Sprintf("%s in an atomic block would leave interrupts disabled until the task resumes", what),
+			Range:   stmt.Position(),
+		}
+	}
+
+	k := len(c.task.resume)
+	label := c.newLabel("resume")
+	c.task.resume = append(c.task.resume, label)
+	ops := []PicOp{Movlw{K: k}, Movwf{F: c.task.state}}
+	switch s := stmt.(type) {
+	case YieldStmt:
+		return append(ops, Return{}, LabelOp{Name: label}), nil
+	case WaitStmt:
+		cond, err := c.condJump(s.Cond, c.task.suspend, false)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, LabelOp{Name: label})
+		return append(ops, cond...), nil
+	}
+	return nil, nil
+}
+
+// restartTask returns code that makes the next step of the task being
+// compiled, if any, start it over.
+func (c *asmGen) restartTask() []PicOp {
+	if c.task == nil || c.task.state == "" {
+		return nil
+	}
+	return []PicOp{Clrf{F: c.task.state}}
+}
+
+// schedulerOps returns the scheduler, which runs a step of every task in
+// turn and never returns.
+func (c *asmGen) schedulerOps() []PicOp {
+	if len(c.prog.Tasks) == 0 {
+		return nil
+	}
+	loop := c.newLabel("schedule")
+	ops := []PicOp{LabelOp{Name: schedulerLabel}, LabelOp{Name: loop}}
+	for _, t := range c.prog.Tasks {
+		ops = append(ops, CallOp{Label: t.Name})
+	}
+	return append(ops, Goto{Label: loop})
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+const tasksInput = `
+section data
+common:
+  x i8
+  go i8
+  n i8
+section program
+fn main() begin
+  scheduler()
+end
+task counter begin
+  x = 1
+  yield
+  x = 2
+  wait until go == 1
+  if go == 1 then begin
+    x = 3
+    yield
+  end
+end
+task other begin
+  n += 1
+end
+`
+
+func TestParseTasks(t *testing.T) {
+	toks, err := Lex(tasksInput)
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	prog, err := Parse(toks)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(prog.Tasks) != 2 || prog.Tasks[0].Name != "counter" || len(prog.Tasks[0].Body) != 5 {
+		t.Fatalf("unexpected tasks %+v", prog.Tasks)
+	}
+	if w, ok := prog.Tasks[0].Body[3].(WaitStmt); !ok || w.String() != "wait until go EQEQ 1" {
+		t.Errorf("expected a wait, got %v", prog.Tasks[0].Body[3])
+	}
+
+	for _, tt := range []struct {
+		input string
+		msg   string
+	}{
+		{"section program\ntask t begin\n  wait go\nend\n", "expected until after wait"},
+		{"section program\ntask begin\nend\n", "expected task name"},
+		{"section program\ntask t\n  yield\nend\n", "expected begin after task t"},
+	} {
+		toks, err := Lex(tt.input)
+		if err != nil {
+			t.Fatalf("Lex failed: %v", err)
+		}
+		if _, err := Parse(toks); err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.msg, err)
+		}
+	}
+}
+
+func TestCompileTasks(t *testing.T) {
+	ops, syms, err := compileBody(tasksInput)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	state, ok := syms.GetAddress("_task_counter")
+	if !ok {
+		t.Fatal("expected a state byte for counter")
+	}
+	if _, ok := syms.GetAddress("_task_other"); ok {
+		t.Error("other never suspends, so it needs no state byte")
+	}
+
+	var got []string
+	for _, op := range ops {
+		got = append(got, op.Assembly())
+	}
+	listing := strings.Join(got, "\n")
+	s := hexAddr(state)
+	for _, want := range []string{
+		"counter:\nMOVF " + s + ",0\nBRW\n GOTO _start_1\n GOTO _resume_3\n GOTO _resume_4\n GOTO _resume_5\n_start_1:",
+		"MOVLW 1\nMOVWF " + s + "\nRETURN\n_resume_3:",
+		"MOVLW 2\nMOVWF " + s + "\n_resume_4:",
+		"CLRF " + s + "\nRETURN\n_suspend_2:\nRETURN\nother:",
+		"other:\nINCF 0x71,1\nRETURN\nscheduler:\n_schedule_7:\n CALL counter\n CALL other\n GOTO _schedule_7",
+	} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("expected\n%s\nin\n%s", want, listing)
+		}
+	}
+	if _, _, err := Assemble(ops, syms); err != nil {
+		t.Errorf("Assemble failed: %v", err)
+	}
+}
+
+// TestTasksSim runs the steps of counter one at a time. The step after
+// the last yield runs off the end, which starts the task over.
+func TestTasksSim(t *testing.T) {
+	ops, syms, err := compileBody(tasksInput)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	addr := func(name string) string {
+		a, _ := syms.GetAddress(name)
+		return hexAddr(a)
+	}
+	m := newCPU(t, ops, map[string]int{})
+	for i, step := range []struct {
+		go_, x int
+	}{{0, 1}, {0, 2}, {0, 2}, {1, 3}, {1, 3}, {0, 1}, {0, 2}} {
+		m.regs[addr("go")] = step.go_
+		m.call("counter")
+		if got := m.regs[addr("x")]; got != step.x {
+			t.Errorf("step %d: expected x = %d, got %d", i, step.x, got)
+		}
+	}
+}
+
+func TestTaskErrors(t *testing.T) {
+	tests := []struct {
+		program string
+		msg     string
+	}{
+		{"fn main() begin\n  yield\nend", "yield can only be used in the body of a task"},
+		{"fn main() begin\n  wait until x == 1\nend", "wait can only be used in the body of a task"},
+		{"task t begin\n  atomic begin\n    yield\n  end\nend", "yield in an atomic block would leave interrupts disabled"},
+		{"fn t() begin\nend\ntask t begin\nend", "task t has the same name as another function or task"},
+		{"task t begin\nend\ntask t begin\nend", "task t has the same name as another function or task"},
+		{"fn scheduler() begin\nend\ntask t begin\nend", "fn scheduler clashes with the scheduler generated for the tasks"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody("section data\ncommon:\n  x i8\nsection program\n" + tt.program + "\n")
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.program, tt.msg, err)
+		}
+	}
+}
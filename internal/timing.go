@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A within or exactly block is checked once all the code is generated,
+// since the time a call takes depends on code that may come later. The
+// block's code is bracketed by labels, and the time from one to the
+// other is worked out from the instructions between them: a cycle for
+// each word, and another for a branch, call or return or for a skip
+// that skips, as in notes/pic16-isa.md. The MOVLBs the assembler adds
+// are found by assembling the whole program, as they depend on the bank
+// selected on the way into the block. Branches
+// only go forward, except in counted loops like those of delays and the
+// multiply and divide helpers. Interrupts are not counted; put the block
+// in an atomic block to keep them out.
+
+// timedBlock is a within or exactly block waiting to be checked.
+type timedBlock struct {
+	TimedStmt
+	cycles     int
+	start, end string // labels around its code
+}
+
+// cycleRange is the fewest and most cycles some code can take.
+type cycleRange struct {
+	lo, hi int
+}
+
+func (r cycleRange) add(s cycleRange) cycleRange {
+	return cycleRange{r.lo + s.lo, r.hi + s.hi}
+}
+
+// join returns a range covering both r and s.
+func (r cycleRange) join(s cycleRange) cycleRange {
+	return cycleRange{min(r.lo, s.lo), max(r.hi, s.hi)}
+}
+
+func (r cycleRange) String() string {
+	if r.lo == r.hi {
+		return fmt.Sprintf("%d cycles", r.lo)
+	}
+	return fmt.Sprintf("%d to %d cycles", r.lo, r.hi)
+}
+
+func (c *asmGen) compileTimed(s TimedStmt) ([]PicOp, error) {
+	cycles, err := c.delayCycles(s.kind(), DelayStmt{Amount: s.Amount, Unit: s.Unit, Range: s.Range})
+	if err != nil {
+		return nil, err
+	}
+	tb := timedBlock{TimedStmt: s, cycles: int(cycles), start: c.newLabel("timed"), end: c.newLabel("timed_end")}
+	body, err := c.compileStmt(BlockStmt{Body: s.Body, Range: s.Range})
+	if err != nil {
+		return nil, err
+	}
+	c.timed = append(c.timed, tb)
+	ops := append([]PicOp{LabelOp{Name: tb.start}}, body...)
+	return append(ops, LabelOp{Name: tb.end}), nil
+}
+
+// checkTiming reports the within and exactly blocks that take the wrong
+// time. syms must hold every register the code uses.
+func (c *asmGen) checkTiming(ops []PicOp, syms SymbolTable) DiagnosticList {
+	if len(c.timed) == 0 {
+		return nil
+	}
+	t, err := newTimer(ops, syms)
+	if err != nil {
+		// Assembling the program will report it.
+		return nil
+	}
+
+	var diagnostics DiagnosticList
+	for _, tb := range c.timed {
+		r, err := t.span(t.labels[tb.start], t.labels[tb.end])
+		var msg string
+		switch {
+		case err != nil:
+			msg = fmt.Sprintf("can't work out how long this %s block takes: %v", tb.kind(), err)
+		case tb.Exact && (r.lo != tb.cycles || r.hi != tb.cycles):
+			msg = fmt.Sprintf("the block should take exactly %d cycles, but takes %v", tb.cycles, r)
+		case !tb.Exact && r.hi > tb.cycles:
+			msg = fmt.Sprintf("the block should take at most %d cycles, but takes %v", tb.cycles, r)
+		default:
+			continue
+		}
+		diagnostics = append(diagnostics, Diagnostic{Code: ErrType, Message: msg, Range: tb.Range})
+	}
+	return diagnostics
+}
+
+// countedLoop is a loop run a fixed number of times by a DECFSZ.
+type countedLoop struct {
+	decfsz int // index of the DECFSZ, which the GOTO back follows
+	count  int
+}
+
+// timer works out how long code takes.
+type timer struct {
+	ops      []PicOp
+	words    []int                  // words each op assembles to
+	labels   map[string]int         // index of each label
+	loops    map[int]countedLoop    // by index of the label they loop back to
+	routines map[string]*cycleRange // time of each routine called, nil while it is being worked out
+}
+
+func newTimer(ops []PicOp, syms SymbolTable) (*timer, error) {
+	words, err := NewAssemblerContext(scratchSymbols(syms)).encode(ops)
+	if err != nil {
+		return nil, err
+	}
+	t := &timer{
+		ops:      ops,
+		words:    words,
+		labels:   map[string]int{},
+		loops:    map[int]countedLoop{},
+		routines: map[string]*cycleRange{},
+	}
+	for i, op := range ops {
+		if l, ok := op.(LabelOp); ok {
+			t.labels[l.Name] = i
+		}
+	}
+
+	// A counted loop is
+	//
+	//	MOVLW n; MOVWF count; ...; loop: <body>; DECFSZ count,1; GOTO loop
+	//
+	// with nothing but straight-line code between the MOVWF and the label.
+	for i, op := range ops {
+		g, ok := op.(Goto)
+		head, back := t.labels[g.Label]
+		if !ok || !back || head >= i || i < 1 {
+			continue
+		}
+		d, ok := ops[i-1].(Decfsz)
+		if !ok || d.D != DestF {
+			continue
+		}
+	scan:
+		for j := head - 1; j > 0; j-- {
+			switch op := ops[j].(type) {
+			case Movwf:
+				if op.F != d.F {
+					continue
+				}
+				if k, ok := ops[j-1].(Movlw); ok {
+					count := k.K & 0xFF
+					if count == 0 {
+						count = 256
+					}
+					t.loops[head] = countedLoop{decfsz: i - 1, count: count}
+				}
+				break scan
+			case LabelOp, Goto, CallOp, Callw, Brw, Return, Retlw, Retfie:
+				break scan
+			}
+		}
+	}
+	return t, nil
+}
+
+// span returns the time from entering ops[from] to reaching ops[stop],
+// or leaving through a return. stop is -1 for a routine.
+func (t *timer) span(from, stop int) (cycleRange, error) {
+	reach := map[int]cycleRange{from: {}}
+	arrive := func(i int, r cycleRange) {
+		if cur, ok := reach[i]; ok {
+			r = cur.join(r)
+		}
+		reach[i] = r
+	}
+	var exit *cycleRange
+	leave := func(r cycleRange) {
+		if exit != nil {
+			r = exit.join(r)
+		}
+		exit = &r
+	}
+
+	for i := from; i < len(t.ops); i++ {
+		r, ok := reach[i]
+		if !ok {
+			continue
+		}
+		if i == stop {
+			leave(r)
+			continue
+		}
+		w := t.words[i] // including any MOVLB
+		cost := cycleRange{w, w}
+		branch := cycleRange{w + 1, w + 1}
+		switch op := t.ops[i].(type) {
+		case LabelOp:
+			loop, ok := t.loops[i]
+			if !ok {
+				arrive(i+1, r)
+				continue
+			}
+			body, err := t.span(i+1, loop.decfsz)
+			if err != nil {
+				return cycleRange{}, err
+			}
+			// Every pass runs the body and the DECFSZ, and all but the
+			// last go back with the GOTO.
+			dec, back := t.words[loop.decfsz], t.words[loop.decfsz+1]+1
+			pass := body.add(cycleRange{dec + back, dec + back})
+			last := body.add(cycleRange{dec + 1, dec + 1})
+			total := last
+			for range loop.count - 1 {
+				total = total.add(pass)
+			}
+			arrive(loop.decfsz+2, r.add(total))
+		case Goto:
+			j, ok := t.labels[op.Label]
+			if !ok {
+				return cycleRange{}, fmt.Errorf("undefined label %s", op.Label)
+			}
+			if j <= i {
+				return cycleRange{}, fmt.Errorf("the loop back to %s doesn't run a fixed number of times", op.Label)
+			}
+			arrive(j, r.add(branch))
+		case CallOp:
+			callee, err := t.routine(op.Label)
+			if err != nil {
+				return cycleRange{}, err
+			}
+			arrive(i+1, r.add(branch).add(callee))
+		case Callw:
+			return cycleRange{}, errors.New("a call through a function table could call anything")
+		case Brw:
+			// A jump table of GOTOs follows.
+			for j := i + 1; j < len(t.ops); j++ {
+				if _, ok := t.ops[j].(Goto); !ok {
+					break
+				}
+				arrive(j, r.add(branch))
+			}
+		case Return, Retlw, Retfie:
+			leave(r.add(branch))
+		case Btfsc, Btfss, Decfsz, Incfsz:
+			arrive(i+1, r.add(cost))
+			next := i + 1
+			for next < len(t.ops) && t.words[next] == 0 {
+				next++
+			}
+			arrive(next+1, r.add(branch))
+		default:
+			arrive(i+1, r.add(cost))
+		}
+	}
+	if exit == nil {
+		return cycleRange{}, errors.New("it never finishes")
+	}
+	return *exit, nil
+}
+
+// routine returns the time a call to label takes once it is running,
+// up to and including its return.
+func (t *timer) routine(label string) (cycleRange, error) {
+	if r, ok := t.routines[label]; ok {
+		if r == nil {
+			return cycleRange{}, fmt.Errorf("%s calls itself", label)
+		}
+		return *r, nil
+	}
+	i, ok := t.labels[label]
+	if !ok {
+		return cycleRange{}, fmt.Errorf("undefined label %s", label)
+	}
+	t.routines[label] = nil
+	r, err := t.span(i, -1)
+	if err != nil {
+		delete(t.routines, label)
+		return cycleRange{}, fmt.Errorf("in %s: %w", label, err)
+	}
+	t.routines[label] = &r
+	return r, nil
+}
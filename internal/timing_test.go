@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const timingHeader = `
+section configuration
+fosc: 32MHz
+section data
+common:
+  x i8
+  y i8
+banked:
+  z i8
+section program
+fn f() begin
+  x = 1
+  return
+end
+table handlers [ f ]
+`
+
+func TestParseTimed(t *testing.T) {
+	toks, err := Lex("section program\nfn main() begin\n  within 12 cycles begin\n  end\n  exactly 8cycles begin\n  end\n  within 2 us begin\n  end\nend\n")
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	prog, err := Parse(toks)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	var got []string
+	for _, stmt := range prog.Functions[0].Body {
+		got = append(got, stmt.String())
+	}
+	want := "within 12 cycles begin\nend|exactly 8cycles begin\nend|within 2 us begin\nend"
+	if strings.Join(got, "|") != want {
+		t.Errorf("expected %q, got %q", want, strings.Join(got, "|"))
+	}
+
+	toks, err = Lex("section program\nfn main() begin\n  within 12 cycles\n    x = 1\nend\n")
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	if _, err := Parse(toks); err == nil || !strings.Contains(err.Error(), "expected begin after within 12") {
+		t.Errorf("expected a missing begin error, got %v", err)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	tests := []struct {
+		body string
+		msg  string // empty if the constraint holds
+	}{
+		// MOVF, XORLW, BTFSS and GOTO, or a skip and the assignment
+		{"within 6 cycles begin\n  if x == 1 then y = 2\nend", ""},
+		{"within 5 cycles begin\n  if x == 1 then y = 2\nend", "should take at most 5 cycles, but takes 5 to 6 cycles"},
+		{"exactly 6 cycles begin\n  if x == 1 then y = 2\nend", "should take exactly 6 cycles, but takes 5 to 6 cycles"},
+		// z's bank is still selected from the startup code, unless BSR
+		// is changed and the first store to z needs a MOVLB.
+		{"exactly 6 cycles begin\n  z = 1\n  x = 1\n  z = 2\nend", ""},
+		{"bsr = w\nexactly 7 cycles begin\n  z = 1\n  x = 1\n  z = 2\nend", ""},
+		// CALL, MOVLW, MOVWF and RETURN
+		{"exactly 6 cycles begin\n  f()\nend", ""},
+		{"exactly 78 cycles begin\n  y = x * y\nend", ""},
+		{"within 13 cycles begin\n  case x of\n    0: y = 1\n    1: y = 2\n  end\nend", ""},
+		{"within 12 cycles begin\n  case x of\n    0: y = 1\n    1: y = 2\n  end\nend", "takes 5 to 13 cycles"},
+		{"exactly 250ns begin\n  x = 1\nend", ""},
+		{"exactly 1us begin\n  x = 1\nend", "should take exactly 8 cycles, but takes 2 cycles"},
+		{"exactly 2 cycles begin\n  exactly 1 cycles begin\n    x = 1\n  end\nend", "should take exactly 1 cycles, but takes 2 cycles"},
+		{"within 10 cycles begin\n  handlers[x]()\nend", "can't work out how long this within block takes: a call through a function table could call anything"},
+		{"within 10 cycles begin\n  x = 1\nend\nwithin 3 begin\nend", "within 3 needs a unit"},
+		{"within 10 cycles begin\n  x = 1\nend\nexactly 1kHz begin\nend", "exactly needs a time, but 1kHz is a frequency"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody(timingHeader + inMain(tt.body))
+		switch {
+		case tt.msg == "" && err != nil:
+			t.Errorf("%q: expected the constraint to hold, got %v", tt.body, err)
+		case tt.msg != "" && (err == nil || !strings.Contains(err.Error(), tt.msg)):
+			t.Errorf("%q: expected error containing %q, got %v", tt.body, tt.msg, err)
+		}
+	}
+}
+
+// TestTimingDelays checks that delays take exactly as long as asked,
+// loops and all.
+func TestTimingDelays(t *testing.T) {
+	for _, n := range []int{0, 1, 6, 7, 8, 9, 100, 768, 769, 770, 771, 5000, 197_000, 50_000_000} {
+		body := fmt.Sprintf("exactly %d cycles begin\n  delay %d cycles\nend", n, n)
+		if _, _, err := compileBody(timingHeader + inMain(body)); err != nil {
+			t.Errorf("delay %d: %v", n, err)
+		}
+	}
+}
+
+// TestTimingHelpers checks the worst cases of the helpers against the
+// cycle counts their calls are annotated with. _unpack is left out, as
+// its count doesn't include the MOVLBs the assembler adds to it.
+func TestTimingHelpers(t *testing.T) {
+	for name, h := range helpers {
+		if name == "_unpack" {
+			continue
+		}
+		c := &asmGen{}
+		ops := append([]PicOp{LabelOp{Name: name}}, h.ops(c)...)
+		syms := NewSymbolTable()
+		for i, temp := range c.temps {
+			syms.SetAddress(temp, 0x70+i)
+		}
+		tm, err := newTimer(ops, syms)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		r, err := tm.routine(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if r.hi+2 != h.cycles {
+			t.Errorf("%s: expected at most %d cycles with the CALL, got %v", name, h.cycles, r)
+		}
+	}
+}
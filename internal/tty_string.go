@@ -11,47 +11,90 @@ func _() {
 	_ = x[UNKNOWN-0]
 	_ = x[EOF-1]
 	_ = x[EQL-2]
-	_ = x[NEQ-3]
-	_ = x[INC-4]
-	_ = x[DEC-5]
-	_ = x[ANDEQL-6]
-	_ = x[OREQL-7]
-	_ = x[XOREQL-8]
-	_ = x[ADDEQL-9]
-	_ = x[SUBEQL-10]
-	_ = x[MINUS-11]
-	_ = x[LBRACK-12]
-	_ = x[RBRACK-13]
-	_ = x[LPAREN-14]
-	_ = x[RPAREN-15]
-	_ = x[COLON-16]
-	_ = x[FN-17]
-	_ = x[BEGIN-18]
-	_ = x[END-19]
-	_ = x[RETURN-20]
-	_ = x[IF-21]
-	_ = x[THEN-22]
-	_ = x[NOT-23]
-	_ = x[SECTION-24]
-	_ = x[CONSTANTS-25]
-	_ = x[DATA-26]
-	_ = x[PROGRAM-27]
-	_ = x[CONFIGURATION-28]
-	_ = x[BANKED-29]
-	_ = x[COMMON-30]
-	_ = x[I8-31]
-	_ = x[AT-32]
-	_ = x[IDENT-33]
-	_ = x[NUM_First-34]
-	_ = x[NUMDECIMAL-35]
-	_ = x[NUMHEX-36]
-	_ = x[NUMBINARY-37]
-	_ = x[NUM_Last-38]
+	_ = x[EQEQ-3]
+	_ = x[NEQ-4]
+	_ = x[INC-5]
+	_ = x[DEC-6]
+	_ = x[ANDEQL-7]
+	_ = x[OREQL-8]
+	_ = x[XOREQL-9]
+	_ = x[ADDEQL-10]
+	_ = x[SUBEQL-11]
+	_ = x[MINUS-12]
+	_ = x[PLUS-13]
+	_ = x[STAR-14]
+	_ = x[SLASH-15]
+	_ = x[PERCENT-16]
+	_ = x[AMP-17]
+	_ = x[PIPE-18]
+	_ = x[CARET-19]
+	_ = x[SHL-20]
+	_ = x[SHR-21]
+	_ = x[LT-22]
+	_ = x[GT-23]
+	_ = x[LE-24]
+	_ = x[GE-25]
+	_ = x[HASH-26]
+	_ = x[LBRACK-27]
+	_ = x[RBRACK-28]
+	_ = x[LPAREN-29]
+	_ = x[RPAREN-30]
+	_ = x[COLON-31]
+	_ = x[COMMA-32]
+	_ = x[DOTDOT-33]
+	_ = x[INDENT-34]
+	_ = x[DEDENT-35]
+	_ = x[FN-36]
+	_ = x[BEGIN-37]
+	_ = x[END-38]
+	_ = x[RETURN-39]
+	_ = x[IF-40]
+	_ = x[THEN-41]
+	_ = x[NOT-42]
+	_ = x[AND-43]
+	_ = x[OR-44]
+	_ = x[SECTION-45]
+	_ = x[CONSTANTS-46]
+	_ = x[DATA-47]
+	_ = x[PROGRAM-48]
+	_ = x[CONFIGURATION-49]
+	_ = x[BANKED-50]
+	_ = x[COMMON-51]
+	_ = x[I8-52]
+	_ = x[I16-53]
+	_ = x[AT-54]
+	_ = x[DELAY-55]
+	_ = x[ENUM-56]
+	_ = x[CASE-57]
+	_ = x[OF-58]
+	_ = x[ELSE-59]
+	_ = x[TABLE-60]
+	_ = x[OVERLAY-61]
+	_ = x[WHEN-62]
+	_ = x[ATOMIC-63]
+	_ = x[ROM-64]
+	_ = x[PACKED-65]
+	_ = x[TASK-66]
+	_ = x[YIELD-67]
+	_ = x[WAIT-68]
+	_ = x[UNTIL-69]
+	_ = x[ASSERT-70]
+	_ = x[BUDGET-71]
+	_ = x[WITHIN-72]
+	_ = x[EXACTLY-73]
+	_ = x[IDENT-74]
+	_ = x[STRING-75]
+	_ = x[NUM_First-76]
+	_ = x[NUMDECIMAL-77]
+	_ = x[NUMHEX-78]
+	_ = x[NUMBINARY-79]
+	_ = x[NUMUNIT-80]
+	_ = x[NUM_Last-81]
 }
 
-const _TTy_name = "UNKNOWNEOFEQLNEQINCDECANDEQLOREQLXOREQLADDEQLSUBEQLMINUSLBRACKRBRACKLPARENRPARENCOLONFNBEGINENDRETURNIFTHENNOTSECTIONCONSTANTSDATAPROGRAMCONFIGURATIONBANKEDCOMMONI8ATIDENTNUM_FirstNUMDECIMALNUMHEXNUMBINARYNUM_Last"
+const _TTy_name = "UNKNOWNEOFEQLEQEQNEQINCDECANDEQLOREQLXOREQLADDEQLSUBEQLMINUSPLUSSTARSLASHPERCENTAMPPIPECARETSHLSHRLTGTLEGEHASHLBRACKRBRACKLPARENRPARENCOLONCOMMADOTDOTINDENTDEDENTFNBEGINENDRETURNIFTHENNOTANDORSECTIONCONSTANTSDATAPROGRAMCONFIGURATIONBANKEDCOMMONI8I16ATDELAYENUMCASEOFELSETABLEOVERLAYWHENATOMICROMPACKEDTASKYIELDWAITUNTILASSERTBUDGETWITHINEXACTLYIDENTSTRINGNUM_FirstNUMDECIMALNUMHEXNUMBINARYNUMUNITNUM_Last"
 
-var _TTy_index = [...]uint8{0, 7, 10, 13, 16, 19, 22, 28, 33, 39, 45, 51, 56, 62, 68, 74, 80, 85, 87, 92, 95, 101, 103, 107, 110, 117, 126, 130, 137, 150, 156, 162, 164, 166, 171, 180, 190, 196, 205, 213}
+var _TTy_index = [...]uint16{0, 7, 10, 13, 17, 20, 23, 26, 32, 37, 43, 49, 55, 60, 64, 68, 73, 80, 83, 87, 92, 95, 98, 100, 102, 104, 106, 110, 116, 122, 128, 134, 139, 144, 150, 156, 162, 164, 169, 172, 178, 180, 184, 187, 190, 192, 199, 208, 212, 219, 232, 238, 244, 246, 249, 251, 256, 260, 264, 266, 270, 275, 282, 286, 292, 295, 301, 305, 310, 314, 319, 325, 331, 337, 344, 349, 355, 364, 374, 380, 389, 396, 404}
 
 func (i TTy) String() string {
 	idx := int(i) - 0
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// A decimal literal may carry a unit: 1ms, 250us, 32MHz, 9600baud. A
+// time is kept in nanoseconds, a frequency in hertz and a baud rate in
+// bits per second, so constants with units can be added, scaled and
+// divided by each other exactly. Used as a value, a time becomes the
+// number of instruction cycles it takes, a frequency the number of
+// cycles in one period, and a baud rate the SPBRG value that gives it
+// with BRGH and BRG16 set, all worked out from fosc.
+
+type Unit int
+
+const (
+	NoUnit Unit = iota
+	TimeUnit
+	FreqUnit
+	BaudUnit
+)
+
+func (u Unit) String() string {
+	switch u {
+	case TimeUnit:
+		return "time"
+	case FreqUnit:
+		return "frequency"
+	case BaudUnit:
+		return "baud rate"
+	}
+	return "plain number"
+}
+
+// unitSuffixes maps the suffix of a literal to its unit and the size of
+// one of it in the unit's base.
+var unitSuffixes = map[string]struct {
+	unit  Unit
+	scale int
+}{
+	"cycles": {NoUnit, 1},
+	"s":      {TimeUnit, 1_000_000_000},
+	"ms":     {TimeUnit, 1_000_000},
+	"us":     {TimeUnit, 1_000},
+	"ns":     {TimeUnit, 1},
+	"Hz":     {FreqUnit, 1},
+	"kHz":    {FreqUnit, 1_000},
+	"MHz":    {FreqUnit, 1_000_000},
+	"baud":   {BaudUnit, 1},
+}
+
+// splitUnit splits a NUMUNIT literal into its digits and its suffix.
+func splitUnit(val string) (string, string) {
+	i := strings.IndexFunc(val, unicode.IsLetter)
+	if i < 0 {
+		return val, ""
+	}
+	return val[:i], val[i:]
+}
+
+// quantity is a constant and its unit, in the unit's base.
+type quantity struct {
+	Value int
+	Unit  Unit
+}
+
+// quantity evaluates e as a constant with a unit. ok is false if e is
+// not constant; err reports units that don't go together.
+func (c *asmGen) quantity(e Expr) (quantity, bool, error) {
+	switch e := e.(type) {
+	case NumExpr:
+		return quantity{e.Value, e.Unit}, true, nil
+	case IdentExpr:
+		if val, ok := c.valueConst(e.Name); ok {
+			return quantity{val, c.prog.Units[e.Name]}, true, nil
+		}
+	case UnaryExpr:
+		if e.Op == HASH {
+			return c.quantity(e.Expr)
+		}
+	case BinaryExpr:
+		if !isArith(e.Op) {
+			break
+		}
+		a, ok, err := c.quantity(e.Lhs)
+		if err != nil || !ok {
+			return quantity{}, false, err
+		}
+		b, ok, err := c.quantity(e.Rhs)
+		if err != nil || !ok {
+			return quantity{}, false, err
+		}
+		return c.combine(e, a, b)
+	}
+	return quantity{}, false, nil
+}
+
+// combine applies the operator of e to a and b.
+func (c *asmGen) combine(e BinaryExpr, a, b quantity) (quantity, bool, error) {
+	fold := func(a, b int, u Unit) (quantity, bool, error) {
+		val, ok := foldOp(e.Op, a, b)
+		return quantity{val, u}, ok, nil
+	}
+	switch {
+	case a.Unit == b.Unit && (e.Op == PLUS || e.Op == MINUS):
+		return fold(a.Value, b.Value, a.Unit)
+	case a.Unit == b.Unit && a.Unit != NoUnit && e.Op == SLASH:
+		// A ratio, such as 1ms / 250us
+		return fold(a.Value, b.Value, NoUnit)
+	case a.Unit == NoUnit && b.Unit == NoUnit:
+		return fold(a.Value, b.Value, NoUnit)
+	case (a.Unit == NoUnit || b.Unit == NoUnit) && (e.Op == PLUS || e.Op == MINUS):
+		// A plain number counts cycles.
+		var err error
+		if a.Unit != NoUnit {
+			a.Value, err = c.unitValue(a, e.Lhs)
+		} else {
+			b.Value, err = c.unitValue(b, e.Rhs)
+		}
+		if err != nil {
+			return quantity{}, false, err
+		}
+		return fold(a.Value, b.Value, NoUnit)
+	case b.Unit == NoUnit && (e.Op == STAR || e.Op == SLASH):
+		return fold(a.Value, b.Value, a.Unit)
+	case a.Unit == NoUnit && e.Op == STAR:
+		return fold(a.Value, b.Value, b.Unit)
+	case e.Op == STAR && (a.Unit == TimeUnit) != (b.Unit == TimeUnit):
+		// The number of periods of a frequency in a time, such as
+		// 1ms * 32kHz
+		return quantity{int(roundDiv(int64(a.Value)*int64(b.Value), 1_000_000_000)), NoUnit}, true, nil
+	}
+	return quantity{}, false, Diagnostic{
+		Code:    ErrType,
+		Message: fmt.Sprintf("mismatched units: %v combines a %s with a %s", e, a.Unit, b.Unit),
+		Range:   e.Range,
+	}
+}
+
+// unitConst evaluates e if it is constant, converting a result with a
+// unit to a plain number. Units are only converted once the arithmetic
+// is done, so 1ms * 32kHz is 32 whatever fosc is.
+func (c *asmGen) unitConst(e Expr) (int, bool, error) {
+	q, ok, err := c.quantity(e)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	k, err := c.unitValue(q, e)
+	return k, err == nil, err
+}
+
+// unitValue converts q, the value of e, to a plain number using the
+// oscillator frequency.
+func (c *asmGen) unitValue(q quantity, e Expr) (int, error) {
+	if q.Unit == NoUnit {
+		return q.Value, nil
+	}
+	if c.prog.Fosc == 0 {
+		return 0, Diagnostic{
+			Code:    ErrUndefinedSymbol,
+			Message: fmt.Sprintf("%v needs the oscillator frequency; declare %s in the configuration section", e, foscKey),
+			Range:   e.Position(),
+		}
+	}
+	if q.Value <= 0 && q.Unit != TimeUnit {
+		return 0, Diagnostic{
+			Code:    ErrInvalidNumber,
+			Message: fmt.Sprintf("%v must be more than zero", e),
+			Range:   e.Position(),
+		}
+	}
+	// One instruction cycle is four oscillator periods.
+	fosc := int64(c.prog.Fosc)
+	switch q.Unit {
+	case TimeUnit:
+		return int(roundDiv(int64(q.Value)*fosc, 4_000_000_000)), nil
+	case FreqUnit:
+		return int(roundDiv(fosc, 4*int64(q.Value))), nil
+	default:
+		return int(roundDiv(fosc, 4*int64(q.Value))) - 1, nil
+	}
+}
+
+// roundDiv returns a/b rounded to the nearest integer, for b > 0.
+func roundDiv(a, b int64) int64 {
+	if a < 0 {
+		return -roundDiv(-a, b)
+	}
+	return (a + b/2) / b
+}
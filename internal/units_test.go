@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLexUnits(t *testing.T) {
+	toks, err := Lex("32MHz 1_000us 9600baud 12cycles 5 ms")
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	want := []struct {
+		ty  TTy
+		val int
+	}{{NUMUNIT, 32_000_000}, {NUMUNIT, 1_000_000}, {NUMUNIT, 9600}, {NUMUNIT, 12}, {NUMDECIMAL, 5}}
+	for i, w := range want {
+		got, err := toks[i].Number()
+		if toks[i].ty != w.ty || err != nil || got != w.val {
+			t.Errorf("token %d: expected %v %d, got %v %d (%v)", i, w.ty, w.val, toks[i], got, err)
+		}
+	}
+	if toks[5].ty != IDENT {
+		t.Errorf("expected ms after a space to stay an identifier, got %v", toks[5])
+	}
+	if _, err := Lex("5furlongs"); err == nil || !strings.Contains(err.Error(), `unknown unit "furlongs"`) {
+		t.Errorf("expected an unknown unit error, got %v", err)
+	}
+}
+
+const unitsHeader = `
+section constants
+tick: 1ms
+section configuration
+fosc: 32MHz
+section data
+common:
+  x i8
+section program
+`
+
+func TestUnits(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int
+	}{
+		{"10us", 80},
+		{"tick / 250us", 4},
+		{"256 - 25us", 56},
+		{"(tick - 990us) / 2", 40},
+		{"38400baud", 207}, // 8 MIPS / 38400 = 208.3 cycles a bit
+		{"100kHz", 80},
+		{"1ms * 32kHz", 32},
+		{"#tick / 100", 80},
+	}
+	for _, tt := range tests {
+		input := unitsHeader + "fn main() begin\n  x = " + tt.expr + "\nend\n"
+		toks, err := Lex(input)
+		if err != nil {
+			t.Fatalf("Lex failed: %v", err)
+		}
+		prog, err := Parse(toks)
+		if err != nil {
+			t.Fatalf("%s: Parse failed: %v", tt.expr, err)
+		}
+		if prog.Fosc != 32_000_000 || prog.Units["tick"] != TimeUnit {
+			t.Fatalf("expected fosc 32MHz and tick to be a time, got %d and %v", prog.Fosc, prog.Units["tick"])
+		}
+		ops, _, err := compileBody(input)
+		if err != nil {
+			t.Errorf("%s: Compile failed: %v", tt.expr, err)
+			continue
+		}
+		if len(ops) < 2 || ops[1] != (Movlw{K: tt.want}) {
+			t.Errorf("%s: expected MOVLW %d, got %v", tt.expr, tt.want, ops)
+		}
+	}
+}
+
+func TestDelayWithUnits(t *testing.T) {
+	ops, _, err := compileBody(unitsHeader + "fn main() begin\n  delay 250us\n  delay tick + 1ms\n  delay 12cycles\n  delay 3 us\nend\n")
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	var comments []string
+	for _, op := range ops {
+		if c, ok := op.(CommentOp); ok && strings.HasPrefix(c.Text, "delay") {
+			comments = append(comments, c.Text)
+		}
+	}
+	want := []string{"delay 2000 cycles", "delay 16000 cycles", "delay 12 cycles", "delay 24 cycles"}
+	if strings.Join(comments, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, comments)
+	}
+}
+
+func TestUnitErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		msg   string
+	}{
+		{"section program\nfn main() begin\n  x = 1ms + 1MHz\nend", "mismatched units: 1ms PLUS 1MHz combines a time with a frequency"},
+		{"section program\nfn main() begin\n  x = 9600baud * 2kHz\nend", "combines a baud rate with a frequency"},
+		{"section program\nfn main() begin\n  x = 10 / 1ms\nend", "combines a plain number with a time"},
+		{"section program\nfn main() begin\n  x = 1ms\nend", "1ms needs the oscillator frequency; declare fosc"},
+		{"section configuration\nfosc: 4MHz\nsection program\nfn main() begin\n  x = 0Hz\nend", "0Hz must be more than zero"},
+		{"section configuration\nfosc: 4MHz\nsection program\nfn main() begin\n  delay 5\nend", "delay 5 needs a unit"},
+		{"section configuration\nfosc: 4MHz\nsection program\nfn main() begin\n  delay 1kHz\nend", "delay needs a time, but 1kHz is a frequency"},
+		{"section configuration\nfosc: 9600baud\n", "fosc is a frequency, not a baud rate"},
+		{"section configuration\nconf1: 1ms\n", "configuration conf1 can't have a unit"},
+		{"section constants\ntick: 1ms\nwhen tick == 1 begin\nend\n", "when can't use tick, which has a unit"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileBody("section data\ncommon:\n  x i8\n" + tt.input + "\n")
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.msg, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+const whenInput = `
+section constants
+board: 1
+enum rev [ a b c ]
+when board == 2 begin
+  led: 5
+end
+when not (board == 2) begin
+  led: 6
+  when board == 3 or board + 1 == 2 begin
+    nested: 1
+  end
+end
+section configuration
+when board != 1 begin
+  conf1: $1234
+end
+section data
+common:
+  x i8
+banked:
+when board == 3 begin
+  y i8
+end
+section program
+when board == 1 begin
+  fn extra() begin
+    return
+  end
+end
+fn main() begin
+  when board == 1 begin
+    x = 1
+    case x of 0: x = 2 end
+  end
+  when board == 2 begin
+    x = 2
+    case x of 0: x = 3 end
+    if x == 1 then begin x = 4 end
+  end
+end
+`
+
+func parseWhen(t *testing.T, input string, defines map[string]int) (Program, error) {
+	t.Helper()
+	toks, err := Lex(input)
+	if err != nil {
+		t.Fatalf("Lex failed: %v", err)
+	}
+	return ParseWithDefines(toks, defines)
+}
+
+func TestWhen(t *testing.T) {
+	prog, err := parseWhen(t, whenInput, nil)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if prog.Consts["led"] != 6 || prog.Consts["nested"] != 1 {
+		t.Errorf("expected led 6 and nested 1, got %v", prog.Consts)
+	}
+	if _, ok := prog.Configuration["conf1"]; ok {
+		t.Errorf("expected no conf1, got %v", prog.Configuration)
+	}
+	if _, ok := prog.Variables["y"]; ok {
+		t.Errorf("expected no y")
+	}
+	if len(prog.Functions) != 2 || prog.Functions[0].Name != "extra" {
+		t.Fatalf("expected extra and main, got %v", prog.Functions)
+	}
+	body := prog.Functions[1].Body
+	if len(body) != 2 {
+		t.Fatalf("expected two statements in main, got %v", body)
+	}
+	if b, ok := body[0].(BlockStmt); !ok || len(b.Body) != 2 {
+		t.Errorf("expected the first when to hold 2 statements, got %v", body[0])
+	}
+	if b, ok := body[1].(BlockStmt); !ok || len(b.Body) != 0 {
+		t.Errorf("expected the second when to be empty, got %v", body[1])
+	}
+}
+
+func TestWhenDefines(t *testing.T) {
+	prog, err := parseWhen(t, whenInput, map[string]int{"board": 3})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if prog.Consts["board"] != 3 {
+		t.Errorf("expected board 3, got %v", prog.Consts)
+	}
+	if _, ok := prog.Variables["y"]; !ok {
+		t.Errorf("expected y")
+	}
+	if prog.Configuration["conf1"] != 0x1234 {
+		t.Errorf("expected conf1, got %v", prog.Configuration)
+	}
+	if len(prog.Functions) != 1 {
+		t.Errorf("expected only main, got %v", prog.Functions)
+	}
+	if _, _, err := Compile(prog); err != nil {
+		t.Errorf("Compile failed: %v", err)
+	}
+}
+
+func TestUnusedDefines(t *testing.T) {
+	// debug isn't declared, but a when block tests it.
+	input := "section constants\nwhen debug == 1 begin\n  led: 1\nend\n"
+	prog, err := parseWhen(t, input, map[string]int{"debug": 1})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if prog.Consts["led"] != 1 {
+		t.Errorf("expected led 1, got %v", prog.Consts)
+	}
+
+	_, err = parseWhen(t, whenInput, map[string]int{"bord": 2, "board": 2, "debgu": 1})
+	want := "0:0: -D bord: no constant or when block uses bord\n0:0: -D debgu: no constant or when block uses debgu\n"
+	if err == nil || err.Error() != want {
+		t.Errorf("expected\n%sgot\n%v", want, err)
+	}
+}
+
+func TestParseDefine(t *testing.T) {
+	tests := []struct {
+		arg  string
+		name string
+		val  int
+		msg  string
+	}{
+		{"board=2", "board", 2, ""},
+		{"mask=$F0", "mask", 0xF0, ""},
+		{"bits=%1010_0000", "bits", 0xA0, ""},
+		{"debug", "debug", 1, ""},
+		{"board=x", "", 0, "expected name=number"},
+		{"=2", "", 0, "expected name=number"},
+		{"board=1 2", "", 0, "expected name=number"},
+		{"tick=1ms", "", 0, "expected name=number"},
+	}
+	for _, tt := range tests {
+		name, val, err := ParseDefine(tt.arg)
+		if tt.msg != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("%s: expected error containing %q, got %v", tt.arg, tt.msg, err)
+			}
+			continue
+		}
+		if err != nil || name != tt.name || val != tt.val {
+			t.Errorf("%s: expected %s = %d, got %s = %d (%v)", tt.arg, tt.name, tt.val, name, val, err)
+		}
+	}
+}
+
+func TestWhenErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		msg   string
+	}{
+		{"section constants\nwhen later begin\nend\nlater: 1\n", "later is not a constant declared before this when"},
+		{"section data\ncommon:\n  x i8\nsection program\nfn main() begin\n  when x begin\n  end\nend\n", "x is not a constant declared before this when"},
+		{"section constants\nwhen &x begin\nend\n", "when needs a constant condition"},
+		{"section constants\nwhen 1\n  a: 1\nend\n", "expected begin after when condition"},
+		{"section constants\nwhen 1 begin\n  a: 1\nsection data\n", "expected end after when block"},
+	}
+	for _, tt := range tests {
+		_, err := parseWhen(t, tt.input, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.msg, err)
+		}
+	}
+}